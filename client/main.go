@@ -1,9 +1,14 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"log/slog"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/CapacitorSet/bizarre-net/lib/client"
 )
@@ -19,14 +24,33 @@ func main() {
 		return
 	}
 
-	srv, err := client.NewClient(clientConf)
+	err := client.ApplyConfigFile(flagset, clientConf)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	// Transports and sources log to the default logger
+	logger, err := clientConf.LogConfig.NewLogger(os.Stderr)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
-	err = srv.Run()
+	slog.SetDefault(logger)
+
+	srv, err := client.NewClient(clientConf)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
+	// Run closes the client when it returns, which restores the routes
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	err = srv.Run(ctx)
+	var exitErr client.ExitError
+	if errors.As(err, &exitErr) {
+		os.Exit(exitErr.Status)
+	} else if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 }
@@ -1,39 +1,85 @@
 package bizarre_net
 
 import (
-	"errors"
+	"flag"
+	"fmt"
+	"reflect"
+	"strings"
 
 	"github.com/BurntSushi/toml"
+
+	"github.com/CapacitorSet/bizarre-net/transports"
 )
 
-type Config struct {
-	Transport        string
-	SendHello        bool
-	DropChatter      bool
-	SkipRoutingCheck bool
-	TUN              TUNConfig `toml:"tun"`
-	UDP              toml.Primitive
-	Cat              toml.Primitive
-	Socket           toml.Primitive
+// DecodeConfigFile decodes a TOML config file. Each top-level key is decoded into the matching entry of fields
+// (matched case-insensitively), and each section named after a registered transport (eg. [udp]) into that
+// transport's config. Values that are missing from the file are left untouched, so fields can hold defaults.
+// Unknown keys are reported as errors, to catch typos.
+func DecodeConfigFile(file string, fields map[string]interface{}, transportConfig *transports.TransportConfig) error {
+	var sections map[string]toml.Primitive
+	md, err := toml.DecodeFile(file, &sections)
+	if err != nil {
+		return err
+	}
+	if transportConfig.Configs == nil {
+		*transportConfig = transports.NewTransportConfig()
+	}
+
+	lowercaseFields := make(map[string]interface{})
+	for key, field := range fields {
+		lowercaseFields[strings.ToLower(key)] = field
+	}
+
+	for key, section := range sections {
+		if field, ok := lowercaseFields[strings.ToLower(key)]; ok {
+			err = md.PrimitiveDecode(section, field)
+		} else if transportSection, ok := transportConfig.Configs[key]; ok {
+			err = md.PrimitiveDecode(section, transportSection)
+		} else {
+			return fmt.Errorf("%s: unknown key %q", file, key)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: decoding %q: %w", file, key, err)
+		}
+	}
+
+	if undecoded := md.Undecoded(); len(undecoded) != 0 {
+		return fmt.Errorf("%s: unknown key %q", file, undecoded[0].String())
+	}
+	return nil
 }
 
-func ReadConfig(file string) (Config, toml.MetaData, error) {
-	// Defaults
-	config := Config{
-		TUN: TUNConfig{
-			Prefix:       "bizarre",
-			SetDefaultGW: true,
-		},
-		SendHello:        true,
-		DropChatter:      true,
-		SkipRoutingCheck: false,
-	}
-	md, err := toml.DecodeFile(file, &config)
+// ApplyConfigFile reads the file given with the -config flag, if any, using read. It must be called after the flags
+// are parsed; flags that were set explicitly take precedence over the values in the file.
+func ApplyConfigFile(flags *flag.FlagSet, read func(file string) error) error {
+	configFlag := flags.Lookup("config")
+	if configFlag == nil || configFlag.Value.String() == "" {
+		return nil
+	}
+	// The values of the explicit flags are restored as they are, rather than set again from their string form: that
+	// would add the values of repeatable flags (eg. -L) a second time.
+	explicit := make(map[string]reflect.Value)
+	flags.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = saveFlag(f.Value)
+	})
+	err := read(configFlag.Value.String())
 	if err != nil {
-		return Config{}, toml.MetaData{}, err
+		return err
 	}
-	if config.Transport == "" {
-		return Config{}, toml.MetaData{}, errors.New("no transport selected")
+	for name, saved := range explicit {
+		reflect.ValueOf(flags.Lookup(name).Value).Elem().Set(saved)
+	}
+	return nil
+}
+
+// saveFlag returns a copy of the value that a flag points to, including the elements of lists.
+func saveFlag(value flag.Value) reflect.Value {
+	current := reflect.ValueOf(value).Elem()
+	saved := reflect.New(current.Type()).Elem()
+	if current.Kind() == reflect.Slice && !current.IsNil() {
+		saved.Set(reflect.AppendSlice(reflect.MakeSlice(current.Type(), 0, current.Len()), current))
+	} else {
+		saved.Set(current)
 	}
-	return config, md, nil
+	return saved
 }
@@ -0,0 +1,111 @@
+package bizarre_net
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/CapacitorSet/bizarre-net/transports"
+)
+
+// writeConfig writes a config file for a test, returning its path.
+func writeConfig(t *testing.T, contents string) string {
+	file := filepath.Join(t.TempDir(), "config.toml")
+	err := os.WriteFile(file, []byte(contents), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestDecodeConfigFile(t *testing.T) {
+	var transportConfig transports.TransportConfig
+	var dropBroadcast bool
+	var timeout time.Duration
+	section := struct{ Name string }{Name: "default"}
+	fields := map[string]interface{}{"dropBroadcast": &dropBroadcast, "timeout": &timeout, "tun": &section}
+	file := writeConfig(t, "dropbroadcast = true\ntimeout = \"5s\"\n\n[udp]\nendpoint = \"203.0.113.1:1917\"\n")
+	err := DecodeConfigFile(file, fields, &transportConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dropBroadcast || timeout != 5*time.Second {
+		t.Errorf("got dropBroadcast = %t and timeout = %s", dropBroadcast, timeout)
+	}
+	// Sections missing from the file keep their defaults
+	if section.Name != "default" {
+		t.Errorf("got name %q, expected the default", section.Name)
+	}
+	if endpoint := transportConfig.Configs["udp"].(*transports.UDPConfig).Endpoint; endpoint != "203.0.113.1:1917" {
+		t.Errorf("got the UDP endpoint %q", endpoint)
+	}
+
+	for contents, key := range map[string]string{
+		"dropBroadcats = true\n":            "dropBroadcats",
+		"[tun]\nname = \"tun0\"\nmtu = 1\n": "tun.mtu",
+		"[udp]\nendpont = \"localhost\"\n":  "udp.endpont",
+		"[carrier-pigeon]\nbirds = 2\n":     "carrier-pigeon",
+	} {
+		err := DecodeConfigFile(writeConfig(t, contents), fields, &transportConfig)
+		if err == nil || !strings.Contains(err.Error(), key) {
+			t.Errorf("%q: expected an error about %s, got %v", contents, key, err)
+		}
+	}
+}
+
+// repeatable is a flag that can be given more than once, like -L.
+type repeatable []string
+
+func (r *repeatable) String() string {
+	return strings.Join(*r, ",")
+}
+
+func (r *repeatable) Set(value string) error {
+	*r = append(*r, value)
+	return nil
+}
+
+func TestApplyConfigFile(t *testing.T) {
+	var name, address string
+	var port int
+	var forwards, allowed repeatable
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	flags.String("config", "", "")
+	flags.StringVar(&name, "name", "flag default", "")
+	flags.StringVar(&address, "address", "flag default", "")
+	flags.IntVar(&port, "port", 1, "")
+	flags.Var(&forwards, "L", "")
+	flags.Var(&allowed, "allow", "")
+	file := writeConfig(t, "name = \"from the file\"\naddress = \"from the file\"\nport = 2\nforwards = [\"9000:b:90\"]\nallow = [\"uptime\"]\n")
+	err := flags.Parse([]string{"-config", file, "-port", "3", "-address", "flag default", "-L", "8080:a:80", "-allow", "ls *", "-allow", "df"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ApplyConfigFile(flags, func(file string) error {
+		var transportConfig transports.TransportConfig
+		return DecodeConfigFile(file, map[string]interface{}{
+			"name": &name, "address": &address, "port": &port, "forwards": &forwards, "allow": &allowed,
+		}, &transportConfig)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "from the file" {
+		t.Errorf("got name %q, expected the value in the file", name)
+	}
+	// Flags given on the command line win, even when they are set to their default value
+	if port != 3 || address != "flag default" {
+		t.Errorf("got port %d and address %q, expected the flags", port, address)
+	}
+	// Repeatable flags replace the lists in the file, and keep each value once
+	if len(forwards) != 1 || forwards[0] != "8080:a:80" {
+		t.Errorf("got the forwards %q", forwards)
+	}
+	if len(allowed) != 2 || allowed[0] != "ls *" || allowed[1] != "df" {
+		t.Errorf("got the patterns %q", allowed)
+	}
+}
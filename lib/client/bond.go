@@ -0,0 +1,271 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	bizarre "github.com/CapacitorSet/bizarre-net"
+	"github.com/CapacitorSet/bizarre-net/transports"
+)
+
+var (
+	_ transports.ClientTransport = (*Bond)(nil)
+	_ transports.PayloadLimiter  = (*Bond)(nil)
+)
+
+type BondMode string
+
+const (
+	// BondFailover sends everything on the most preferred healthy transport
+	BondFailover BondMode = "failover"
+	// BondStripe spreads packets across every healthy transport to aggregate bandwidth
+	BondStripe BondMode = "stripe"
+)
+
+type BondConfig struct {
+	Mode           BondMode
+	ProbeInterval  time.Duration // How often every transport is probed with a ping
+	SilenceTimeout time.Duration // A transport that received nothing for this long is considered down
+}
+
+// TransportStats holds the statistics of a single transport in a Bond.
+type TransportStats struct {
+	Name            string
+	Healthy         bool
+	PacketsSent     uint64
+	BytesSent       uint64
+	PacketsReceived uint64
+	BytesReceived   uint64
+	WriteErrors     uint64
+	LastReceived    time.Time
+	RTT             time.Duration // Round-trip time of the last answered probe
+}
+
+type bondMember struct {
+	transports.ClientTransport
+
+	sync.Mutex
+	stats    TransportStats
+	pingSent time.Time
+}
+
+// Bond is a ClientTransport that uses several transports at once, switching between them when one goes silent
+// (BondFailover) or striping packets across them (BondStripe).
+type Bond struct {
+	Config  BondConfig
+	members []*bondMember
+	log     *slog.Logger
+
+	lock sync.Mutex
+	next int // Index of the next transport to use in stripe mode
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func NewBond(config BondConfig, members []transports.NamedClientTransport, logger *slog.Logger) (*Bond, error) {
+	if config.Mode != BondFailover && config.Mode != BondStripe {
+		return nil, fmt.Errorf("unknown bonding mode %q", config.Mode)
+	}
+	if config.ProbeInterval <= 0 {
+		return nil, fmt.Errorf("the probe interval must be positive, got %s", config.ProbeInterval)
+	}
+	if config.SilenceTimeout <= 0 {
+		return nil, fmt.Errorf("the silence timeout must be positive, got %s", config.SilenceTimeout)
+	}
+	bond := &Bond{Config: config, log: logger, closed: make(chan struct{})}
+	now := time.Now()
+	for _, member := range members {
+		bond.members = append(bond.members, &bondMember{
+			ClientTransport: member.ClientTransport,
+			// Transports are presumed healthy until they fail to answer probes
+			stats: TransportStats{Name: member.Name, Healthy: true, LastReceived: now},
+		})
+	}
+	return bond, nil
+}
+
+// MaxPayload implements transports.PayloadLimiter: messages must fit in every transport, as any of them may carry
+// them.
+func (B *Bond) MaxPayload() int {
+	var members []interface{}
+	for _, member := range B.members {
+		members = append(members, member.ClientTransport)
+	}
+	return transports.MaxPayload(members...)
+}
+
+// Stats returns a snapshot of the statistics of every transport, in order of preference.
+func (B *Bond) Stats() []TransportStats {
+	var ret []TransportStats
+	for _, member := range B.members {
+		member.Lock()
+		ret = append(ret, member.stats)
+		member.Unlock()
+	}
+	return ret
+}
+
+// Listen listens on every transport until the bond is closed. A transport that fails is only reported, as the others
+// carry on; Listen fails when all of them did.
+func (B *Bond) Listen(ch chan<- []byte) error {
+	errs := make(chan error, len(B.members))
+	for _, member := range B.members {
+		memberChan := make(chan []byte)
+		go func(member *bondMember) {
+			err := member.Listen(memberChan)
+			close(memberChan)
+			if err != nil {
+				B.log.Warn("Transport failed", "transport", member.stats.Name, "error", err)
+			}
+			errs <- err
+		}(member)
+		go B.memberLoop(member, memberChan, ch)
+	}
+	go B.probeLoop()
+
+	var failed []error
+	for range B.members {
+		if err := <-errs; err != nil {
+			failed = append(failed, err)
+		}
+	}
+	if len(failed) == len(B.members) {
+		return fmt.Errorf("all transports failed: %w", errors.Join(failed...))
+	}
+	return nil
+}
+
+// Close stops probing and closes every transport.
+func (B *Bond) Close() error {
+	var errs []error
+	B.closeOnce.Do(func() {
+		close(B.closed)
+		for _, member := range B.members {
+			errs = append(errs, member.Close())
+		}
+	})
+	return errors.Join(errs...)
+}
+
+func (B *Bond) memberLoop(member *bondMember, memberChan <-chan []byte, ch chan<- []byte) {
+	for packet := range memberChan {
+		member.Lock()
+		member.stats.PacketsReceived++
+		member.stats.BytesReceived += uint64(len(packet))
+		member.stats.LastReceived = time.Now()
+		msg, err := bizarre.ParseMessage(packet)
+		isPong := err == nil && msg.Type == bizarre.MessagePong
+		if isPong && !member.pingSent.IsZero() {
+			member.stats.RTT = time.Since(member.pingSent)
+			member.pingSent = time.Time{}
+		}
+		member.Unlock()
+		if isPong {
+			B.updateHealth()
+			continue
+		}
+		ch <- packet
+	}
+}
+
+// probeLoop periodically pings every transport and updates their health.
+func (B *Bond) probeLoop() {
+	ticker := time.NewTicker(B.Config.ProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-B.closed:
+			return
+		}
+		for _, member := range B.members {
+			member.Lock()
+			member.pingSent = time.Now()
+			member.Unlock()
+			// Probes go out in a goroutine, as request-response transports like DNS block until the reply arrives
+			go func(member *bondMember) {
+				B.writeTo(member, bizarre.Message{Type: bizarre.MessagePing}.Marshal())
+			}(member)
+		}
+		B.updateHealth()
+	}
+}
+
+// updateHealth marks transports as healthy or not, and reports when the most preferred healthy transport, which is
+// the one in use in failover mode, changes.
+func (B *Bond) updateHealth() {
+	B.lock.Lock()
+	defer B.lock.Unlock()
+	previous, active := -1, -1
+	for i, member := range B.members {
+		member.Lock()
+		if member.stats.Healthy && previous == -1 {
+			previous = i
+		}
+		member.stats.Healthy = time.Since(member.stats.LastReceived) < B.Config.SilenceTimeout
+		if member.stats.Healthy && active == -1 {
+			active = i
+		}
+		member.Unlock()
+	}
+	if active != previous {
+		if active == -1 {
+			B.log.Warn("No transport is healthy")
+		} else {
+			B.log.Info("Switching transport", "transport", B.members[active].stats.Name)
+		}
+	}
+}
+
+func (B *Bond) writeTo(member *bondMember, payload []byte) (int, error) {
+	n, err := member.Write(payload)
+	member.Lock()
+	if err != nil {
+		member.stats.WriteErrors++
+	} else {
+		member.stats.PacketsSent++
+		member.stats.BytesSent += uint64(n)
+	}
+	member.Unlock()
+	return n, err
+}
+
+// candidates returns the transports to try for the next packet, best first.
+func (B *Bond) candidates() []*bondMember {
+	B.lock.Lock()
+	defer B.lock.Unlock()
+	var healthy, unhealthy []*bondMember
+	for _, member := range B.members {
+		member.Lock()
+		if member.stats.Healthy {
+			healthy = append(healthy, member)
+		} else {
+			unhealthy = append(unhealthy, member)
+		}
+		member.Unlock()
+	}
+	if B.Config.Mode == BondStripe && len(healthy) != 0 {
+		B.next = (B.next + 1) % len(healthy)
+		healthy = append(healthy[B.next:], healthy[:B.next]...)
+	}
+	// If everything is down, keep trying in order of preference rather than giving up
+	return append(healthy, unhealthy...)
+}
+
+// Write sends the payload on the best transport, falling back to the next ones if it fails.
+func (B *Bond) Write(payload []byte) (int, error) {
+	var err error
+	for _, member := range B.candidates() {
+		var n int
+		n, err = B.writeTo(member, payload)
+		if err == nil {
+			return n, nil
+		}
+		B.log.Warn("Error writing to transport", "transport", member.stats.Name, "error", err)
+	}
+	return 0, fmt.Errorf("all transports failed: %w", err)
+}
@@ -0,0 +1,101 @@
+package client
+
+import (
+	"errors"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/CapacitorSet/bizarre-net/transports"
+)
+
+// fakeTransport records what is written to it, and fails writes if broken is set.
+type fakeTransport struct {
+	written [][]byte
+	broken  bool
+	closed  bool
+}
+
+func (T *fakeTransport) Listen(ch chan<- []byte) error {
+	return nil
+}
+
+func (T *fakeTransport) Close() error {
+	T.closed = true
+	return nil
+}
+
+func (T *fakeTransport) Write(payload []byte) (int, error) {
+	if T.broken {
+		return 0, errors.New("broken")
+	}
+	T.written = append(T.written, payload)
+	return len(payload), nil
+}
+
+func newTestBond(t *testing.T, mode BondMode) (*Bond, *fakeTransport, *fakeTransport) {
+	primary, fallback := &fakeTransport{}, &fakeTransport{}
+	bond, err := NewBond(BondConfig{Mode: mode, ProbeInterval: time.Second, SilenceTimeout: time.Minute}, []transports.NamedClientTransport{
+		{Name: "primary", ClientTransport: primary},
+		{Name: "fallback", ClientTransport: fallback},
+	}, slog.New(slog.DiscardHandler))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bond, primary, fallback
+}
+
+func TestBondFailover(t *testing.T) {
+	bond, primary, fallback := newTestBond(t, BondFailover)
+
+	bond.Write([]byte{1})
+	if len(primary.written) != 1 || len(fallback.written) != 0 {
+		t.Fatalf("expected the primary transport to be used")
+	}
+
+	// The primary goes silent
+	bond.members[0].stats.LastReceived = time.Now().Add(-time.Hour)
+	bond.updateHealth()
+	bond.Write([]byte{2})
+	if len(primary.written) != 1 || len(fallback.written) != 1 {
+		t.Fatalf("expected the fallback transport to be used")
+	}
+
+	// The fallback breaks too: writes go to the silent primary rather than nowhere
+	fallback.broken = true
+	_, err := bond.Write([]byte{3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(primary.written) != 2 {
+		t.Fatalf("expected the primary transport to be used as a last resort")
+	}
+	if stats := bond.Stats(); stats[1].WriteErrors != 1 || stats[0].Healthy {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestBondConfig(t *testing.T) {
+	members := []transports.NamedClientTransport{{Name: "primary", ClientTransport: &fakeTransport{}}}
+	for _, config := range []BondConfig{
+		{Mode: BondFailover, ProbeInterval: 0, SilenceTimeout: time.Minute},
+		{Mode: BondFailover, ProbeInterval: -time.Second, SilenceTimeout: time.Minute},
+		{Mode: BondFailover, ProbeInterval: time.Second},
+		{Mode: "random", ProbeInterval: time.Second, SilenceTimeout: time.Minute},
+	} {
+		_, err := NewBond(config, members, slog.New(slog.DiscardHandler))
+		if err == nil {
+			t.Errorf("%+v: expected an error", config)
+		}
+	}
+}
+
+func TestBondStripe(t *testing.T) {
+	bond, primary, fallback := newTestBond(t, BondStripe)
+	for i := 0; i < 10; i++ {
+		bond.Write([]byte{byte(i)})
+	}
+	if len(primary.written) != 5 || len(fallback.written) != 5 {
+		t.Fatalf("packets were not striped evenly: %d and %d", len(primary.written), len(fallback.written))
+	}
+}
@@ -1,144 +1,472 @@
 package client
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
-	"os"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
 
 	bizarre "github.com/CapacitorSet/bizarre-net"
+	"github.com/CapacitorSet/bizarre-net/metrics"
 	"github.com/CapacitorSet/bizarre-net/sources"
 	"github.com/CapacitorSet/bizarre-net/transports"
 )
 
-var (
-	debug = log.New(os.Stdout, "[debug] ", log.Ldate|log.Ltime|log.Lshortfile)
-	info  = log.New(os.Stdout, "[info]  ", log.Ldate|log.Ltime|log.Lshortfile)
-	warn  = log.New(os.Stdout, "[warn]  ", log.Ldate|log.Ltime|log.Lshortfile)
-)
-
 type ClientConfig struct {
 	SourceConfig    sources.SourceConfig
 	TransportConfig transports.TransportConfig
+	BondConfig      BondConfig // Used when more than one transport is selected
 
-	DropChatter bool
-	SendHello   bool
+	DropChatter      bool
+	SendHello        bool
+	SkipRoutingCheck bool // Do not check whether the TUN would route the transport endpoints into the tunnel
+	EndpointRoutes   bool // Route such endpoints through their current gateway, rather than refusing to start
+	LogConfig        bizarre.LogConfig
+	MetricsAddress   string // Where to serve Prometheus metrics on /metrics; empty to not serve them
+
+	// For programs that embed the client
+	Logger *slog.Logger // nil to use slog.Default(), which transports and sources log to as well
+	Events Events
 }
 
 func NewConfigFromFlags(flags *flag.FlagSet) *ClientConfig {
 	config := ClientConfig{}
+	flags.String("config", "", "Config file (flags take precedence over it)")
 	sources.PartialConfigFromFlags(&config.SourceConfig, flags) // todo: fix, we only need TUN config
 	transports.PartialConfigFromFlags(&config.TransportConfig, flags)
+	flags.StringVar((*string)(&config.BondConfig.Mode), "bond", string(BondFailover), "How to use multiple transports: failover or stripe")
+	flags.DurationVar(&config.BondConfig.ProbeInterval, "probe-interval", 5*time.Second, "How often transports are probed when using multiple transports")
+	flags.DurationVar(&config.BondConfig.SilenceTimeout, "silence-timeout", 15*time.Second, "How long a transport can be silent before switching to another one")
 	flags.BoolVar(&config.DropChatter, "drop-broadcast", true, "Do not send broadcast traffic")
+	flags.BoolVar(&config.SkipRoutingCheck, "skip-routing-check", false, "Do not check whether the TUN would route the transport endpoints into the tunnel itself")
+	flags.BoolVar(&config.EndpointRoutes, "endpoint-routes", true, "Route the transport endpoints that the TUN would capture through their current gateway (otherwise, refuse to start)")
+	bizarre.LogConfigFromFlags(&config.LogConfig, flags)
+	flags.StringVar(&config.MetricsAddress, "metrics", "", "Serve Prometheus metrics on this address, at /metrics (eg. 127.0.0.1:9100)")
 	// todo: figure out how to encode flag
 	config.SendHello = true
 	return &config
 }
 
+// ReadFile decodes a config file into the config, overriding the current values.
+func (config *ClientConfig) ReadFile(file string) error {
+	return bizarre.DecodeConfigFile(file, map[string]interface{}{
+		"transport":        &config.TransportConfig.Names,
+		"sendHello":        &config.SendHello,
+		"dropBroadcast":    &config.DropChatter,
+		"skipRoutingCheck": &config.SkipRoutingCheck,
+		"endpointRoutes":   &config.EndpointRoutes,
+		"bond":             &config.BondConfig,
+		"log":              &config.LogConfig,
+		"metrics":          &config.MetricsAddress,
+		"tun":              &config.SourceConfig.TUNConfig,
+		"tap":              &config.SourceConfig.TAPConfig,
+		"cmd":              &config.SourceConfig.CmdExecConfig,
+		"shell":            &config.SourceConfig.ShellConfig,
+		"files":            &config.SourceConfig.FileConfig,
+		"socks":            &config.SourceConfig.SOCKSConfig,
+		"netstack":         &config.SourceConfig.NetstackConfig,
+		"forward":          &config.SourceConfig.ForwardConfig,
+	}, &config.TransportConfig)
+}
+
+// ReadConfig reads a config file, starting from the same defaults as the command line.
+func ReadConfig(file string) (*ClientConfig, error) {
+	config := NewConfigFromFlags(flag.NewFlagSet("", flag.ContinueOnError))
+	err := config.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// ApplyConfigFile reads the config file given with -config, if any, after the flags were parsed.
+func ApplyConfigFile(flags *flag.FlagSet, config *ClientConfig) error {
+	return bizarre.ApplyConfigFile(flags, config.ReadFile)
+}
+
 type Client struct {
-	Source    sources.Source
+	Sources   []sources.Source // The ID of the stream of each source is its index
 	Transport transports.ClientTransport
 
-	Config  ClientConfig
-	errChan chan error
+	Config        ClientConfig
+	log           *slog.Logger
+	packets       *slog.Logger // For per-packet messages
+	session       *session
+	metrics       *metrics.Metrics
+	metricsServer *metrics.Server // nil unless MetricsAddress is set
+	errChan       chan error      // The first error of a goroutine, which stops Run
+	closed        chan struct{}
+	closeOnce     *sync.Once
 }
 
 // NewClient creates a Server object that contains the entire client-side logic.
-func NewClient(config *ClientConfig) (Client, error) {
-	source, err := sources.NewSource(config.SourceConfig)
+func NewClient(config *ClientConfig) (_ Client, err error) {
+	logger := config.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	packets := logger.With(bizarre.SubsystemKey, bizarre.SubsystemPacket)
+	if config.SourceConfig.PrintsOutput() && config.Events.CommandOutput == nil {
+		// Per-packet logs would be mixed with the output of the remote command
+		packets = slog.New(slog.DiscardHandler)
+	}
+	logger = logger.With(bizarre.SubsystemKey, bizarre.SubsystemClient)
+	var endpoints []net.IP
+	if config.SourceConfig.TUNConfig.Name != "" && !config.SkipRoutingCheck {
+		// Before the transports connect, as they would not reach the server through the tunnel they carry
+		endpoints, err = checkRouting(config, logger)
+		if err != nil {
+			return Client{}, err
+		}
+	}
+	selected, err := transports.NewClientTransports(config.TransportConfig)
 	if err != nil {
-		return Client{}, fmt.Errorf("creating source: %w", err)
+		return Client{}, fmt.Errorf("creating transport: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			// Close the connections of the transports, which a bond would otherwise close
+			for _, member := range selected {
+				member.Close()
+			}
+		}
+	}()
+	var transport transports.ClientTransport
+	if len(selected) == 1 {
+		transport = selected[0].ClientTransport
+	} else {
+		transport, err = NewBond(config.BondConfig, selected, logger.With(bizarre.SubsystemKey, bizarre.SubsystemTransport))
+		if err != nil {
+			return Client{}, fmt.Errorf("creating transport: %w", err)
+		}
 	}
 
-	// Todo: check if endpoint IP is routed via TUN
-	transport, err := transports.NewClientTransport(config.TransportConfig)
+	// The sources are created after the transport, whose payload limit sets their MTU
+	sourceConfig := config.SourceConfig
+	err = sourceConfig.LimitMTU(transports.MaxPayload(transport))
 	if err != nil {
-		return Client{}, fmt.Errorf("creating transport: %w", err)
+		return Client{}, err
+	}
+	sourceConfig.ExcludeEndpoints(endpoints)
+	clientSources, err := sources.NewSources(sourceConfig)
+	if err != nil {
+		return Client{}, fmt.Errorf("creating source: %w", err)
 	}
+	if config.Events.CommandOutput != nil {
+		stdout := outputWriter{kind: bizarre.MessageStdout, callback: config.Events.CommandOutput}
+		stderr := outputWriter{kind: bizarre.MessageStderr, callback: config.Events.CommandOutput}
+		for _, source := range clientSources {
+			switch source := source.(type) {
+			case *sources.CmdExecSource:
+				source.Stdout, source.Stderr = stdout, stderr
+			case *sources.ShellSource:
+				source.Stdout, source.Stderr = stdout, stderr
+			}
+		}
+	}
+
+	C := Client{Sources: clientSources, Transport: transport, Config: *config, log: logger, packets: packets, session: &session{}, errChan: make(chan error, 1), closed: make(chan struct{}), closeOnce: new(sync.Once)}
+	C.metrics = metrics.New(C.sessionCount)
+	if bond, ok := transport.(*Bond); ok {
+		for i, member := range selected {
+			C.metrics.RTT(member.Name, func() time.Duration {
+				return bond.Stats()[i].RTT
+			})
+		}
+	} else {
+		C.metrics.RTT(selected[0].Name, C.helloRTT)
+	}
+	if config.MetricsAddress != "" {
+		C.metricsServer, err = C.metrics.Listen(config.MetricsAddress)
+		if err != nil {
+			for _, source := range clientSources {
+				source.Close()
+			}
+			return Client{}, fmt.Errorf("serving metrics: %w", err)
+		}
+	}
+	return C, nil
+}
 
-	return Client{Source: source, Transport: transport, Config: *config, errChan: make(chan error)}, nil
+// Metrics returns the metrics of the client, whose Handler can be served by programs that embed it.
+func (C Client) Metrics() *metrics.Metrics {
+	return C.metrics
 }
 
-func (C Client) sourceLoop(sourceChan <-chan []byte) {
-	for packet := range sourceChan {
-		if pkt := bizarre.TryParse(packet); pkt != nil {
+// Close stops the client, closing the transport and the sources, which restores the routes that the TUN changed.
+// Run returns nil once the client is closed.
+func (C Client) Close() error {
+	var errs []error
+	C.closeOnce.Do(func() {
+		close(C.closed)
+		errs = append(errs, C.Transport.Close())
+		for _, source := range C.Sources {
+			errs = append(errs, source.Close())
+		}
+		if C.metricsServer != nil {
+			errs = append(errs, C.metricsServer.Close())
+		}
+	})
+	return errors.Join(errs...)
+}
+
+// fail stops Run with an error, unless it is already stopping.
+func (C Client) fail(err error) {
+	select {
+	case C.errChan <- err:
+	default:
+	}
+}
+
+func (C Client) sourceLoop(stream uint16, sourceChan <-chan bizarre.Message) {
+	for msg := range sourceChan {
+		if msg.Type == bizarre.MessageIP {
+			pkt := bizarre.TryParse(msg.Payload)
+			if pkt == nil {
+				print_len := 10
+				if len(msg.Payload) < print_len {
+					print_len = len(msg.Payload)
+				}
+				C.packets.Warn("Dropping packet: not an IP packet", "stream", stream, "begins", fmt.Sprintf("%x", msg.Payload[:print_len]))
+				C.drop(bizarre.DropNotIP, msg.Payload)
+				continue
+			}
 			if C.Config.DropChatter && bizarre.IsChatter(pkt) {
-				debug.Println("Dropping packet: chatter")
+				C.packets.Debug("Dropping packet: chatter", "stream", stream, "packet", bizarre.LogPacket(pkt))
+				C.drop(bizarre.DropChatter, msg.Payload)
 				continue
 			}
-			debug.Printf("Source received: %s type=%s bytes=%d", bizarre.FlowString(pkt), bizarre.LayerString(pkt), len(packet))
-		} else if packet[0] == sources.CMD_EXEC_CMD_HEADER {
-			debug.Printf("Source received: CmdExec packet bytes=%d", len(packet)-1)
-		} else {
-			print_len := 10
-			if len(packet) < print_len {
-				print_len = len(packet)
+			C.packets.Debug("Source received", "stream", stream, "packet", bizarre.LogPacket(pkt), "bytes", len(msg.Payload))
+		} else if msg.Type == bizarre.MessageEthernet {
+			pkt := bizarre.TryParseFrame(msg.Payload)
+			if pkt == nil {
+				C.packets.Warn("Dropping frame: not an Ethernet frame", "stream", stream)
+				C.drop(bizarre.DropNotIP, msg.Payload)
+				continue
 			}
-			warn.Printf("Dropping packet: not an IP packet (begins with %x)", packet[:print_len])
-			continue
+			if C.Config.DropChatter && bizarre.IsChatter(pkt) {
+				C.packets.Debug("Dropping frame: chatter", "stream", stream, "frame", bizarre.LogFrame(pkt))
+				C.drop(bizarre.DropChatter, msg.Payload)
+				continue
+			}
+			C.packets.Debug("Source received", "stream", stream, "frame", bizarre.LogFrame(pkt), "bytes", len(msg.Payload))
+		} else {
+			C.packets.Debug("Source received", "stream", stream, "type", msg.Type.String(), "bytes", len(msg.Payload))
 		}
-		// todo: WriteToServer
-		n, err := C.Transport.Write(packet)
+		msg.Stream = stream
+		n, err := C.send(msg)
 		if err != nil {
-			warn.Println("Error writing packet to transport: " + err.Error())
+			C.packets.Warn("Error writing packet to transport", "error", err)
+			C.drop(bizarre.DropTransportError, msg.Payload)
 			continue
 		}
-		debug.Printf("Wrote %d bytes to transport", n)
+		C.packets.Debug("Wrote to transport", "bytes", n)
 	}
 }
 
 func (C Client) transportLoop(transportChan <-chan []byte) {
 	for packet := range transportChan {
-		packetPreviewLen := 10
-		if len(packet) < packetPreviewLen {
-			packetPreviewLen = len(packet)
+		C.metrics.Message(metrics.Received, len(packet))
+		msg, err := bizarre.ParseMessage(packet)
+		if err != nil {
+			C.packets.Warn("Dropping packet received from transport", "error", err)
+			C.drop(bizarre.DropMalformed, packet)
+			continue
 		}
-		debug.Printf("Received %d bytes (starting with %x)", len(packet), packet[:packetPreviewLen])
-		if pkt := bizarre.TryParse(packet); pkt != nil {
-			if C.Config.DropChatter && bizarre.IsChatter(pkt) {
+		C.packets.Debug("Transport received", "stream", msg.Stream, "type", msg.Type.String(), "bytes", len(msg.Payload))
+		C.received(msg)
+		switch msg.Type {
+		case bizarre.MessageHelloAck:
+			C.log.Debug("Received hello-ack")
+			ack, err := bizarre.ParseHelloAck(msg.Payload)
+			if err != nil {
+				C.log.Warn("Ignoring the address in the hello-ack", "error", err)
+			}
+			C.addressNetstacks(ack.Address)
+		case bizarre.MessagePong:
+			// Only meaningful to Bond, which consumes them
+		default:
+			if int(msg.Stream) >= len(C.Sources) {
+				C.packets.Warn("Dropping packet: unknown stream", "stream", msg.Stream)
+				C.drop(bizarre.DropUnknownStream, msg.Payload)
 				continue
 			}
+			if msg.Type == bizarre.MessageIP {
+				if pkt := bizarre.TryParse(msg.Payload); pkt != nil {
+					if C.Config.DropChatter && bizarre.IsChatter(pkt) {
+						C.drop(bizarre.DropChatter, msg.Payload)
+						continue
+					}
+					C.packets.Debug("Transport received", "stream", msg.Stream, "packet", bizarre.LogPacket(pkt), "bytes", len(msg.Payload))
+				}
+			} else if msg.Type == bizarre.MessageEthernet {
+				if pkt := bizarre.TryParseFrame(msg.Payload); pkt != nil {
+					if C.Config.DropChatter && bizarre.IsChatter(pkt) {
+						C.drop(bizarre.DropChatter, msg.Payload)
+						continue
+					}
+					C.packets.Debug("Transport received", "stream", msg.Stream, "frame", bizarre.LogFrame(pkt), "bytes", len(msg.Payload))
+				}
+			}
 
-			debug.Printf("Transport received: %s type=%s bytes=%d", bizarre.FlowString(pkt), bizarre.LayerString(pkt), len(packet))
-
-			err := C.Source.Write(packet)
+			err := C.Sources[msg.Stream].Write(msg)
 			if err != nil {
-				warn.Println("Error writing packet to TUN: " + err.Error())
+				C.packets.Warn("Error writing packet to source", "stream", msg.Stream, "error", err)
+				C.drop(bizarre.DropNetworkError, msg.Payload)
 				continue
 			}
-			debug.Printf("Wrote %d bytes to TUN", len(packet))
-		} else if hello := bizarre.TryParseHelloAck(packet); hello {
-			debug.Println("net=>tun: hello-ack")
-			warn.Println("todo: process hello-ack")
-		} else if packet[0] == sources.CMD_EXEC_STDOUT_HEADER {
-			info.Printf("Command output: %s", packet[1:])
-		} else {
-			warn.Printf("Unknown packet received from transport! %d bytes, starts with %x", len(packet), packet[:10])
+			C.packets.Debug("Wrote to source", "stream", msg.Stream, "bytes", len(msg.Payload))
+		}
+	}
+}
+
+// send sends a message to the server.
+func (C Client) send(msg bizarre.Message) (int, error) {
+	n, err := C.Transport.Write(msg.Marshal())
+	if err == nil {
+		C.metrics.Message(metrics.Sent, n)
+	}
+	return n, err
+}
+
+// waitsForAddress returns whether a network stack of the client waits for the server to assign it an address.
+func (C Client) waitsForAddress() bool {
+	for _, source := range C.Sources {
+		if netstack, ok := source.(*sources.NetstackSource); ok && netstack.NeedsAddress() {
+			return true
+		}
+	}
+	return false
+}
+
+// addressNetstacks gives the network stacks that wait for an address the one that the server assigned, or the default
+// one if it is invalid, as servers that cannot assign addresses leave it out.
+func (C Client) addressNetstacks(addr netip.Addr) {
+	if !addr.IsValid() {
+		addr = netip.MustParseAddr(sources.ClientNetstackIP)
+	}
+	for _, source := range C.Sources {
+		netstack, ok := source.(*sources.NetstackSource)
+		if !ok || !netstack.NeedsAddress() {
+			continue
+		}
+		err := netstack.SetAddress(addr)
+		if err != nil {
+			C.log.Warn("Could not set the address of the network stack", "ip", addr.String(), "error", err)
+			continue
 		}
+		C.log.Info("Network stack is up", "ip", addr.String())
 	}
 }
 
-func (C Client) Run() error {
-	sourceChan := make(chan []byte)
-	go C.sourceLoop(sourceChan)
-	go C.Source.Start(sourceChan)
+// ExitError is returned by Run when a remote command exits with a non-zero status.
+type ExitError struct {
+	Status int
+}
+
+func (e ExitError) Error() string {
+	return fmt.Sprintf("remote command exited with status %d", e.Status)
+}
 
-	// Maps the in-tunnel source IP of the host to its transport address (used in WriteTo for datagram transports)
-	// clientAddr := make(map[string]interface{})
+// Run runs the client until every source that completes (such as remote commands) is done, the context is done,
+// the client is closed, or the transport or a source fails. It closes the client before returning.
+func (C Client) Run(ctx context.Context) (err error) {
+	defer func() {
+		closeErr := C.Close()
+		if err == nil {
+			err = closeErr
+		}
+		C.stopped(err)
+	}()
+
+	for i, source := range C.Sources {
+		sourceChan := make(chan bizarre.Message)
+		go C.sourceLoop(uint16(i), sourceChan)
+		go func(stream int, source sources.Source) {
+			err := source.Start(sourceChan)
+			if err != nil {
+				C.fail(fmt.Errorf("source %d: %w", stream, err))
+			}
+		}(i, source)
+	}
+
+	if C.metricsServer != nil {
+		go func() {
+			err := C.metricsServer.Serve()
+			if err != nil {
+				C.fail(fmt.Errorf("serving metrics: %w", err))
+			}
+		}()
+	}
 
 	transportChan := make(chan []byte)
 	go C.transportLoop(transportChan)
-	go C.Transport.Listen(transportChan)
+	go func() {
+		err := C.Transport.Listen(transportChan)
+		close(transportChan)
+		if err != nil {
+			C.fail(fmt.Errorf("transport: %w", err))
+		}
+	}()
 
 	if C.Config.SendHello {
-		debug.Println("Sending hello")
-		// todo: WriteToServer
-		_, err := C.Transport.Write(bizarre.HELLO_PREFIX)
+		C.log.Debug("Sending hello")
+		hello := bizarre.Message{Type: bizarre.MessageHello}
+		if C.waitsForAddress() {
+			hello.Flags |= bizarre.FlagAddress
+		}
+		C.helloSent()
+		_, err := C.send(hello)
 		if err != nil {
-			warn.Printf("Could not send hello: %s", err)
+			C.log.Warn("Could not send hello", "error", err)
+			C.metrics.HandshakeFailed()
 			return err
 		}
+		timer := time.AfterFunc(helloTimeout, C.checkHello)
+		defer timer.Stop()
+	} else {
+		// No server will assign an address
+		C.addressNetstacks(netip.Addr{})
 	}
 
-	return <-C.errChan
+	var finishing []<-chan int
+	for _, source := range C.Sources {
+		if finisher, ok := source.(sources.Finisher); ok {
+			finishing = append(finishing, finisher.Done())
+		}
+	}
+	if len(finishing) == 0 {
+		select {
+		case err := <-C.errChan:
+			return err
+		case <-C.closed:
+			return nil
+		case <-ctx.Done():
+			return nil
+		}
+	}
+	status := 0
+	for _, done := range finishing {
+		select {
+		case sourceStatus := <-done:
+			if status == 0 {
+				status = sourceStatus
+			}
+		case err := <-C.errChan:
+			return err
+		case <-C.closed:
+			return nil
+		case <-ctx.Done():
+			return nil
+		}
+	}
+	if status != 0 {
+		return ExitError{Status: status}
+	}
+	return nil
 }
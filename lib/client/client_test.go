@@ -0,0 +1,101 @@
+package client
+
+import (
+	"log/slog"
+	"testing"
+	"time"
+
+	bizarre "github.com/CapacitorSet/bizarre-net"
+	"github.com/CapacitorSet/bizarre-net/sources"
+	"github.com/CapacitorSet/bizarre-net/transports"
+)
+
+func init() {
+	// Fake transports, created from a *fakeTransport config
+	for _, name := range []string{"fake-primary", "fake-fallback"} {
+		transports.Register(transports.Registration{
+			Name:      name,
+			NewConfig: func() interface{} { return &fakeTransport{} },
+			NewClient: func(config interface{}) (transports.ClientTransport, error) {
+				return config.(*fakeTransport), nil
+			},
+		})
+	}
+}
+
+// fakeSource records the messages written to it.
+type fakeSource struct {
+	written []string
+}
+
+func (S *fakeSource) Start(ch chan bizarre.Message) error {
+	return nil
+}
+
+func (S *fakeSource) Write(msg bizarre.Message) error {
+	S.written = append(S.written, string(msg.Payload))
+	return nil
+}
+
+func (S *fakeSource) Close() error {
+	return nil
+}
+
+// TestStreams checks that messages from the server reach the source of their stream, and that those for other streams
+// are dropped.
+func TestStreams(t *testing.T) {
+	first, second := &fakeSource{}, &fakeSource{}
+	var dropped []bizarre.DropReason
+	C := Client{
+		Sources: []sources.Source{first, second},
+		Config: ClientConfig{Events: Events{PacketDropped: func(reason bizarre.DropReason, packet []byte) {
+			dropped = append(dropped, reason)
+		}}},
+		log:     slog.New(slog.DiscardHandler),
+		packets: slog.New(slog.DiscardHandler),
+		session: &session{},
+	}
+	transportChan := make(chan []byte, 10)
+	for _, msg := range []bizarre.Message{
+		{Type: bizarre.MessageStdout, Stream: 0, Payload: []byte("a1")},
+		{Type: bizarre.MessageStdout, Stream: 1, Payload: []byte("b1")},
+		{Type: bizarre.MessageStdout, Stream: 2, Payload: []byte("c1")},
+		{Type: bizarre.MessageStdout, Stream: 1, Payload: []byte("b2")},
+		{Type: bizarre.MessageStdout, Stream: 0, Payload: []byte("a2")},
+	} {
+		transportChan <- msg.Marshal()
+	}
+	close(transportChan)
+	C.transportLoop(transportChan)
+
+	if len(first.written) != 2 || first.written[0] != "a1" || first.written[1] != "a2" {
+		t.Errorf("got %q on the first stream", first.written)
+	}
+	if len(second.written) != 2 || second.written[0] != "b1" || second.written[1] != "b2" {
+		t.Errorf("got %q on the second stream", second.written)
+	}
+	if len(dropped) != 1 || dropped[0] != bizarre.DropUnknownStream {
+		t.Errorf("expected the message for stream 2 to be dropped, got %v", dropped)
+	}
+}
+
+// TestNewClientCloses checks that the transports are closed when the client cannot be created.
+func TestNewClientCloses(t *testing.T) {
+	primary, fallback := &fakeTransport{}, &fakeTransport{}
+	config := ClientConfig{
+		TransportConfig: transports.TransportConfig{
+			Names:   []string{"fake-primary", "fake-fallback"},
+			Configs: map[string]interface{}{"fake-primary": primary, "fake-fallback": fallback},
+		},
+		// Bonding fails without a probe interval
+		BondConfig: BondConfig{Mode: BondFailover, SilenceTimeout: time.Minute},
+		Logger:     slog.New(slog.DiscardHandler),
+	}
+	_, err := NewClient(&config)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if !primary.closed || !fallback.closed {
+		t.Errorf("expected the transports to be closed, got %t and %t", primary.closed, fallback.closed)
+	}
+}
@@ -0,0 +1,140 @@
+package client
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+
+	bizarre "github.com/CapacitorSet/bizarre-net"
+)
+
+// How long the server has to answer the hello before the handshake is considered failed
+const helloTimeout = 10 * time.Second
+
+// Events are callbacks that report what happens in a client, for programs that embed it. They are called from the
+// goroutines of the client, which they block until they return; nil callbacks are skipped.
+type Events struct {
+	SessionUp     func()          // The server answered the hello
+	SessionDown   func(err error) // Run returned after the session was up, with the error it returned
+	PacketDropped func(reason bizarre.DropReason, packet []byte)
+	// CommandOutput receives the output of a remote command or shell (kind is MessageStdout or MessageStderr), which
+	// is then not printed
+	CommandOutput func(kind bizarre.MessageType, data []byte)
+}
+
+// State is a snapshot of the session of a client with its server.
+type State struct {
+	Up           bool          // Whether the server answered the hello
+	Since        time.Time     // When the server answered the hello
+	LastReceived time.Time     // When the last message from the server arrived
+	RTT          time.Duration // How long the server took to answer the hello
+	// The statistics of every transport, in order of preference, when more than one is used
+	Transports []TransportStats
+}
+
+// session tracks the state of the client, which is shared by its copies.
+type session struct {
+	sync.Mutex
+	up           bool
+	since        time.Time
+	lastReceived time.Time
+	helloSent    time.Time
+	rtt          time.Duration
+}
+
+// outputWriter passes what is written to it to Events.CommandOutput.
+type outputWriter struct {
+	kind     bizarre.MessageType
+	callback func(kind bizarre.MessageType, data []byte)
+}
+
+func (w outputWriter) Write(p []byte) (int, error) {
+	w.callback(w.kind, p)
+	return len(p), nil
+}
+
+// State returns a snapshot of the state of the session.
+func (C Client) State() State {
+	C.session.Lock()
+	state := State{Up: C.session.up, Since: C.session.since, LastReceived: C.session.lastReceived, RTT: C.session.rtt}
+	C.session.Unlock()
+	if bond, ok := C.Transport.(*Bond); ok {
+		state.Transports = bond.Stats()
+	}
+	return state
+}
+
+// received records that a message arrived from the server. For a hello-ack, it marks the session as up.
+func (C Client) received(msg bizarre.Message) {
+	C.session.Lock()
+	C.session.lastReceived = time.Now()
+	wentUp := msg.Type == bizarre.MessageHelloAck && !C.session.up
+	if wentUp {
+		C.session.up = true
+		C.session.since = C.session.lastReceived
+		if !C.session.helloSent.IsZero() {
+			C.session.rtt = C.session.since.Sub(C.session.helloSent)
+		}
+	}
+	C.session.Unlock()
+	if wentUp {
+		C.log.Info("Connected to the server")
+		if C.Config.Events.SessionUp != nil {
+			C.Config.Events.SessionUp()
+		}
+	}
+}
+
+// helloSent records when the hello was sent, to measure the round-trip time.
+func (C Client) helloSent() {
+	C.session.Lock()
+	C.session.helloSent = time.Now()
+	C.session.Unlock()
+}
+
+// checkHello reports a failed handshake if the server did not answer the hello, in which case the network stacks that
+// wait for an address from the server use the default one.
+func (C Client) checkHello() {
+	C.session.Lock()
+	up := C.session.up
+	C.session.Unlock()
+	if !up {
+		C.log.Warn("The server did not answer the hello", "timeout", helloTimeout)
+		C.metrics.HandshakeFailed()
+		C.addressNetstacks(netip.Addr{})
+	}
+}
+
+func (C Client) helloRTT() time.Duration {
+	C.session.Lock()
+	defer C.session.Unlock()
+	return C.session.rtt
+}
+
+// sessionCount returns 1 if the session is up, for the metrics.
+func (C Client) sessionCount() int {
+	C.session.Lock()
+	defer C.session.Unlock()
+	if C.session.up {
+		return 1
+	}
+	return 0
+}
+
+// stopped marks the session as down once Run returns.
+func (C Client) stopped(err error) {
+	C.session.Lock()
+	wasUp := C.session.up
+	C.session.up = false
+	C.session.Unlock()
+	if wasUp && C.Config.Events.SessionDown != nil {
+		C.Config.Events.SessionDown(err)
+	}
+}
+
+func (C Client) drop(reason bizarre.DropReason, packet []byte) {
+	C.metrics.Drop(reason)
+	if C.Config.Events.PacketDropped != nil {
+		C.Config.Events.PacketDropped(reason, packet)
+	}
+}
@@ -0,0 +1,36 @@
+package client
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+
+	"github.com/CapacitorSet/bizarre-net/transports"
+)
+
+// checkRouting resolves the endpoints of the transports, and checks whether the TUN would route them into the tunnel
+// itself. If so, it refuses to start unless EndpointRoutes is set, in which case it returns the endpoints for the TUN
+// to route them through their current gateway instead.
+func checkRouting(config *ClientConfig, logger *slog.Logger) ([]net.IP, error) {
+	endpoints, err := transports.ClientEndpoints(config.TransportConfig)
+	if err != nil {
+		return nil, fmt.Errorf("resolving transport endpoints: %w", err)
+	}
+	for _, ip := range endpoints {
+		captured, err := config.SourceConfig.TUNConfig.Captures(ip)
+		if err != nil {
+			return nil, err
+		}
+		if !captured {
+			continue
+		}
+		if !config.EndpointRoutes {
+			return nil, fmt.Errorf("the TUN would route the transport endpoint %s into the tunnel: exclude it with -exclude, or pass -endpoint-routes", ip)
+		}
+		logger.Info("Routing the transport endpoint outside of the TUN", "endpoint", ip)
+	}
+	if !config.EndpointRoutes {
+		return nil, nil
+	}
+	return endpoints, nil
+}
@@ -0,0 +1,39 @@
+package client
+
+import (
+	"flag"
+	"log/slog"
+	"testing"
+)
+
+func TestCheckRouting(t *testing.T) {
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	config := NewConfigFromFlags(flags)
+	logger := slog.New(slog.DiscardHandler)
+	err := flags.Parse([]string{"-transport", "udp", "-udp-address", "192.0.2.1:1917", "-tun", "bizarre0", "-tun-ip", "10.0.0.2/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	endpoints, err := checkRouting(config, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(endpoints) != 1 || endpoints[0].String() != "192.0.2.1" {
+		t.Errorf("got %v, expected the endpoint to be routed outside of the TUN", endpoints)
+	}
+
+	config.EndpointRoutes = false
+	if _, err = checkRouting(config, logger); err == nil {
+		t.Error("expected the default route to conflict with the endpoint")
+	}
+	config.SourceConfig.TUNConfig.Exclude = []string{"192.0.2.0/24"}
+	if _, err = checkRouting(config, logger); err != nil {
+		t.Errorf("expected no conflict with the endpoint excluded, got %s", err)
+	}
+	config.SourceConfig.TUNConfig.Exclude = nil
+	config.SourceConfig.TUNConfig.FwMark = 0x10
+	if _, err = checkRouting(config, logger); err != nil {
+		t.Errorf("expected no conflict with policy routing, got %s", err)
+	}
+}
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	bizarre "github.com/CapacitorSet/bizarre-net"
+	"github.com/CapacitorSet/bizarre-net/transports"
+)
+
+// Events are callbacks that report what happens in a server, for programs that embed it. They are called from the
+// goroutines of the server, which they block until they return; nil callbacks are skipped.
+type Events struct {
+	SessionUp     func(SessionState) // A client sent its first message
+	SessionDown   func(SessionState) // A client was silent for the session timeout, or the server stopped
+	PacketDropped func(reason bizarre.DropReason, packet []byte)
+}
+
+// SessionState is a snapshot of the state of a client of the server.
+type SessionState struct {
+	Transport string       // The name of the transport that the client uses
+	Address   string       // The address of the client on the transport
+	Addresses []netip.Addr // The addresses of the client in the tunnel, as seen in its packets
+	Since     time.Time    // When the first message of the client arrived
+	LastSeen  time.Time    // When the last message of the client arrived
+}
+
+// clientKey identifies a client by the transport it uses and its address on that transport.
+type clientKey struct {
+	Transport transports.ServerTransport
+	Address   string
+}
+
+// clients holds the state of the sessions, which is shared by the copies of the server.
+type clients struct {
+	sync.Mutex
+	states map[clientKey]*SessionState
+
+	// The addresses that the server assigns to the network stacks of clients that ask for one, so that clients
+	// using the same default address do not take over each other's packets
+	pool     netip.Prefix // Invalid if the server has no TUN or network stack
+	reserved []netip.Addr // The addresses of the server, which are never assigned
+	assigned map[clientKey]netip.Addr
+}
+
+func (s SessionState) clone() SessionState {
+	s.Addresses = slices.Clone(s.Addresses)
+	return s
+}
+
+// Sessions returns a snapshot of the state of every client, oldest first.
+func (S Server) Sessions() []SessionState {
+	S.clients.Lock()
+	var ret []SessionState
+	for _, state := range S.clients.states {
+		ret = append(ret, state.clone())
+	}
+	S.clients.Unlock()
+	slices.SortFunc(ret, func(a, b SessionState) int {
+		return a.Since.Compare(b.Since)
+	})
+	return ret
+}
+
+// seen records that a message arrived from a client, and reports the new ones.
+func (S *Server) seen(packet taggedPacket) {
+	key := clientKey{Transport: packet.Transport, Address: fmt.Sprint(packet.Address)}
+	now := time.Now()
+	S.clients.Lock()
+	state, ok := S.clients.states[key]
+	if !ok {
+		state = &SessionState{Transport: packet.TransportName, Address: key.Address, Since: now}
+		S.clients.states[key] = state
+	}
+	state.LastSeen = now
+	up := state.clone()
+	S.clients.Unlock()
+	if !ok {
+		S.log.Info("New client", "address", up.Address, "transport", up.Transport)
+		if S.Config.Events.SessionUp != nil {
+			S.Config.Events.SessionUp(up)
+		}
+	}
+}
+
+// learnAddress records an address of a client in the tunnel.
+func (S *Server) learnAddress(client session, addr netip.Addr) {
+	key := clientKey{Transport: client.Transport, Address: fmt.Sprint(client.Address)}
+	S.clients.Lock()
+	defer S.clients.Unlock()
+	if state, ok := S.clients.states[key]; ok && !slices.Contains(state.Addresses, addr) {
+		state.Addresses = append(state.Addresses, addr)
+	}
+}
+
+// hasAddress returns whether an address in the tunnel belongs to a client: either the server assigned it to the
+// client, or the client sent packets from it.
+func (S *Server) hasAddress(client session, addr netip.Addr) bool {
+	key := clientKey{Transport: client.Transport, Address: fmt.Sprint(client.Address)}
+	S.clients.Lock()
+	defer S.clients.Unlock()
+	if assigned, ok := S.clients.assigned[key]; ok && assigned == addr {
+		return true
+	}
+	state, ok := S.clients.states[key]
+	return ok && slices.Contains(state.Addresses, addr)
+}
+
+// assignAddress returns the address assigned to the network stack of a client, picking the first address of the pool
+// that is neither assigned nor seen in the packets of a client. It fails if the pool is empty or exhausted.
+func (S *Server) assignAddress(client session) (netip.Addr, error) {
+	key := clientKey{Transport: client.Transport, Address: fmt.Sprint(client.Address)}
+	S.clients.Lock()
+	defer S.clients.Unlock()
+	if addr, ok := S.clients.assigned[key]; ok {
+		// The hello was repeated
+		return addr, nil
+	}
+	if !S.clients.pool.IsValid() {
+		return netip.Addr{}, fmt.Errorf("no TUN or network stack to assign addresses in")
+	}
+	used := make(map[netip.Addr]bool)
+	for _, addr := range S.clients.reserved {
+		used[addr] = true
+	}
+	for _, addr := range S.clients.assigned {
+		used[addr] = true
+	}
+	for _, state := range S.clients.states {
+		for _, addr := range state.Addresses {
+			used[addr] = true
+		}
+	}
+	pool := S.clients.pool
+	for addr := pool.Addr().Next(); pool.Contains(addr); addr = addr.Next() {
+		if addr.Is4() && !pool.Contains(addr.Next()) {
+			// The broadcast address
+			break
+		}
+		if !used[addr] {
+			if S.clients.assigned == nil {
+				S.clients.assigned = make(map[clientKey]netip.Addr)
+			}
+			S.clients.assigned[key] = addr
+			return addr, nil
+		}
+	}
+	return netip.Addr{}, fmt.Errorf("no free address in %s", pool)
+}
+
+// expire ends the sessions of the clients that were silent for longer than the timeout, or of every client if the
+// timeout is 0: their state and assigned address are forgotten, and the listeners of their remote forwards are
+// closed. The server still knows where to send the packets of the client.
+func (S *Server) expire(timeout time.Duration) {
+	now := time.Now()
+	var expired []SessionState
+	var expiredKeys []clientKey
+	S.clients.Lock()
+	for key, state := range S.clients.states {
+		if timeout == 0 || now.Sub(state.LastSeen) > timeout {
+			expired = append(expired, *state)
+			expiredKeys = append(expiredKeys, key)
+			delete(S.clients.states, key)
+			delete(S.clients.assigned, key)
+		}
+	}
+	S.clients.Unlock()
+	for _, key := range expiredKeys {
+		if S.forwards != nil {
+			S.forwards.Release(key)
+		}
+		if S.shells != nil {
+			S.shells.Kill(key)
+			S.exec.Kill(key)
+		}
+	}
+	for _, state := range expired {
+		S.log.Info("Client went away", "address", state.Address, "transport", state.Transport)
+		if S.Config.Events.SessionDown != nil {
+			S.Config.Events.SessionDown(state)
+		}
+	}
+}
+
+// sessionCount returns the number of clients, for the metrics.
+func (S Server) sessionCount() int {
+	S.clients.Lock()
+	defer S.clients.Unlock()
+	return len(S.clients.states)
+}
+
+func (S *Server) drop(reason bizarre.DropReason, packet []byte) {
+	S.metrics.Drop(reason)
+	if S.Config.Events.PacketDropped != nil {
+		S.Config.Events.PacketDropped(reason, packet)
+	}
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestSessions(t *testing.T) {
+	var up, down []SessionState
+	S := Server{
+		Config: ServerConfig{Events: Events{
+			SessionUp:   func(state SessionState) { up = append(up, state) },
+			SessionDown: func(state SessionState) { down = append(down, state) },
+		}},
+		log:     slog.New(slog.DiscardHandler),
+		clients: &clients{states: make(map[clientKey]*SessionState)},
+	}
+	first := taggedPacket{TransportName: "udp", session: session{Address: "192.0.2.1:9000"}}
+	second := taggedPacket{TransportName: "udp", session: session{Address: "192.0.2.2:9000"}}
+	S.seen(first)
+	S.seen(first)
+	S.learnAddress(first.session, netip.MustParseAddr("10.0.0.2"))
+	S.learnAddress(first.session, netip.MustParseAddr("10.0.0.2"))
+	time.Sleep(10 * time.Millisecond)
+	S.seen(second)
+
+	if len(up) != 2 {
+		t.Fatalf("expected 2 sessions to go up, got %d", len(up))
+	}
+	sessions := S.Sessions()
+	if len(sessions) != 2 || sessions[0].Address != "192.0.2.1:9000" || sessions[0].Transport != "udp" {
+		t.Fatalf("unexpected sessions: %+v", sessions)
+	}
+	if len(sessions[0].Addresses) != 1 || sessions[0].Addresses[0] != netip.MustParseAddr("10.0.0.2") {
+		t.Errorf("unexpected addresses: %v", sessions[0].Addresses)
+	}
+
+	S.expire(5 * time.Millisecond)
+	if len(down) != 1 || down[0].Address != "192.0.2.1:9000" {
+		t.Fatalf("expected the first client to go away, got %+v", down)
+	}
+	S.expire(0)
+	if len(down) != 2 || len(S.Sessions()) != 0 {
+		t.Errorf("expected every session to end, got %+v", S.Sessions())
+	}
+}
+
+func TestAssignAddress(t *testing.T) {
+	S := Server{clients: &clients{
+		states:   make(map[clientKey]*SessionState),
+		pool:     netip.MustParsePrefix("10.0.0.0/29"),
+		reserved: []netip.Addr{netip.MustParseAddr("10.0.0.1")},
+	}}
+	first := session{Address: "192.0.2.1:9000"}
+	second := session{Address: "192.0.2.2:9000"}
+	// A client with a TUN of its own, which was seen using 10.0.0.3
+	S.clients.states[clientKey{Address: "192.0.2.3:9000"}] = &SessionState{Addresses: []netip.Addr{netip.MustParseAddr("10.0.0.3")}}
+
+	expected := []struct {
+		client session
+		ip     string
+	}{
+		{first, "10.0.0.2"},
+		{second, "10.0.0.4"},
+		{first, "10.0.0.2"}, // A repeated hello gets the same address
+	}
+	for _, test := range expected {
+		addr, err := S.assignAddress(test.client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addr != netip.MustParseAddr(test.ip) {
+			t.Errorf("%v: got %s, expected %s", test.client.Address, addr, test.ip)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		_, err := S.assignAddress(session{Address: fmt.Sprintf("192.0.2.%d:9000", 10+i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 10.0.0.7 is the broadcast address
+	_, err := S.assignAddress(session{Address: "192.0.2.20:9000"})
+	if err == nil {
+		t.Error("expected the pool to be exhausted")
+	}
+}
@@ -0,0 +1,360 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"os/exec"
+	"os/user"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	bizarre "github.com/CapacitorSet/bizarre-net"
+	"github.com/CapacitorSet/bizarre-net/sources"
+)
+
+// PatternList is a list of command patterns, usable as a repeatable flag.
+type PatternList []string
+
+func (L *PatternList) String() string {
+	return strings.Join(*L, ", ")
+}
+
+func (L *PatternList) Set(value string) error {
+	*L = append(*L, value)
+	return nil
+}
+
+// ExecConfig is the policy for remote commands and shells.
+type ExecConfig struct {
+	Enabled bool
+	// Allow holds the commands that clients may run, where * matches any string without shell metacharacters.
+	// If it is empty every command is allowed; otherwise shells are refused, as they would bypass it.
+	Allow    PatternList
+	User     string // The user to run commands as (requires root); empty for the user of the server
+	Dir      string // The working directory of commands; empty for the home directory of the user
+	ScrubEnv bool   // Run commands with a minimal environment rather than the one of the server
+
+	Timeout       time.Duration // Commands running for longer are killed; shells are not limited
+	MaxOutput     int64         // Commands and shells producing more bytes of output are killed
+	MaxConcurrent int           // Maximum number of commands and shells running at once
+
+	AuditLog string // File that executed commands are logged to; empty to log them with the other messages
+}
+
+func execConfigFromFlags(config *ExecConfig, flags *flag.FlagSet) {
+	flags.BoolVar(&config.Enabled, "exec", true, "Allow clients to run commands and shells")
+	flags.Var(&config.Allow, "exec-allow", "Allow only commands matching this pattern, where * matches any string without shell metacharacters (can be repeated)")
+	flags.StringVar(&config.User, "exec-user", "", "Run commands as this user")
+	flags.StringVar(&config.Dir, "exec-dir", "", "Working directory of commands (default: the home of the user)")
+	flags.BoolVar(&config.ScrubEnv, "exec-scrub-env", true, "Run commands with a minimal environment")
+	flags.DurationVar(&config.Timeout, "exec-timeout", 0, "Kill commands running for longer than this (0 for no limit)")
+	flags.Int64Var(&config.MaxOutput, "exec-max-output", 0, "Kill commands producing more bytes of output (0 for no limit)")
+	flags.IntVar(&config.MaxConcurrent, "exec-max-concurrent", 0, "Maximum number of commands running at once (0 for no limit)")
+	flags.StringVar(&config.AuditLog, "exec-audit-log", "", "File to log executed commands to")
+}
+
+// executor runs commands and shells according to an ExecConfig.
+type executor struct {
+	ExecConfig
+	patterns   []*regexp.Regexp
+	credential *syscall.Credential // nil to run as the user of the server
+	home       string
+	audit      *log.Logger
+	log        *slog.Logger
+
+	lock     sync.Mutex
+	running  int
+	commands map[*runningCommand]struct{} // The commands being run, which are killed when their client goes away
+	closed   bool
+}
+
+// runningCommand is a command being run for a client, which cancelling kills.
+type runningCommand struct {
+	client clientKey
+	cancel context.CancelFunc
+}
+
+func newExecutor(config ExecConfig, logger *slog.Logger) (*executor, error) {
+	E := &executor{ExecConfig: config, log: logger, commands: make(map[*runningCommand]struct{})}
+	for _, pattern := range config.Allow {
+		// Commands run in bash, so the wildcard must not match anything that could chain another command
+		re := "^" + strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, "[^;&|<>`$()\\\\\n]*") + "$"
+		E.patterns = append(E.patterns, regexp.MustCompile(re))
+	}
+
+	var runAs *user.User
+	var err error
+	if config.User == "" {
+		runAs, err = user.Current()
+	} else {
+		runAs, err = user.Lookup(config.User)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("looking up user: %w", err)
+	}
+	E.home = runAs.HomeDir
+	if config.User != "" {
+		E.credential, err = credentialOf(runAs)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.AuditLog == "" {
+		E.audit = slog.NewLogLogger(logger.With(bizarre.SubsystemKey, bizarre.SubsystemAudit).Handler(), slog.LevelInfo)
+		return E, nil
+	}
+	auditOutput, err := os.OpenFile(config.AuditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("opening audit log: %w", err)
+	}
+	E.audit = log.New(auditOutput, "[audit] ", log.Ldate|log.Ltime)
+	return E, nil
+}
+
+func credentialOf(u *user.User) (*syscall.Credential, error) {
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("parsing uid of %s: %w", u.Username, err)
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("parsing gid of %s: %w", u.Username, err)
+	}
+	credential := &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+	groups, err := u.GroupIds()
+	if err != nil {
+		return nil, fmt.Errorf("looking up groups of %s: %w", u.Username, err)
+	}
+	for _, group := range groups {
+		id, err := strconv.ParseUint(group, 10, 32)
+		if err == nil {
+			credential.Groups = append(credential.Groups, uint32(id))
+		}
+	}
+	return credential, nil
+}
+
+// allows returns whether the policy allows running a command.
+func (E *executor) allows(command string) bool {
+	if len(E.patterns) == 0 {
+		return true
+	}
+	for _, pattern := range E.patterns {
+		if pattern.MatchString(command) {
+			return true
+		}
+	}
+	return false
+}
+
+// acquire reserves a slot for a new command, failing if too many are running.
+func (E *executor) acquire() error {
+	E.lock.Lock()
+	defer E.lock.Unlock()
+	if E.closed {
+		return errors.New("the server is closing")
+	}
+	if E.MaxConcurrent != 0 && E.running >= E.MaxConcurrent {
+		return fmt.Errorf("too many commands running (%d)", E.running)
+	}
+	E.running++
+	return nil
+}
+
+func (E *executor) release() {
+	E.lock.Lock()
+	E.running--
+	E.lock.Unlock()
+}
+
+// track registers a running command of a client, returning a function that unregisters it.
+func (E *executor) track(client clientKey, cancel context.CancelFunc) func() {
+	command := &runningCommand{client: client, cancel: cancel}
+	E.lock.Lock()
+	E.commands[command] = struct{}{}
+	E.lock.Unlock()
+	return func() {
+		E.lock.Lock()
+		delete(E.commands, command)
+		E.lock.Unlock()
+	}
+}
+
+// Kill kills the commands of a client.
+func (E *executor) Kill(client clientKey) {
+	E.lock.Lock()
+	defer E.lock.Unlock()
+	for command := range E.commands {
+		if command.client == client {
+			command.cancel()
+		}
+	}
+}
+
+// Close kills every command and refuses to start new ones.
+func (E *executor) Close() {
+	E.lock.Lock()
+	defer E.lock.Unlock()
+	E.closed = true
+	for command := range E.commands {
+		command.cancel()
+	}
+}
+
+// command prepares a command with the working directory, environment and user of the policy. The command runs in a
+// process group of its own, which is killed as a whole once the context is done, so that its children cannot keep it
+// running (or its output open) past a timeout.
+func (E *executor) command(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true, Credential: E.credential}
+	cmd.Cancel = func() error {
+		return killGroup(cmd)
+	}
+	// In case a child left its own group while holding the output
+	cmd.WaitDelay = time.Second
+	cmd.Dir = E.Dir
+	if cmd.Dir == "" {
+		cmd.Dir = E.home
+	}
+	if E.ScrubEnv {
+		cmd.Env = []string{
+			"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+			"HOME=" + E.home,
+		}
+		if lang, ok := os.LookupEnv("LANG"); ok {
+			cmd.Env = append(cmd.Env, "LANG="+lang)
+		}
+	} else {
+		cmd.Env = os.Environ()
+	}
+	return cmd
+}
+
+// killGroup kills the process group of a started command, which is the command and its children.
+func killGroup(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
+
+// outputLimit kills a command once its output (stdout and stderr combined) exceeds a number of bytes.
+type outputLimit struct {
+	sync.Mutex
+	remaining int64
+	exceeded  bool
+	kill      func()
+}
+
+type limitedWriter struct {
+	io.Writer
+	limit *outputLimit
+}
+
+func (w limitedWriter) Write(p []byte) (int, error) {
+	w.limit.Lock()
+	if w.limit.exceeded || int64(len(p)) > w.limit.remaining {
+		if !w.limit.exceeded {
+			w.limit.exceeded = true
+			w.limit.kill()
+		}
+		w.limit.Unlock()
+		return 0, errors.New("output limit exceeded")
+	}
+	w.limit.remaining -= int64(len(p))
+	w.limit.Unlock()
+	return w.Writer.Write(p)
+}
+
+// limitOutput wraps the writers of a command so that the policy on output size is enforced.
+func (E *executor) limitOutput(kill func(), writers ...*io.Writer) *outputLimit {
+	if E.MaxOutput == 0 {
+		return nil
+	}
+	limit := &outputLimit{remaining: E.MaxOutput, kill: kill}
+	for _, w := range writers {
+		*w = limitedWriter{Writer: *w, limit: limit}
+	}
+	return limit
+}
+
+// exitStatus returns the exit status of a command that has been waited for, following the shell convention of
+// 128+N for commands killed by signal N.
+func exitStatus(state *os.ProcessState) int {
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return state.ExitCode()
+}
+
+// Run runs a command for a client stream, sending its output and then its exit status.
+func (E *executor) Run(command string, client session) {
+	status := E.run(command, client)
+	err := client.Send(bizarre.ExitMessage(status))
+	if err != nil {
+		E.log.Warn("Error sending exit status", "error", err)
+	}
+}
+
+func (E *executor) run(command string, client session) int {
+	refuse := func(reason string) int {
+		E.audit.Printf("%v: refused command %q: %s", client.Address, command, reason)
+		client.Send(bizarre.Message{Type: bizarre.MessageStderr, Payload: []byte("bizarre-net: " + reason + "\n")})
+		// Same as a shell that cannot run the command
+		return 126
+	}
+	if !E.Enabled {
+		return refuse("command execution is disabled")
+	}
+	if !E.allows(command) {
+		return refuse("command not allowed")
+	}
+	err := E.acquire()
+	if err != nil {
+		return refuse(err.Error())
+	}
+	defer E.release()
+
+	// Cancelling kills the command, which the output limit relies on
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if E.Timeout != 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), E.Timeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	defer cancel()
+	defer E.track(clientKey{Transport: client.Transport, Address: fmt.Sprint(client.Address)}, cancel)()
+	cmd := E.command(ctx, "bash", "-c", command)
+	cmd.Stdout = sources.MessageWriter{Sender: client, Type: bizarre.MessageStdout}
+	cmd.Stderr = sources.MessageWriter{Sender: client, Type: bizarre.MessageStderr}
+	limit := E.limitOutput(cancel, &cmd.Stdout, &cmd.Stderr)
+
+	E.audit.Printf("%v: running command %q", client.Address, command)
+	start := time.Now()
+	err = cmd.Run()
+	status := 0
+	if cmd.ProcessState != nil {
+		status = exitStatus(cmd.ProcessState)
+	} else if err != nil {
+		// The command could not be started
+		E.log.Warn("Error running command", "command", command, "error", err)
+		status = 127
+	}
+	reason := ""
+	if limit != nil && limit.exceeded {
+		reason = " (output limit exceeded)"
+	} else if ctx.Err() == context.DeadlineExceeded {
+		reason = " (timed out)"
+	}
+	E.audit.Printf("%v: command %q exited with status %d after %s%s", client.Address, command, status, time.Since(start).Round(time.Millisecond), reason)
+	return status
+}
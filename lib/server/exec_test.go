@@ -0,0 +1,65 @@
+package server
+
+import (
+	"log/slog"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestExecAllowlist(t *testing.T) {
+	E, err := newExecutor(ExecConfig{Allow: PatternList{"uptime", "ls *", "systemctl status *.service"}}, slog.New(slog.DiscardHandler))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]bool{
+		"uptime":                       true,
+		"uptime; rm -rf /":             false,
+		"ls /tmp":                      true,
+		"ls":                           false,
+		"ls /tmp; id":                  false,
+		"ls $(id)":                     false,
+		"ls /tmp | sh":                 false,
+		"ls /tmp\nid":                  false,
+		"systemctl status ssh.service": true,
+		"systemctl status ssh":         false,
+		"id":                           false,
+	}
+	for command, expected := range tests {
+		if E.allows(command) != expected {
+			t.Errorf("%q: expected allowed=%t", command, expected)
+		}
+	}
+
+	E, err = newExecutor(ExecConfig{}, slog.New(slog.DiscardHandler))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !E.allows("anything") {
+		t.Error("an empty allowlist should allow every command")
+	}
+}
+
+func TestExecKillsChildren(t *testing.T) {
+	transport := newFakeTransport()
+	client := session{Transport: transport, Address: "192.0.2.1:9000"}
+	tests := map[string]ExecConfig{
+		"timeout":      {Enabled: true, Timeout: 500 * time.Millisecond},
+		"output limit": {Enabled: true, MaxOutput: 4},
+	}
+	for name, config := range tests {
+		E, err := newExecutor(config, slog.New(slog.DiscardHandler))
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		// bash runs sleep as a child, which holds the output open until it exits
+		status := E.run("echo output; sleep 5; true", client)
+		if elapsed := time.Since(start); elapsed > 3*time.Second {
+			t.Errorf("%s: the command ran for %s", name, elapsed)
+		}
+		if status != 128+int(syscall.SIGKILL) {
+			t.Errorf("%s: expected the command to be killed, got status %d", name, status)
+		}
+	}
+}
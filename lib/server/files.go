@@ -0,0 +1,251 @@
+package server
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	bizarre "github.com/CapacitorSet/bizarre-net"
+	"github.com/CapacitorSet/bizarre-net/sources"
+)
+
+type FilesConfig struct {
+	Root     string // The directory that clients can access; empty to disable file transfers
+	ReadOnly bool
+}
+
+func filesConfigFromFlags(config *FilesConfig, flags *flag.FlagSet) {
+	flags.StringVar(&config.Root, "files-root", "", "Directory that clients can list, download from and upload to")
+	flags.BoolVar(&config.ReadOnly, "files-read-only", false, "Do not allow uploads")
+}
+
+type upload struct {
+	file    *os.File
+	path    string
+	tracker *sources.ChunkTracker
+}
+
+// files serves file transfers, confined to the root directory.
+type files struct {
+	FilesConfig
+	root      *os.Root // nil if file transfers are disabled
+	chunkSize int      // Amount of file data in each message, which every transport must carry
+	log       *slog.Logger
+
+	sync.Mutex
+	uploads map[streamKey]*upload
+}
+
+func newFiles(config FilesConfig, logger *slog.Logger) (*files, error) {
+	F := &files{FilesConfig: config, log: logger, uploads: make(map[streamKey]*upload)}
+	if config.Root != "" {
+		var err error
+		F.root, err = os.OpenRoot(config.Root)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return F, nil
+}
+
+// relative returns the path within the root of a path requested by a client, where / is the root.
+func relative(requested string) string {
+	clean := strings.TrimPrefix(path.Clean("/"+requested), "/")
+	if clean == "" {
+		return "."
+	}
+	return clean
+}
+
+func sendError(client session, err error) {
+	client.Send(bizarre.Message{Type: bizarre.MessageFileError, Flags: bizarre.FlagEnd, Payload: []byte(err.Error())})
+}
+
+// Handle handles a file transfer message from a client stream. Requests that only read files are served
+// asynchronously, while uploads are handled in order.
+func (F *files) Handle(client session, msg bizarre.Message) {
+	if F.root == nil {
+		sendError(client, errors.New("file transfers are disabled"))
+		return
+	}
+	var err error
+	switch msg.Type {
+	case bizarre.MessageFileList, bizarre.MessageFileStat, bizarre.MessageFileGet:
+		var request bizarre.FileRequest
+		request, err = bizarre.ParseFileRequest(msg.Payload)
+		if err == nil {
+			go func() {
+				err := F.read(client, msg.Type, request)
+				if err != nil {
+					F.log.Debug("Could not serve file request", "type", msg.Type.String(), "path", request.Path, "error", err)
+					sendError(client, err)
+				}
+			}()
+		}
+	case bizarre.MessageFilePut:
+		err = F.startUpload(client, msg.Payload)
+	case bizarre.MessageFileData:
+		err = F.receive(client, msg.Payload)
+	case bizarre.MessageFileDone:
+		err = F.finishUpload(client, msg.Payload)
+	default:
+		err = fmt.Errorf("unexpected %s message", msg.Type)
+	}
+	if err != nil {
+		F.log.Warn("Error handling message", "type", msg.Type.String(), "error", err)
+		sendError(client, err)
+	}
+}
+
+func (F *files) read(client session, kind bizarre.MessageType, request bizarre.FileRequest) error {
+	name := relative(request.Path)
+	switch kind {
+	case bizarre.MessageFileStat:
+		info, err := F.root.Lstat(name)
+		if err != nil {
+			return err
+		}
+		return client.Send(bizarre.Message{Type: bizarre.MessageFileInfo, Flags: bizarre.FlagEnd, Payload: bizarre.NewFileInfo(info).Marshal()})
+	case bizarre.MessageFileList:
+		file, err := F.root.Open(name)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		info, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return client.Send(bizarre.Message{Type: bizarre.MessageFileInfo, Flags: bizarre.FlagEnd, Payload: bizarre.NewFileInfo(info).Marshal()})
+		}
+		entries, err := file.ReadDir(-1)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			info, err := entry.Info()
+			if err != nil {
+				// The entry was removed in the meantime
+				continue
+			}
+			err = client.Send(bizarre.Message{Type: bizarre.MessageFileInfo, Payload: bizarre.NewFileInfo(info).Marshal()})
+			if err != nil {
+				return err
+			}
+		}
+		return client.Send(bizarre.Message{Type: bizarre.MessageFileInfo, Flags: bizarre.FlagEnd})
+	default: // MessageFileGet
+		file, err := F.root.Open(name)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		info, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return fmt.Errorf("%s is a directory", request.Path)
+		}
+		F.log.Debug("Sending file", "path", request.Path, "offset", request.Offset)
+		return sources.SendFile(client, file, request.Offset, F.chunkSize)
+	}
+}
+
+func (F *files) startUpload(client session, payload []byte) error {
+	if F.ReadOnly {
+		return errors.New("uploads are disabled")
+	}
+	request, err := bizarre.ParseFileRequest(payload)
+	if err != nil {
+		return err
+	}
+	file, err := F.root.OpenFile(relative(request.Path), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err == nil && uint64(info.Size()) < request.Offset {
+		err = fmt.Errorf("cannot resume from byte %d, the file has %d bytes", request.Offset, info.Size())
+	}
+	if err == nil {
+		// Anything after the resumed part is overwritten
+		err = file.Truncate(int64(request.Offset))
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+	info, _ = file.Stat()
+
+	key := keyOf(client)
+	F.Lock()
+	if previous := F.uploads[key]; previous != nil {
+		previous.file.Close()
+	}
+	F.uploads[key] = &upload{file: file, path: request.Path, tracker: sources.NewChunkTracker(request.Offset)}
+	F.Unlock()
+	// Tell the client that it can start sending
+	return client.Send(bizarre.Message{Type: bizarre.MessageFileInfo, Payload: bizarre.NewFileInfo(info).Marshal()})
+}
+
+func (F *files) receive(client session, payload []byte) error {
+	F.Lock()
+	upload := F.uploads[keyOf(client)]
+	F.Unlock()
+	if upload == nil {
+		return errors.New("no upload in progress on this stream")
+	}
+	chunk, err := bizarre.ParseFileChunk(payload)
+	if err != nil {
+		return err
+	}
+	_, err = upload.file.WriteAt(chunk.Data, int64(chunk.Offset))
+	if err != nil {
+		return err
+	}
+	upload.tracker.Add(chunk.Offset, len(chunk.Data))
+	return nil
+}
+
+func (F *files) finishUpload(client session, payload []byte) error {
+	key := keyOf(client)
+	F.Lock()
+	upload := F.uploads[key]
+	F.Unlock()
+	if upload == nil {
+		return errors.New("no upload in progress on this stream")
+	}
+	expected, err := bizarre.ParseFileDone(payload)
+	if err != nil {
+		return err
+	}
+	if received := upload.tracker.Contiguous(); received < expected.Size {
+		// Ask the client to resend what is missing, as if it resumed the upload
+		F.log.Debug("Upload incomplete, resuming", "path", upload.path, "received", received, "size", expected.Size)
+		err = upload.file.Truncate(int64(received))
+		if err != nil {
+			return err
+		}
+		upload.tracker = sources.NewChunkTracker(received)
+		resume := bizarre.FileInfo{Size: received, Name: path.Base(upload.path)}
+		return client.Send(bizarre.Message{Type: bizarre.MessageFileInfo, Payload: resume.Marshal()})
+	}
+
+	F.Lock()
+	delete(F.uploads, key)
+	F.Unlock()
+	defer upload.file.Close()
+	err = sources.FinishReceiving(upload.file, upload.tracker, expected)
+	if err != nil {
+		return err
+	}
+	F.log.Info("Received file", "path", upload.path, "client", client, "bytes", expected.Size)
+	return client.Send(bizarre.Message{Type: bizarre.MessageFileDone, Flags: bizarre.FlagEnd, Payload: expected.Marshal()})
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	bizarre "github.com/CapacitorSet/bizarre-net"
+)
+
+// newTestFiles creates a root for file transfers next to a directory outside of it, which holds a secret file and is
+// linked to from the root.
+func newTestFiles(t *testing.T) (F *files, root, outside string) {
+	root, outside = t.TempDir(), t.TempDir()
+	err := os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink(filepath.Join(outside, "secret"), filepath.Join(root, "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink(outside, filepath.Join(root, "linkdir"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	F, err = newFiles(FilesConfig{Root: root}, slog.New(slog.DiscardHandler))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return F, root, outside
+}
+
+func TestFilesDownloadConfined(t *testing.T) {
+	F, _, outside := newTestFiles(t)
+	transport := newFakeTransport()
+	client := session{Transport: transport, Address: "client", Stream: 1}
+	for _, name := range []string{"../secret", "../../" + filepath.Base(outside) + "/secret", filepath.Join(outside, "secret"), "link", "linkdir/secret"} {
+		for _, kind := range []bizarre.MessageType{bizarre.MessageFileGet, bizarre.MessageFileStat, bizarre.MessageFileList} {
+			F.Handle(client, bizarre.Message{Type: kind, Payload: bizarre.FileRequest{Path: name}.Marshal()})
+			reply, _ := transport.reply(t)
+			if kind == bizarre.MessageFileStat && name == "link" && reply.Type == bizarre.MessageFileInfo {
+				// Statting the link itself does not follow it
+				continue
+			}
+			if reply.Type != bizarre.MessageFileError {
+				t.Errorf("%s %s: got %s, expected an error", kind, name, reply.Type)
+			}
+		}
+	}
+}
+
+func TestFilesUploadConfined(t *testing.T) {
+	F, root, outside := newTestFiles(t)
+	transport := newFakeTransport()
+	client := session{Transport: transport, Address: "client", Stream: 1}
+	put := func(name string) bizarre.Message {
+		F.Handle(client, bizarre.Message{Type: bizarre.MessageFilePut, Payload: bizarre.FileRequest{Path: name}.Marshal()})
+		reply, _ := transport.reply(t)
+		return reply
+	}
+
+	// Paths that climb out of the root end up inside of it
+	if reply := put("../evil"); reply.Type != bizarre.MessageFileInfo {
+		t.Errorf("got %s, expected the upload to start", reply.Type)
+	}
+	if _, err := os.Stat(filepath.Join(root, "evil")); err != nil {
+		t.Error(err)
+	}
+	// Absolute paths are within the root too, where the directories do not exist, and symlinks that point outside of
+	// it are refused
+	for _, name := range []string{filepath.Join(outside, "evil"), "link", "linkdir/evil"} {
+		if reply := put(name); reply.Type != bizarre.MessageFileError {
+			t.Errorf("%s: got %s, expected an error", name, reply.Type)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(outside, "evil")); err == nil {
+		t.Error("a file was created outside of the root")
+	}
+	secret, err := os.ReadFile(filepath.Join(outside, "secret"))
+	if err != nil || string(secret) != "secret" {
+		t.Errorf("the file outside of the root was changed to %q (%v)", secret, err)
+	}
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	bizarre "github.com/CapacitorSet/bizarre-net"
+	"github.com/CapacitorSet/bizarre-net/sources"
+)
+
+const udpForwardIdleTimeout = time.Minute
+
+type remoteForward struct {
+	client   clientKey
+	target   netip.AddrPort
+	listener io.Closer
+}
+
+// ownedBy returns whether a forward belongs to the client of a request for it: the same session, or a new session of
+// the same network stack, such as one that was restarted.
+func (forward *remoteForward) ownedBy(client clientKey, target netip.AddrPort) bool {
+	return forward.client == client || forward.target.Addr() == target.Addr()
+}
+
+// forwards runs the listeners of remote forwards, which clients request with -R. The connections that they accept
+// are forwarded to the network stack of the client, through the TUN or the network stack of the server. The listeners
+// are closed when the session of their client ends.
+type forwards struct {
+	enabled bool
+	public  bool // Whether clients can listen on other addresses than loopback ones
+
+	dial func(ctx context.Context, network, address string) (net.Conn, error) // nil if the server has no network
+	log  *slog.Logger
+
+	sync.Mutex
+	listeners map[string]*remoteForward // Indexed by network and bind address, eg. tcp/localhost:8080
+}
+
+func newForwards(enabled, public bool, network sources.Source, logger *slog.Logger) *forwards {
+	F := &forwards{enabled: enabled, public: public, log: logger, listeners: make(map[string]*remoteForward)}
+	switch network := network.(type) {
+	case *sources.NetstackSource:
+		F.dial = network.DialContext
+	case nil:
+	default:
+		// The TUN is routed to the clients
+		var dialer net.Dialer
+		F.dial = dialer.DialContext
+	}
+	return F
+}
+
+// Close stops listening for every remote forward.
+func (F *forwards) Close() error {
+	F.Lock()
+	defer F.Unlock()
+	var errs []error
+	for key, forward := range F.listeners {
+		errs = append(errs, forward.listener.Close())
+		delete(F.listeners, key)
+	}
+	return errors.Join(errs...)
+}
+
+// Release stops listening for the remote forwards of a client, whose session ended.
+func (F *forwards) Release(client clientKey) error {
+	F.Lock()
+	defer F.Unlock()
+	var errs []error
+	for key, forward := range F.listeners {
+		if forward.client == client {
+			errs = append(errs, forward.listener.Close())
+			delete(F.listeners, key)
+			F.log.Info("Stopped forwarding remote port", "bind", key, "client", client.Address)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// isLoopback returns whether a bind address only listens on loopback addresses.
+func isLoopback(bind string) bool {
+	host, _, err := net.SplitHostPort(bind)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip, err := netip.ParseAddr(host)
+	return err == nil && ip.IsLoopback()
+}
+
+// Open starts listening for a remote forward, unless the client already has it.
+func (F *forwards) Open(client session, request bizarre.Forward) error {
+	if !F.enabled {
+		return errors.New("remote forwards are disabled")
+	}
+	if F.dial == nil {
+		return errors.New("the server has no TUN or network stack to reach the client with")
+	}
+	if !F.public && !isLoopback(request.Bind) {
+		return fmt.Errorf("%s is not a loopback address, and the server only allows those", request.Bind)
+	}
+	network := "tcp"
+	if request.UDP {
+		network = "udp"
+	}
+	key := network + "/" + request.Bind
+	owner := clientKey{Transport: client.Transport, Address: fmt.Sprint(client.Address)}
+	F.Lock()
+	defer F.Unlock()
+	if existing := F.listeners[key]; existing != nil {
+		if !existing.ownedBy(owner, request.Target) {
+			return fmt.Errorf("%s is already forwarded", request.Bind)
+		}
+		if existing.target == request.Target {
+			// A repeated request, possibly from a new session
+			existing.client = owner
+			return nil
+		}
+		// The client forwards to another port now
+		existing.listener.Close()
+		delete(F.listeners, key)
+	}
+
+	target := request.Target.String()
+	dial := func(ctx context.Context) (net.Conn, error) {
+		return F.dial(ctx, network, target)
+	}
+	forward := &remoteForward{client: owner, target: request.Target}
+	if request.UDP {
+		conn, err := net.ListenPacket("udp", request.Bind)
+		if err != nil {
+			return err
+		}
+		forward.listener = conn
+		go sources.ServeDatagrams(conn, dial, udpForwardIdleTimeout)
+	} else {
+		listener, err := net.Listen("tcp", request.Bind)
+		if err != nil {
+			return err
+		}
+		forward.listener = listener
+		go sources.ServeStreams(listener, dial)
+	}
+	F.listeners[key] = forward
+	F.log.Info("Forwarding remote port", "network", network, "bind", request.Bind, "client", client, "target", target)
+	return nil
+}
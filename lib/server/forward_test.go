@@ -0,0 +1,116 @@
+package server
+
+import (
+	"log/slog"
+	"net"
+	"net/netip"
+	"testing"
+
+	bizarre "github.com/CapacitorSet/bizarre-net"
+)
+
+func newTestForwards(public bool) *forwards {
+	var dialer net.Dialer
+	return &forwards{enabled: true, public: public, dial: dialer.DialContext, log: slog.New(slog.DiscardHandler), listeners: make(map[string]*remoteForward)}
+}
+
+func TestForwardsLoopbackOnly(t *testing.T) {
+	F := newTestForwards(false)
+	defer F.Close()
+	client := session{Address: "192.0.2.1:9000"}
+	target := netip.MustParseAddrPort("10.0.0.2:3000")
+	for _, bind := range []string{":0", "0.0.0.0:0", "[::]:0", "192.0.2.10:0", "example.com:0"} {
+		err := F.Open(client, bizarre.Forward{Target: target, Bind: bind})
+		if err == nil {
+			t.Errorf("%s: expected the bind address to be refused", bind)
+		}
+	}
+	for _, bind := range []string{"localhost:0", "127.0.0.1:0"} {
+		err := F.Open(client, bizarre.Forward{Target: target, Bind: bind})
+		if err != nil {
+			t.Errorf("%s: %s", bind, err)
+		}
+	}
+
+	public := newTestForwards(true)
+	defer public.Close()
+	err := public.Open(client, bizarre.Forward{Target: target, Bind: ":0"})
+	if err != nil {
+		t.Errorf("expected every interface to be allowed, got %s", err)
+	}
+}
+
+func TestForwardsEndWithSession(t *testing.T) {
+	S := Server{
+		log:      slog.New(slog.DiscardHandler),
+		clients:  &clients{states: make(map[clientKey]*SessionState)},
+		forwards: newTestForwards(false),
+	}
+	defer S.forwards.Close()
+	first := taggedPacket{TransportName: "udp", session: session{Address: "192.0.2.1:9000"}}
+	second := taggedPacket{TransportName: "udp", session: session{Address: "192.0.2.2:9000"}}
+	request := bizarre.Forward{Target: netip.MustParseAddrPort("10.0.0.2:3000"), Bind: "127.0.0.1:0"}
+	S.seen(first)
+	if err := S.forwards.Open(first.session, request); err != nil {
+		t.Fatal(err)
+	}
+	// Repeated requests succeed, but other clients cannot take the bind address
+	if err := S.forwards.Open(first.session, request); err != nil {
+		t.Fatal(err)
+	}
+	other := request
+	other.Target = netip.MustParseAddrPort("10.0.0.3:3000")
+	if err := S.forwards.Open(second.session, other); err == nil {
+		t.Fatal("expected another client to be refused")
+	}
+
+	// The same network stack can claim it again from a new session, eg. after restarting
+	restarted := session{Address: "192.0.2.1:9001"}
+	reclaim := request
+	reclaim.Target = netip.MustParseAddrPort("10.0.0.2:4000")
+	if err := S.forwards.Open(restarted, reclaim); err != nil {
+		t.Fatalf("expected the client to reclaim its forward, got %s", err)
+	}
+
+	// Once the session ends, the listener is closed and the bind address is free
+	S.seen(taggedPacket{TransportName: "udp", session: restarted})
+	S.expire(0)
+	if len(S.forwards.listeners) != 0 {
+		t.Fatalf("expected the forwards to be released, got %d", len(S.forwards.listeners))
+	}
+	if err := S.forwards.Open(second.session, other); err != nil {
+		t.Fatalf("expected the bind address to be free, got %s", err)
+	}
+}
+
+// TestForwardTarget checks that clients can only forward to their own address in the tunnel.
+func TestForwardTarget(t *testing.T) {
+	config := ServerConfig{RemoteForwards: true}
+	config.SourceConfig.NetstackConfig.Enabled = true
+	transport := startServer(t, config)
+	transport.send("192.0.2.1:9000", bizarre.Message{Type: bizarre.MessageHello, Flags: bizarre.FlagAddress})
+	reply, _ := transport.reply(t)
+	ack, err := bizarre.ParseHelloAck(reply.Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		target netip.Addr
+		ok     bool
+	}{
+		{ack.Address.Next(), false}, // The address of another client
+		{ack.Address, true},
+	} {
+		request := bizarre.Forward{Target: netip.AddrPortFrom(test.target, 3000), Bind: "127.0.0.1:0"}
+		transport.send("192.0.2.1:9000", bizarre.Message{Type: bizarre.MessageForward, Payload: request.Marshal()})
+		reply, _ := transport.reply(t)
+		result, err := bizarre.ParseForwardResult(reply.Payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (result.Error == "") != test.ok {
+			t.Errorf("%s: got the error %q", test.target, result.Error)
+		}
+	}
+}
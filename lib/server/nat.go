@@ -0,0 +1,185 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/CapacitorSet/bizarre-net/sources"
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// The nftables table that holds the rules of the server, which is deleted as a whole on exit
+const natTable = "bizarre-net"
+
+type NATConfig struct {
+	Egress string // The interface that leads to the Internet, eg. "eth0"; empty to leave forwarding to the host
+}
+
+// nat forwards the traffic of the clients to the egress interface, masquerading it behind the address of the server,
+// like a home router: hosts behind the egress interface cannot open connections to the clients. It undoes its changes
+// when closed.
+type nat struct {
+	conn    *nftables.Conn
+	table   *nftables.Table
+	sysctls map[string]string // The previous values of the sysctls that were changed, indexed by path
+}
+
+func newNAT(config NATConfig, tun *sources.TUNSource) (*nat, error) {
+	if _, err := net.InterfaceByName(config.Egress); err != nil {
+		return nil, fmt.Errorf("egress interface %s: %w", config.Egress, err)
+	}
+	conn, err := nftables.New()
+	if err != nil {
+		return nil, err
+	}
+	N := &nat{conn: conn, table: &nftables.Table{Name: natTable, Family: nftables.TableFamilyINet}, sysctls: make(map[string]string)}
+
+	// Replace the table that a server which did not exit cleanly may have left behind
+	if _, err := conn.ListTableOfFamily(natTable, nftables.TableFamilyINet); err == nil {
+		conn.DelTable(N.table)
+	}
+	conn.AddTable(N.table)
+	forward := conn.AddChain(&nftables.Chain{
+		Name:     "forward",
+		Table:    N.table,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookForward,
+		Priority: nftables.ChainPriorityFilter,
+	})
+	postrouting := conn.AddChain(&nftables.Chain{
+		Name:     "postrouting",
+		Table:    N.table,
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookPostrouting,
+		Priority: nftables.ChainPriorityNATSource,
+	})
+
+	accept := []expr.Any{&expr.Verdict{Kind: expr.VerdictAccept}}
+	// iifname <tun> oifname <egress> accept
+	conn.AddRule(&nftables.Rule{Table: N.table, Chain: forward, Exprs: concat(
+		matchInterface(expr.MetaKeyIIFNAME, tun.Name), matchInterface(expr.MetaKeyOIFNAME, config.Egress), accept,
+	)})
+	// iifname <egress> oifname <tun> ct state established,related accept
+	conn.AddRule(&nftables.Rule{Table: N.table, Chain: forward, Exprs: concat(
+		matchInterface(expr.MetaKeyIIFNAME, config.Egress), matchInterface(expr.MetaKeyOIFNAME, tun.Name),
+		matchEstablished(), accept,
+	)})
+	// iifname <egress> oifname <tun> drop
+	conn.AddRule(&nftables.Rule{Table: N.table, Chain: forward, Exprs: concat(
+		matchInterface(expr.MetaKeyIIFNAME, config.Egress), matchInterface(expr.MetaKeyOIFNAME, tun.Name),
+		[]expr.Any{&expr.Verdict{Kind: expr.VerdictDrop}},
+	)})
+
+	hasIPv6 := false
+	for _, address := range tun.Addresses {
+		subnet := &net.IPNet{IP: address.IP.Mask(address.Mask), Mask: address.Mask}
+		if subnet.IP.To4() == nil {
+			hasIPv6 = true
+		}
+		// ip saddr <subnet> oifname <egress> masquerade
+		conn.AddRule(&nftables.Rule{Table: N.table, Chain: postrouting, Exprs: concat(
+			matchSource(subnet), matchInterface(expr.MetaKeyOIFNAME, config.Egress), []expr.Any{&expr.Masq{}},
+		)})
+	}
+	err = conn.Flush()
+	if err != nil {
+		return nil, fmt.Errorf("adding nftables rules: %w", err)
+	}
+
+	err = N.setSysctl("/proc/sys/net/ipv4/ip_forward", "1")
+	if err == nil && hasIPv6 {
+		err = N.setSysctl("/proc/sys/net/ipv6/conf/all/forwarding", "1")
+	}
+	if err != nil {
+		N.Close()
+		return nil, fmt.Errorf("enabling forwarding: %w", err)
+	}
+	return N, nil
+}
+
+// setSysctl writes a sysctl, remembering its previous value.
+func (N *nat) setSysctl(path, value string) error {
+	previous, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(previous)) == value {
+		return nil
+	}
+	err = os.WriteFile(path, []byte(value), 0644)
+	if err != nil {
+		return err
+	}
+	N.sysctls[path] = string(previous)
+	return nil
+}
+
+// Close deletes the rules and restores the sysctls.
+func (N *nat) Close() error {
+	var errs []error
+	for path, value := range N.sysctls {
+		errs = append(errs, os.WriteFile(path, []byte(value), 0644))
+	}
+	N.sysctls = make(map[string]string)
+	N.conn.DelTable(N.table)
+	if err := N.conn.Flush(); err != nil && !errors.Is(err, unix.ENOENT) {
+		errs = append(errs, fmt.Errorf("deleting nftables rules: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+func concat(groups ...[]expr.Any) []expr.Any {
+	var ret []expr.Any
+	for _, group := range groups {
+		ret = append(ret, group...)
+	}
+	return ret
+}
+
+// matchInterface matches the name of the input or output interface.
+func matchInterface(key expr.MetaKey, name string) []expr.Any {
+	// Names are compared as null-terminated strings of IFNAMSIZ bytes
+	data := make([]byte, unix.IFNAMSIZ)
+	copy(data, name)
+	return []expr.Any{
+		&expr.Meta{Key: key, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: data},
+	}
+}
+
+// matchEstablished matches packets of connections that were already accepted.
+func matchEstablished() []expr.Any {
+	return []expr.Any{
+		&expr.Ct{Key: expr.CtKeySTATE, Register: 1},
+		&expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            4,
+			Mask:           binaryutil.NativeEndian.PutUint32(expr.CtStateBitESTABLISHED | expr.CtStateBitRELATED),
+			Xor:            make([]byte, 4),
+		},
+		&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: make([]byte, 4)},
+	}
+}
+
+// matchSource matches packets whose source address is in the subnet.
+func matchSource(subnet *net.IPNet) []expr.Any {
+	// The table handles both IP versions, so the version is checked before reading the address
+	protocol, offset, ip := byte(unix.NFPROTO_IPV4), uint32(12), subnet.IP.To4()
+	if ip == nil {
+		protocol, offset, ip = unix.NFPROTO_IPV6, 8, subnet.IP.To16()
+	}
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{protocol}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: uint32(len(ip))},
+		&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: uint32(len(ip)), Mask: subnet.Mask, Xor: make([]byte, len(ip))},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ip},
+	}
+}
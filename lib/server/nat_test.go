@@ -0,0 +1,73 @@
+package server
+
+import (
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/CapacitorSet/bizarre-net/sources"
+	"github.com/google/nftables"
+	"github.com/vishvananda/netns"
+)
+
+func readSysctl(t *testing.T, path string) string {
+	value, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(value))
+}
+
+func TestNAT(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("NAT rules can only be tested as root")
+	}
+	// Work in a network namespace of its own, which starts with forwarding disabled and no rules
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	host, err := netns.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host.Close()
+	ns, err := netns.New()
+	if err != nil {
+		t.Skipf("creating a network namespace: %s", err)
+	}
+	defer ns.Close()
+	defer netns.Set(host)
+
+	_, v4, _ := net.ParseCIDR("10.0.0.1/24")
+	_, v6, _ := net.ParseCIDR("fd00::1/64")
+	N, err := newNAT(NATConfig{Egress: "lo"}, &sources.TUNSource{Name: "bizarre0", Addresses: []*net.IPNet{v4, v6}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := &nftables.Table{Name: natTable, Family: nftables.TableFamilyINet}
+	chains := map[string]int{"forward": 3, "postrouting": 2}
+	for name, expected := range chains {
+		rules, err := N.conn.GetRules(table, &nftables.Chain{Name: name, Table: table})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rules) != expected {
+			t.Errorf("%s: got %d rules, expected %d", name, len(rules), expected)
+		}
+	}
+	if value := readSysctl(t, "/proc/sys/net/ipv4/ip_forward"); value != "1" {
+		t.Errorf("got ip_forward=%s, expected forwarding to be enabled", value)
+	}
+
+	err = N.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := N.conn.ListTableOfFamily(natTable, nftables.TableFamilyINet); err == nil {
+		t.Error("the table was not deleted")
+	}
+	if value := readSysctl(t, "/proc/sys/net/ipv4/ip_forward"); value != "0" {
+		t.Errorf("got ip_forward=%s, expected it to be restored", value)
+	}
+}
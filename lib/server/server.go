@@ -1,150 +1,651 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
-	"os"
-	"os/exec"
+	"log/slog"
+	"net/netip"
+	"sync"
+	"time"
 
 	bizarre "github.com/CapacitorSet/bizarre-net"
+	"github.com/CapacitorSet/bizarre-net/metrics"
 	"github.com/CapacitorSet/bizarre-net/sources"
 	"github.com/CapacitorSet/bizarre-net/transports"
-)
-
-var (
-	debug = log.New(os.Stdout, "[debug] ", log.Ldate | log.Ltime | log.Lshortfile)
-	info = log.New(os.Stdout, "[info]  ", log.Ldate | log.Ltime | log.Lshortfile)
-	warn = log.New(os.Stdout, "[warn]  ", log.Ldate | log.Ltime | log.Lshortfile)
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 )
 
 type ServerConfig struct {
 	SourceConfig    sources.SourceConfig
 	TransportConfig transports.TransportConfig
+	ExecConfig      ExecConfig
+	FilesConfig     FilesConfig
+	NATConfig       NATConfig
+
+	DropChatter          bool
+	RemoteForwards       bool          // Whether clients can listen on the server with -R
+	PublicRemoteForwards bool          // Whether they can listen on other addresses than loopback ones
+	SessionTimeout       time.Duration // How long a silent client keeps its session; 0 keeps it until the server stops
+	LogConfig            bizarre.LogConfig
+	MetricsAddress       string // Where to serve Prometheus metrics on /metrics; empty to not serve them
 
-	DropChatter bool
+	Logger *slog.Logger // nil to use slog.Default(), which transports and sources log to as well
+	Events Events
 }
 
 func NewConfigFromFlags(flags *flag.FlagSet) *ServerConfig {
 	config := ServerConfig{}
+	flags.String("config", "", "Config file (flags take precedence over it)")
 	sources.PartialConfigFromFlags(&config.SourceConfig, flags) // todo: fix, we only need TUN config
+	// The server must keep its own routes: only the client TUN routes traffic by default
+	defaultRoute := flags.Lookup("default-route")
+	defaultRoute.DefValue = "false"
+	defaultRoute.Value.Set("false")
+	flags.BoolVar(&config.SourceConfig.NetstackConfig.Enabled, "netstack", false, "Terminate tunnelled connections in a userspace network stack instead of a TUN (does not require root)")
+	flags.BoolVar(&config.SourceConfig.NetstackConfig.AllowLocal, "netstack-allow-local", false, "Let clients connect to loopback and link-local addresses of the server with -netstack")
 	transports.PartialConfigFromFlags(&config.TransportConfig, flags)
+	execConfigFromFlags(&config.ExecConfig, flags)
+	filesConfigFromFlags(&config.FilesConfig, flags)
 	flags.BoolVar(&config.DropChatter, "drop-broadcast", true, "Do not send broadcast traffic")
+	flags.StringVar(&config.NATConfig.Egress, "nat", "", "Forward the traffic of the clients to this interface (eg. eth0), masquerading it behind the server (requires a TUN)")
+	flags.BoolVar(&config.RemoteForwards, "remote-forwards", true, "Allow clients to listen on the server with -R")
+	flags.BoolVar(&config.PublicRemoteForwards, "public-remote-forwards", false, "Allow clients to listen on other addresses than loopback ones, such as every interface")
+	bizarre.LogConfigFromFlags(&config.LogConfig, flags)
+	flags.StringVar(&config.MetricsAddress, "metrics", "", "Serve Prometheus metrics on this address, at /metrics (eg. 127.0.0.1:9100)")
+	flags.DurationVar(&config.SessionTimeout, "session-timeout", 5*time.Minute, "End the session of clients that are silent for this long (0 to never end it)")
 	return &config
 }
 
+// ReadFile decodes a config file into the config, overriding the current values.
+func (config *ServerConfig) ReadFile(file string) error {
+	return bizarre.DecodeConfigFile(file, map[string]interface{}{
+		"transport":            &config.TransportConfig.Names,
+		"dropBroadcast":        &config.DropChatter,
+		"remoteForwards":       &config.RemoteForwards,
+		"publicRemoteForwards": &config.PublicRemoteForwards,
+		"sessionTimeout":       &config.SessionTimeout,
+		"log":                  &config.LogConfig,
+		"metrics":              &config.MetricsAddress,
+		"tun":                  &config.SourceConfig.TUNConfig,
+		"tap":                  &config.SourceConfig.TAPConfig,
+		"netstack":             &config.SourceConfig.NetstackConfig,
+		"nat":                  &config.NATConfig,
+		"exec":                 &config.ExecConfig,
+		"files":                &config.FilesConfig,
+	}, &config.TransportConfig)
+}
+
+// ReadConfig reads a config file, starting from the same defaults as the command line.
+func ReadConfig(file string) (*ServerConfig, error) {
+	config := NewConfigFromFlags(flag.NewFlagSet("", flag.ContinueOnError))
+	err := config.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// ApplyConfigFile reads the config file given with -config, if any, after the flags were parsed.
+func ApplyConfigFile(flags *flag.FlagSet, config *ServerConfig) error {
+	return bizarre.ApplyConfigFile(flags, config.ReadFile)
+}
+
 type Server struct {
-	TUN       sources.TUNSource
-	Transport transports.ServerTransport
+	// Network is where IP packets from clients go: a TUN or a userspace network stack, or a TAP for Ethernet frames.
+	// It is nil if none is configured, in which case the server only provides the other sources, such as the shell.
+	Network    sources.Source
+	Transports []transports.NamedServerTransport
 
-	Config  ServerConfig
-	errChan chan error
+	Config        ServerConfig
+	log           *slog.Logger
+	packets       *slog.Logger // For per-packet messages
+	clients       *clients
+	metrics       *metrics.Metrics
+	metricsServer *metrics.Server // nil unless MetricsAddress is set
+	errChan       chan error      // The first error of a goroutine, which stops Run
+	closed        chan struct{}
+	closeOnce     *sync.Once
+	exec          *executor
+	shells        *shells
+	files         *files
+	forwards      *forwards
+	nat           *nat // nil unless NAT is enabled
 }
 
 // NewServer creates a Server object that contains the entire server-side logic.
-func NewServer(config *ServerConfig) (Server, error) {
-	tun, err := sources.CreateTUN(config.SourceConfig.TUNConfig)
+func NewServer(config *ServerConfig) (_ Server, err error) {
+	serverTransports, err := transports.NewServerTransports(config.TransportConfig)
 	if err != nil {
-		return Server{}, fmt.Errorf("creating source: %w", err)
+		return Server{}, fmt.Errorf("creating transport: %w", err)
+	}
+	logger := config.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	S := Server{
+		Transports: serverTransports,
+		Config:     *config,
+		log:        logger.With(bizarre.SubsystemKey, bizarre.SubsystemServer),
+		packets:    logger.With(bizarre.SubsystemKey, bizarre.SubsystemPacket),
+		clients:    &clients{states: make(map[clientKey]*SessionState)},
+		errChan:    make(chan error, 1),
+		closed:     make(chan struct{}),
+		closeOnce:  new(sync.Once),
 	}
+	S.metrics = metrics.New(S.sessionCount)
+	for _, transport := range serverTransports {
+		if queue, ok := transport.ServerTransport.(transports.Queuer); ok {
+			S.metrics.QueueLength(transport.Name, queue.Len)
+		}
+	}
+	defer func() {
+		if err != nil {
+			// Undo what was set up, such as the routes and the NAT rules
+			S.Close()
+		}
+	}()
+	// Packets must fit in the messages of every transport, as clients may use any of them
+	var limited []interface{}
+	for _, transport := range serverTransports {
+		limited = append(limited, transport.ServerTransport)
+	}
+	sourceConfig := config.SourceConfig
+	err = sourceConfig.LimitMTU(transports.MaxPayload(limited...))
+	if err != nil {
+		return Server{}, err
+	}
+
+	if sourceConfig.NetstackConfig.Enabled {
+		netstackConfig := sourceConfig.NetstackConfig
+		netstackConfig.Forward = true
+		if netstackConfig.IP == "" {
+			netstackConfig.IP = sources.ServerNetstackIP
+		}
+		netstack, err := sources.CreateNetstack(netstackConfig)
+		if err != nil {
+			return Server{}, fmt.Errorf("creating source: %w", err)
+		}
+		S.log.Info("Using a userspace network stack")
+		S.Network = netstack
+	} else if sourceConfig.TUNConfig.Name != "" {
+		tun, err := sources.CreateTUN(sourceConfig.TUNConfig)
+		if err != nil {
+			return Server{}, fmt.Errorf("creating source: %w", err)
+		}
+		S.Network = &tun
+	} else if sourceConfig.TAPConfig.Name != "" {
+		tap, err := sources.CreateTAP(sourceConfig.TAPConfig)
+		if err != nil {
+			return Server{}, fmt.Errorf("creating source: %w", err)
+		}
+		S.Network = &tap
+	}
+
+	S.clients.pool, S.clients.reserved = addressPool(S.Network)
 
-	transport, err := transports.NewServerTransport(config.TransportConfig)
+	if config.NATConfig.Egress != "" {
+		tun, ok := S.Network.(*sources.TUNSource)
+		if !ok {
+			return Server{}, fmt.Errorf("NAT needs a TUN (with -netstack, connections are proxied without it)")
+		}
+		S.nat, err = newNAT(config.NATConfig, tun)
+		if err != nil {
+			return Server{}, fmt.Errorf("setting up NAT: %w", err)
+		}
+		S.log.Info("Masquerading the clients", "egress", config.NATConfig.Egress)
+	}
+
+	S.exec, err = newExecutor(config.ExecConfig, S.log)
 	if err != nil {
-		return Server{}, fmt.Errorf("creating transport: %w", err)
+		return Server{}, fmt.Errorf("setting up command execution: %w", err)
 	}
+	S.shells = newShells(S.exec)
 
-	return Server{TUN: tun, Transport: transport, Config: *config, errChan: make(chan error)}, nil
+	S.files, err = newFiles(config.FilesConfig, S.log)
+	if err != nil {
+		return Server{}, fmt.Errorf("setting up file transfers: %w", err)
+	}
+	S.files.chunkSize = sourceConfig.FileConfig.ChunkSize
+	S.forwards = newForwards(config.RemoteForwards, config.PublicRemoteForwards, S.Network, S.log)
+
+	if config.MetricsAddress != "" {
+		S.metricsServer, err = S.metrics.Listen(config.MetricsAddress)
+		if err != nil {
+			return Server{}, fmt.Errorf("serving metrics: %w", err)
+		}
+	}
+	return S, nil
 }
 
-func (S *Server) Run() error {
-	tunChan := make(chan []byte)
-	go S.TUN.Start(tunChan)
+// Metrics returns the metrics of the server, whose Handler can be served by programs that embed it.
+func (S Server) Metrics() *metrics.Metrics {
+	return S.metrics
+}
 
-	// Maps the in-tunnel source IP of the host to its transport address (used in WriteTo for datagram transports)
-	clientAddr := make(map[string]interface{})
+// Close stops the server, closing the transports, the listeners of remote forwards and the network, kills the commands
+// and shells of the clients, and undoes the changes that it made to the host, such as its routes and NAT rules. Run
+// returns nil once the server is closed.
+func (S Server) Close() error {
+	var errs []error
+	S.closeOnce.Do(func() {
+		close(S.closed)
+		for _, transport := range S.Transports {
+			errs = append(errs, transport.Close())
+		}
+		if S.forwards != nil {
+			errs = append(errs, S.forwards.Close())
+		}
+		if S.shells != nil {
+			S.shells.Close()
+			S.exec.Close()
+		}
+		if S.nat != nil {
+			errs = append(errs, S.nat.Close())
+		}
+		if S.Network != nil {
+			errs = append(errs, S.Network.Close())
+		}
+		if S.metricsServer != nil {
+			errs = append(errs, S.metricsServer.Close())
+		}
+	})
+	return errors.Join(errs...)
+}
+
+// fail stops Run with an error, unless it is already stopping.
+func (S *Server) fail(err error) {
+	select {
+	case S.errChan <- err:
+	default:
+	}
+}
+
+// session identifies a client by the transport it arrived on and its address on that transport, as well as the
+// stream of the client source that a message belongs to.
+type session struct {
+	Transport transports.ServerTransport
+	Address   interface{}
+	Stream    uint16
+	metrics   *metrics.Metrics
+}
+
+func (s session) WriteTo(payload []byte) (int, error) {
+	n, err := s.Transport.WriteTo(payload, s.Address)
+	if err == nil {
+		s.metrics.Message(metrics.Sent, n)
+	}
+	return n, err
+}
+
+// LogValue describes the client in log messages.
+func (s session) LogValue() slog.Value {
+	return slog.StringValue(fmt.Sprint(s.Address))
+}
+
+// Send sends a message on the stream of the session.
+func (s session) Send(msg bizarre.Message) error {
+	msg.Stream = s.Stream
+	_, err := s.WriteTo(msg.Marshal())
+	return err
+}
+
+// streamKey identifies a client stream.
+type streamKey struct {
+	Transport transports.ServerTransport
+	Address   string
+	Stream    uint16
+}
+
+func keyOf(client session) streamKey {
+	return streamKey{Transport: client.Transport, Address: fmt.Sprint(client.Address), Stream: client.Stream}
+}
+
+// endpointAddr returns the IP address of a network endpoint of a packet. Unlike Endpoint.String, it tells IPv6 addresses
+// apart from the IPv4 addresses that they embed.
+func endpointAddr(endpoint gopacket.Endpoint) netip.Addr {
+	addr, _ := netip.AddrFromSlice(endpoint.Raw())
+	return addr
+}
+
+// addressPool returns the prefix that the addresses of client network stacks are assigned from, and the addresses of
+// the server in it: the subnet of the TUN, or the /24 (or /64) around the address of the network stack. The prefix is
+// invalid for TAPs, whose clients bridge Ethernet frames rather than route packets.
+func addressPool(network sources.Source) (netip.Prefix, []netip.Addr) {
+	switch network := network.(type) {
+	case *sources.NetstackSource:
+		ip, err := netip.ParseAddr(network.IP)
+		if err != nil {
+			return netip.Prefix{}, nil
+		}
+		ip = ip.Unmap()
+		bits := 24
+		if ip.Is6() {
+			bits = 64
+		}
+		return netip.PrefixFrom(ip, bits).Masked(), []netip.Addr{ip}
+	case *sources.TUNSource:
+		var pool netip.Prefix
+		var reserved []netip.Addr
+		for _, address := range network.Addresses {
+			ip, ok := netip.AddrFromSlice(address.IP)
+			if !ok {
+				continue
+			}
+			ip = ip.Unmap()
+			reserved = append(reserved, ip)
+			if !pool.IsValid() {
+				ones, _ := address.Mask.Size()
+				pool = netip.PrefixFrom(ip, ones).Masked()
+			}
+		}
+		return pool, reserved
+	default:
+		return netip.Prefix{}, nil
+	}
+}
+
+// taggedPacket is a packet received from a transport, along with the session it belongs to.
+type taggedPacket struct {
+	Payload       []byte
+	TransportName string
+	session
+}
 
+// listen runs a transport listener, tagging its packets with the transport they arrived on, until it returns.
+func listen(transport transports.NamedServerTransport, ch chan<- taggedPacket, m *metrics.Metrics) error {
 	transportChan := make(chan transports.Packet)
-	go S.Transport.Listen(transportChan)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- transport.ServerTransport.Listen(transportChan)
+		close(transportChan)
+	}()
+	for packet := range transportChan {
+		ch <- taggedPacket{
+			Payload:       packet.Payload,
+			TransportName: transport.Name,
+			session:       session{Transport: transport.ServerTransport, Address: packet.Address, metrics: m},
+		}
+	}
+	return <-errChan
+}
+
+// Run runs the server until the context is cancelled, the server is closed, or the network or a transport fails. The
+// server is closed when Run returns, which ends the sessions of the clients.
+func (S *Server) Run(ctx context.Context) (err error) {
+	defer func() {
+		closeErr := S.Close()
+		if err == nil {
+			err = closeErr
+		}
+		S.expire(0)
+	}()
+
+	tunChan := make(chan bizarre.Message)
+	if S.Network != nil {
+		go func() {
+			err := S.Network.Start(tunChan)
+			if err != nil {
+				S.fail(fmt.Errorf("network: %w", err))
+			}
+		}()
+	}
+
+	if S.metricsServer != nil {
+		go func() {
+			err := S.metricsServer.Serve()
+			if err != nil {
+				S.fail(fmt.Errorf("serving metrics: %w", err))
+			}
+		}()
+	}
+
+	// Maps the in-tunnel source IP of the host to its session (used in WriteTo for datagram transports)
+	sessions := make(map[netip.Addr]session)
+	// Maps the MAC addresses behind TAP clients to their session, like a learning bridge
+	stations := make(map[string]session)
+
+	transportChan := make(chan taggedPacket)
+	for _, transport := range S.Transports {
+		go func(transport transports.NamedServerTransport) {
+			err := listen(transport, transportChan, S.metrics)
+			if err != nil {
+				S.fail(fmt.Errorf("%s transport: %w", transport.Name, err))
+			}
+		}(transport)
+	}
+
+	// Silent clients are checked for a few times per timeout
+	var expiry <-chan time.Time
+	if S.Config.SessionTimeout > 0 {
+		ticker := time.NewTicker(S.Config.SessionTimeout / 4)
+		defer ticker.Stop()
+		expiry = ticker.C
+	}
 
 	for {
 		select {
-		case packet := <-tunChan:
+		case tunMsg := <-tunChan:
+			if tunMsg.Type == bizarre.MessageEthernet {
+				S.sendFrame(tunMsg.Payload, stations)
+				continue
+			}
+			packet := tunMsg.Payload
 			pkt := bizarre.TryParse(packet)
 			if pkt == nil {
-				warn.Println("Dropping packet: not an IP packet")
+				S.packets.Warn("Dropping packet from the network: not an IP packet")
+				S.drop(bizarre.DropNotIP, packet)
 				continue
 			}
 			if S.Config.DropChatter && bizarre.IsChatter(pkt) {
-				debug.Println("Dropping packet: chatter")
+				S.packets.Debug("Dropping packet from the network: chatter", "packet", bizarre.LogPacket(pkt))
+				S.drop(bizarre.DropChatter, packet)
 				continue
 			}
-			debug.Printf("TUN received: %s type=%s bytes=%d", bizarre.FlowString(pkt), bizarre.LayerString(pkt), len(packet))
+			S.packets.Debug("Network received", "packet", bizarre.LogPacket(pkt), "bytes", len(packet))
 			netFlow := pkt.NetworkLayer().NetworkFlow()
 			_, tunnelDst := netFlow.Endpoints()
-			addr := clientAddr[tunnelDst.String()]
-			if addr == nil {
-				warn.Println("Dropping packet: no client found for this flow")
+			client, ok := sessions[endpointAddr(tunnelDst)]
+			if !ok {
+				S.packets.Warn("Dropping packet: no client found for this flow", "packet", bizarre.LogPacket(pkt))
+				S.drop(bizarre.DropNoClient, packet)
 				continue
 			}
-			n, err := S.Transport.WriteTo(packet, addr)
+			err := client.Send(bizarre.Message{Type: bizarre.MessageIP, Payload: packet})
 			if err != nil {
-				warn.Println("Error writing packet to transport: " + err.Error())
+				S.packets.Warn("Error writing packet to transport", "client", client, "error", err)
+				S.drop(bizarre.DropTransportError, packet)
 				continue
 			}
-			debug.Printf("Wrote %d bytes to transport", n)
+			S.packets.Debug("Wrote to transport", "client", client, "bytes", len(packet))
 
 		case packet := <-transportChan:
-			if pkt := bizarre.TryParse(packet.Payload); pkt != nil {
+			S.metrics.Message(metrics.Received, len(packet.Payload))
+			msg, err := bizarre.ParseMessage(packet.Payload)
+			if err != nil {
+				S.packets.Warn("Dropping packet received from transport", "client", packet.session, "error", err)
+				S.drop(bizarre.DropMalformed, packet.Payload)
+				continue
+			}
+			packet.Stream = msg.Stream
+			S.seen(packet)
+
+			switch msg.Type {
+			case bizarre.MessageHello:
+				// todo: read credentials here
+				S.log.Debug("Received hello, replying with hello-ack", "client", packet.session)
+				var ack bizarre.HelloAck
+				if msg.Flags&bizarre.FlagAddress != 0 {
+					ack.Address, err = S.assignAddress(packet.session)
+					if err != nil {
+						S.log.Warn("Could not assign an address to the client", "client", packet.session, "error", err)
+					} else {
+						S.log.Info("Assigned an address to the client", "client", packet.session, "ip", ack.Address.String())
+						sessions[ack.Address] = packet.session
+					}
+				}
+				err := packet.Send(bizarre.Message{Type: bizarre.MessageHelloAck, Payload: ack.Marshal()})
+				if err != nil {
+					S.log.Warn("Error writing hello-ack to transport", "client", packet.session, "error", err)
+					S.metrics.HandshakeFailed()
+				}
+			case bizarre.MessagePing:
+				err := packet.Send(bizarre.Message{Type: bizarre.MessagePong})
+				if err != nil {
+					S.log.Warn("Error writing pong to transport", "client", packet.session, "error", err)
+				}
+			case bizarre.MessageIP:
+				if S.Network == nil {
+					S.packets.Warn("Dropping packet: no TUN or network stack configured", "client", packet.session)
+					S.drop(bizarre.DropNoNetwork, msg.Payload)
+					continue
+				}
+				pkt := bizarre.TryParse(msg.Payload)
+				if pkt == nil {
+					S.packets.Warn("Dropping packet: not an IP packet", "client", packet.session)
+					S.drop(bizarre.DropNotIP, msg.Payload)
+					continue
+				}
 				if S.Config.DropChatter && bizarre.IsChatter(pkt) {
+					S.drop(bizarre.DropChatter, msg.Payload)
 					continue
 				}
 
 				// Inspect the source address so packet responses (syn-acks, etc) can be sent to the host
 				netFlow := pkt.NetworkLayer().NetworkFlow()
 				tunnelSrc, _ := netFlow.Endpoints()
-				clientAddr[tunnelSrc.String()] = packet.Address
+				sessions[endpointAddr(tunnelSrc)] = packet.session
+				S.learnAddress(packet.session, endpointAddr(tunnelSrc))
 
-				debug.Printf("Transport received: %s type=%s bytes=%d", bizarre.FlowString(pkt), bizarre.LayerString(pkt), len(packet.Payload))
+				S.packets.Debug("Transport received", "client", packet.session, "packet", bizarre.LogPacket(pkt), "bytes", len(msg.Payload))
 
-				_, err := S.TUN.TUN.Write(packet.Payload)
+				err := S.Network.Write(msg)
 				if err != nil {
-					warn.Println("Error writing packet to TUN: " + err.Error())
-					return err
+					S.packets.Warn("Error writing packet to the network", "error", err)
+					S.drop(bizarre.DropNetworkError, msg.Payload)
+					continue
 				}
-				debug.Printf("Wrote %d bytes to TUN", len(packet.Payload))
-			} else if hello := bizarre.TryParseHello(packet.Payload); hello != nil {
-				// todo: read credentials here
-				debug.Println("net=>tun: hello (replying with hello-ack)")
-				warn.Println("todo: process hello")
-				S.Transport.WriteTo(bizarre.HELLO_ACK_MESSAGE, packet.Address)
-				/*
-					_, err := conn.WriteTo(HELLO_ACK_MESSAGE, transportSrc)
-					if err != nil {
-						serverDoneChan <- err
-						break
-					}
-				*/
-			} else if packet.Payload[0] == sources.CMD_EXEC_CMD_HEADER {
-				command := string(packet.Payload[1:])
-				debug.Printf("net=>tun: command %q", command)
-				go func(command string) {
-					info.Printf("Executing command %q", command)
-					cmdObj := exec.Command("bash", "-c", command)
-					cmdObj.Stdout = sources.WithStdoutHeader(S.Transport.WriterTo(packet.Address))
-					err := cmdObj.Start()
-					if err != nil {
-						warn.Printf("Running %q: %s", command, err)
-					}
-					err = cmdObj.Wait()
-					if err != nil {
-						warn.Printf("Running %q: %s", command, err)
-					}
-				}(command)
-			} else {
-				warn.Printf("Unknown packet received from transport! %d bytes, starts with %x", len(packet.Payload), packet.Payload[:10])
+				S.packets.Debug("Wrote to the network", "bytes", len(msg.Payload))
+			case bizarre.MessageEthernet:
+				if S.Network == nil {
+					S.packets.Warn("Dropping frame: no TAP configured", "client", packet.session)
+					S.drop(bizarre.DropNoNetwork, msg.Payload)
+					continue
+				}
+				pkt := bizarre.TryParseFrame(msg.Payload)
+				if pkt == nil {
+					S.packets.Warn("Dropping frame: not an Ethernet frame", "client", packet.session)
+					S.drop(bizarre.DropNotIP, msg.Payload)
+					continue
+				}
+				if S.Config.DropChatter && bizarre.IsChatter(pkt) {
+					S.drop(bizarre.DropChatter, msg.Payload)
+					continue
+				}
+				ethernet := pkt.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+				stations[ethernet.SrcMAC.String()] = packet.session
+				S.packets.Debug("Transport received", "client", packet.session, "frame", bizarre.LogFrame(pkt), "bytes", len(msg.Payload))
+
+				err := S.Network.Write(msg)
+				if err != nil {
+					S.packets.Warn("Error writing frame to the network", "error", err)
+					S.drop(bizarre.DropNetworkError, msg.Payload)
+					continue
+				}
+			case bizarre.MessageCmdExec:
+				command := string(msg.Payload)
+				S.log.Debug("Received command", "client", packet.session, "stream", msg.Stream, "command", command)
+				go S.exec.Run(command, packet.session)
+			case bizarre.MessageShellOpen:
+				err := S.shells.Open(packet.session, msg.Payload)
+				if err != nil {
+					S.exec.audit.Printf("%v: could not open shell: %s", packet.Address, err)
+					packet.Send(bizarre.Message{Type: bizarre.MessageStderr, Payload: []byte("bizarre-net: " + err.Error() + "\n")})
+					packet.Send(bizarre.ExitMessage(126))
+				}
+			case bizarre.MessageStdin, bizarre.MessageShellResize:
+				err := S.shells.Handle(packet.session, msg)
+				if err != nil {
+					S.log.Warn("Error handling message", "client", packet.session, "type", msg.Type.String(), "error", err)
+				}
+			case bizarre.MessageFileList, bizarre.MessageFileStat, bizarre.MessageFileGet,
+				bizarre.MessageFilePut, bizarre.MessageFileData, bizarre.MessageFileDone:
+				S.files.Handle(packet.session, msg)
+			case bizarre.MessageForward:
+				request, err := bizarre.ParseForward(msg.Payload)
+				if err != nil {
+					S.log.Warn("Dropping forward request", "client", packet.session, "error", err)
+					continue
+				}
+				// An IPv4-mapped target is reached with IPv4 packets
+				target := request.Target.Addr().Unmap()
+				result := bizarre.ForwardResult{UDP: request.UDP, Bind: request.Bind}
+				if !S.hasAddress(packet.session, target) {
+					// Otherwise a client could take over the packets of another one
+					err = fmt.Errorf("%s is not an address of the client", target)
+				} else {
+					err = S.forwards.Open(packet.session, request)
+				}
+				if err != nil {
+					S.log.Warn("Refusing to forward", "client", packet.session, "bind", request.Bind, "error", err)
+					result.Error = err.Error()
+				} else {
+					// The server connects to the client before it sends any packet
+					sessions[target] = packet.session
+				}
+				packet.Send(bizarre.Message{Type: bizarre.MessageForwardResult, Flags: bizarre.FlagEnd, Payload: result.Marshal()})
+			default:
+				S.log.Warn("Unknown message received", "client", packet.session, "type", msg.Type.String(), "stream", msg.Stream, "bytes", len(msg.Payload))
 			}
+		case <-expiry:
+			S.expire(S.Config.SessionTimeout)
 		case err := <-S.errChan:
 			return err
+		case <-S.closed:
+			return nil
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// sendFrame sends a frame from the TAP to the client behind its destination address, or to every client if it is a
+// broadcast or multicast address, or one that was not seen yet.
+func (S *Server) sendFrame(frame []byte, stations map[string]session) {
+	pkt := bizarre.TryParseFrame(frame)
+	if pkt == nil {
+		S.packets.Warn("Dropping frame from the network: not an Ethernet frame")
+		S.drop(bizarre.DropNotIP, frame)
+		return
+	}
+	if S.Config.DropChatter && bizarre.IsChatter(pkt) {
+		S.packets.Debug("Dropping frame from the network: chatter", "frame", bizarre.LogFrame(pkt))
+		S.drop(bizarre.DropChatter, frame)
+		return
+	}
+	S.packets.Debug("Network received", "frame", bizarre.LogFrame(pkt), "bytes", len(frame))
+	msg := bizarre.Message{Type: bizarre.MessageEthernet, Payload: frame}
+	ethernet := pkt.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	if client, ok := stations[ethernet.DstMAC.String()]; ok {
+		err := client.Send(msg)
+		if err != nil {
+			S.packets.Warn("Error writing frame to transport", "client", client, "error", err)
+			S.drop(bizarre.DropTransportError, frame)
+		}
+		return
+	}
+	flooded := make(map[streamKey]bool)
+	for _, client := range stations {
+		key := keyOf(client)
+		if flooded[key] {
+			continue
+		}
+		flooded[key] = true
+		err := client.Send(msg)
+		if err != nil {
+			S.packets.Warn("Error writing frame to transport", "client", client, "error", err)
 		}
 	}
 }
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	bizarre "github.com/CapacitorSet/bizarre-net"
+	"github.com/CapacitorSet/bizarre-net/transports"
+)
+
+func init() {
+	transports.Register(transports.Registration{
+		Name:      "fake",
+		NewConfig: func() interface{} { return newFakeTransport() },
+		NewServer: func(config interface{}) (transports.ServerTransport, error) {
+			return config.(*fakeTransport), nil
+		},
+	})
+}
+
+// fakeTransport is a server transport that receives the packets that a test gives it, and records its replies.
+type fakeTransport struct {
+	incoming chan transports.Packet
+	replies  chan transports.Packet
+	closed   chan struct{}
+}
+
+func newFakeTransport() *fakeTransport {
+	return &fakeTransport{
+		incoming: make(chan transports.Packet),
+		replies:  make(chan transports.Packet, 100),
+		closed:   make(chan struct{}),
+	}
+}
+
+func (T *fakeTransport) Listen(ch chan<- transports.Packet) error {
+	for {
+		select {
+		case packet := <-T.incoming:
+			ch <- packet
+		case <-T.closed:
+			return nil
+		}
+	}
+}
+
+func (T *fakeTransport) WriteTo(payload []byte, address interface{}) (int, error) {
+	T.replies <- transports.Packet{Payload: append([]byte(nil), payload...), Address: address}
+	return len(payload), nil
+}
+
+func (T *fakeTransport) WriterTo(address interface{}) io.Writer {
+	return nil
+}
+
+func (T *fakeTransport) Close() error {
+	close(T.closed)
+	return nil
+}
+
+// send gives the transport a message from a client.
+func (T *fakeTransport) send(address string, msg bizarre.Message) {
+	T.incoming <- transports.Packet{Payload: msg.Marshal(), Address: address}
+}
+
+// reply returns the next reply of the server.
+func (T *fakeTransport) reply(t *testing.T) (bizarre.Message, interface{}) {
+	t.Helper()
+	select {
+	case packet := <-T.replies:
+		msg, err := bizarre.ParseMessage(packet.Payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg, packet.Address
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a reply")
+		return bizarre.Message{}, nil
+	}
+}
+
+// startServer runs a server with the given config over a fake transport, named "fake", and the other transports. It
+// stops the server at the end of the test.
+func startServer(t *testing.T, config ServerConfig, others ...transports.NamedServerTransport) *fakeTransport {
+	transport := newFakeTransport()
+	config.TransportConfig = transports.TransportConfig{Names: []string{"fake"}, Configs: map[string]interface{}{"fake": transport}}
+	config.Logger = slog.New(slog.DiscardHandler)
+	S, err := NewServer(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	S.Transports = append(S.Transports, others...)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() {
+		stopped <- S.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-stopped; err != nil {
+			t.Error(err)
+		}
+	})
+	return transport
+}
+
+// TestStreams checks that interleaved messages on two streams of a client reach the handler of their own stream, and
+// that the replies are sent on the same stream.
+func TestStreams(t *testing.T) {
+	transport := startServer(t, ServerConfig{ExecConfig: ExecConfig{Enabled: true}})
+	for _, msg := range []bizarre.Message{
+		{Type: bizarre.MessageShellOpen, Stream: 1, Payload: bizarre.ShellOpen{}.Marshal()},
+		{Type: bizarre.MessageShellOpen, Stream: 2, Payload: bizarre.ShellOpen{}.Marshal()},
+		{Type: bizarre.MessageStdin, Stream: 2, Payload: []byte("echo two\n")},
+		{Type: bizarre.MessageStdin, Stream: 1, Payload: []byte("echo one\n")},
+		{Type: bizarre.MessageStdin, Stream: 1, Flags: bizarre.FlagEnd, Payload: []byte("exit 1\n")},
+		{Type: bizarre.MessageStdin, Stream: 2, Flags: bizarre.FlagEnd, Payload: []byte("exit 2\n")},
+	} {
+		transport.send("client", msg)
+	}
+
+	stdout := make(map[uint16]string)
+	exited := make(map[uint16]int)
+	for len(exited) < 2 {
+		reply, _ := transport.reply(t)
+		switch reply.Type {
+		case bizarre.MessageStdout:
+			stdout[reply.Stream] += string(reply.Payload)
+		case bizarre.MessageExit:
+			status, err := bizarre.ParseExitStatus(reply.Payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			exited[reply.Stream] = status
+		default:
+			t.Fatalf("unexpected %s message on stream %d", reply.Type, reply.Stream)
+		}
+	}
+	if stdout[1] != "one\n" || stdout[2] != "two\n" {
+		t.Errorf("got the output %v", stdout)
+	}
+	if exited[1] != 1 || exited[2] != 2 {
+		t.Errorf("got the exit statuses %v", exited)
+	}
+}
+
+// TestReplyTransport checks that the server answers each client over the transport that its message arrived on.
+func TestReplyTransport(t *testing.T) {
+	other := newFakeTransport()
+	transport := startServer(t, ServerConfig{}, transports.NamedServerTransport{Name: "other", ServerTransport: other})
+	transport.send("192.0.2.1:9000", bizarre.Message{Type: bizarre.MessageHello})
+	other.send("192.0.2.2:9000", bizarre.Message{Type: bizarre.MessageHello})
+	// Both transports can have a client with the same address
+	other.send("192.0.2.1:9000", bizarre.Message{Type: bizarre.MessagePing})
+	transport.send("192.0.2.1:9000", bizarre.Message{Type: bizarre.MessagePing})
+
+	for _, expected := range []struct {
+		transport *fakeTransport
+		replies   []bizarre.MessageType
+		addresses []string
+	}{
+		{transport, []bizarre.MessageType{bizarre.MessageHelloAck, bizarre.MessagePong}, []string{"192.0.2.1:9000", "192.0.2.1:9000"}},
+		{other, []bizarre.MessageType{bizarre.MessageHelloAck, bizarre.MessagePong}, []string{"192.0.2.2:9000", "192.0.2.1:9000"}},
+	} {
+		for i, kind := range expected.replies {
+			reply, address := expected.transport.reply(t)
+			if reply.Type != kind || address != expected.addresses[i] {
+				t.Errorf("got %s for %v, expected %s for %s", reply.Type, address, kind, expected.addresses[i])
+			}
+		}
+		if len(expected.transport.replies) != 0 {
+			t.Errorf("got %d more replies", len(expected.transport.replies))
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+
+	bizarre "github.com/CapacitorSet/bizarre-net"
+	"github.com/CapacitorSet/bizarre-net/sources"
+	"github.com/creack/pty"
+)
+
+// shellQueueLen is how many stdin messages can wait for a shell to read them before it is killed
+const shellQueueLen = 64
+
+type shell struct {
+	cmd    *exec.Cmd
+	cancel context.CancelFunc // Kills the shell
+	stdin  io.WriteCloser
+	pty    *os.File // nil if the shell has no terminal
+
+	// Stdin messages are written by a goroutine of their own, so that a shell that does not read them only blocks
+	// itself
+	input  chan bizarre.Message
+	exited chan struct{} // Closed when the shell has exited, which stops the goroutine
+
+	outputDone chan struct{} // Closed when all the output of the PTY was sent
+	limit      *outputLimit
+}
+
+// shells holds the running shells, indexed by client stream.
+type shells struct {
+	sync.Mutex
+	running map[streamKey]*shell
+	exec    *executor
+}
+
+func newShells(exec *executor) *shells {
+	return &shells{running: make(map[streamKey]*shell), exec: exec}
+}
+
+// Open starts a shell for a client stream.
+func (S *shells) Open(client session, payload []byte) error {
+	open, err := bizarre.ParseShellOpen(payload)
+	if err != nil {
+		return err
+	}
+	if !S.exec.Enabled {
+		return errors.New("command execution is disabled")
+	}
+	if len(S.exec.patterns) != 0 {
+		return errors.New("shells are not allowed when commands are restricted")
+	}
+	key := keyOf(client)
+	S.Lock()
+	_, exists := S.running[key]
+	S.Unlock()
+	if exists {
+		return errors.New("a shell is already running on this stream")
+	}
+	err = S.exec.acquire()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cmd := S.exec.command(ctx, "bash")
+	cmd.Env = append(cmd.Env, "TERM="+open.Term)
+	sh := &shell{cmd: cmd, cancel: cancel, input: make(chan bizarre.Message, shellQueueLen), exited: make(chan struct{})}
+	kill := func() { killGroup(cmd) }
+	if open.Rows != 0 && open.Cols != 0 {
+		// The shell leads a session of its own, and thus a process group, which it cannot also create
+		cmd.SysProcAttr.Setpgid = false
+		sh.pty, err = pty.StartWithSize(cmd, &pty.Winsize{Rows: open.Rows, Cols: open.Cols})
+		if err != nil {
+			cancel()
+			S.exec.release()
+			return err
+		}
+		sh.stdin = sh.pty
+		sh.outputDone = make(chan struct{})
+		output := io.Writer(sources.MessageWriter{Sender: client, Type: bizarre.MessageStdout})
+		sh.limit = S.exec.limitOutput(kill, &output)
+		go func() {
+			// Reading fails with EIO once the shell and its children have exited
+			io.Copy(output, sh.pty)
+			close(sh.outputDone)
+		}()
+	} else {
+		sh.stdin, err = cmd.StdinPipe()
+		if err != nil {
+			cancel()
+			S.exec.release()
+			return err
+		}
+		cmd.Stdout = sources.MessageWriter{Sender: client, Type: bizarre.MessageStdout}
+		cmd.Stderr = sources.MessageWriter{Sender: client, Type: bizarre.MessageStderr}
+		sh.limit = S.exec.limitOutput(kill, &cmd.Stdout, &cmd.Stderr)
+		err = cmd.Start()
+		if err != nil {
+			cancel()
+			S.exec.release()
+			return err
+		}
+	}
+	S.exec.audit.Printf("%v: opened shell (pid %d, terminal: %t)", client.Address, cmd.Process.Pid, sh.pty != nil)
+
+	S.Lock()
+	S.running[key] = sh
+	S.Unlock()
+	go S.writeInput(sh)
+	go S.wait(client, sh)
+	return nil
+}
+
+// writeInput writes the stdin messages of a shell to it, until the shell exits.
+func (S *shells) writeInput(sh *shell) {
+	for {
+		select {
+		case msg := <-sh.input:
+			err := sh.write(msg)
+			if err != nil {
+				S.exec.log.Debug("Could not write to shell", "error", err)
+			}
+		case <-sh.exited:
+			return
+		}
+	}
+}
+
+func (sh *shell) write(msg bizarre.Message) error {
+	if len(msg.Payload) != 0 {
+		_, err := sh.stdin.Write(msg.Payload)
+		if err != nil {
+			return err
+		}
+	}
+	if msg.Flags&bizarre.FlagEnd != 0 {
+		if sh.pty != nil {
+			// Closing the PTY would hang up the shell; send an end-of-file character instead
+			_, err := sh.pty.Write([]byte{4})
+			return err
+		}
+		return sh.stdin.Close()
+	}
+	return nil
+}
+
+func (S *shells) wait(client session, sh *shell) {
+	err := sh.cmd.Wait()
+	sh.cancel()
+	close(sh.exited)
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		S.exec.log.Warn("Error waiting for shell", "error", err)
+	}
+	if sh.pty != nil {
+		<-sh.outputDone
+		sh.pty.Close()
+	}
+	S.Lock()
+	delete(S.running, keyOf(client))
+	S.Unlock()
+	S.exec.release()
+
+	status := exitStatus(sh.cmd.ProcessState)
+	reason := ""
+	if sh.limit != nil && sh.limit.exceeded {
+		reason = " (output limit exceeded)"
+	}
+	S.exec.audit.Printf("%v: shell exited with status %d%s", client.Address, status, reason)
+	err = client.Send(bizarre.ExitMessage(status))
+	if err != nil {
+		S.exec.log.Warn("Error sending exit status", "error", err)
+	}
+}
+
+// Kill kills the shells of a client.
+func (S *shells) Kill(client clientKey) {
+	S.Lock()
+	defer S.Unlock()
+	for key, sh := range S.running {
+		if key.Transport == client.Transport && key.Address == client.Address {
+			sh.cancel()
+		}
+	}
+}
+
+// Close kills every shell.
+func (S *shells) Close() {
+	S.Lock()
+	defer S.Unlock()
+	for _, sh := range S.running {
+		sh.cancel()
+	}
+}
+
+// Handle handles a message for the shell of a client stream.
+func (S *shells) Handle(client session, msg bizarre.Message) error {
+	S.Lock()
+	sh := S.running[keyOf(client)]
+	S.Unlock()
+	if sh == nil {
+		return errors.New("no shell running on this stream")
+	}
+
+	switch msg.Type {
+	case bizarre.MessageStdin:
+		select {
+		case sh.input <- msg:
+			return nil
+		default:
+			sh.cancel()
+			return errors.New("the shell does not read its input, killing it")
+		}
+	case bizarre.MessageShellResize:
+		if sh.pty == nil {
+			return nil
+		}
+		size, err := bizarre.ParseWindowSize(msg.Payload)
+		if err != nil {
+			return err
+		}
+		return pty.Setsize(sh.pty, &pty.Winsize{Rows: size.Rows, Cols: size.Cols})
+	default:
+		return fmt.Errorf("unexpected %s message", msg.Type)
+	}
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	bizarre "github.com/CapacitorSet/bizarre-net"
+)
+
+// TestShell runs a shell without a terminal, which reads commands from stdin.
+func TestShell(t *testing.T) {
+	transport := startServer(t, ServerConfig{ExecConfig: ExecConfig{Enabled: true}})
+	transport.send("client", bizarre.Message{Type: bizarre.MessageShellOpen, Stream: 1, Payload: bizarre.ShellOpen{}.Marshal()})
+	transport.send("client", bizarre.Message{Type: bizarre.MessageStdin, Stream: 1, Payload: []byte("echo hello\necho oops >&2\n")})
+	transport.send("client", bizarre.Message{Type: bizarre.MessageStdin, Stream: 1, Flags: bizarre.FlagEnd, Payload: []byte("exit 3\n")})
+
+	var stdout, stderr string
+	for {
+		reply, _ := transport.reply(t)
+		if reply.Stream != 1 {
+			t.Fatalf("got a reply on stream %d", reply.Stream)
+		}
+		switch reply.Type {
+		case bizarre.MessageStdout:
+			stdout += string(reply.Payload)
+		case bizarre.MessageStderr:
+			stderr += string(reply.Payload)
+		case bizarre.MessageExit:
+			status, err := bizarre.ParseExitStatus(reply.Payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status != 3 {
+				t.Errorf("got exit status %d, expected 3", status)
+			}
+			if stdout != "hello\n" || stderr != "oops\n" {
+				t.Errorf("got stdout %q and stderr %q", stdout, stderr)
+			}
+			return
+		default:
+			t.Fatalf("unexpected %s message", reply.Type)
+		}
+	}
+}
+
+// TestShellNotReading checks that a shell that does not read its input is killed, rather than blocking the server.
+func TestShellNotReading(t *testing.T) {
+	transport := startServer(t, ServerConfig{ExecConfig: ExecConfig{Enabled: true}})
+	transport.send("client", bizarre.Message{Type: bizarre.MessageShellOpen, Stream: 1, Payload: bizarre.ShellOpen{}.Marshal()})
+	transport.send("client", bizarre.Message{Type: bizarre.MessageStdin, Stream: 1, Payload: []byte("exec sleep 60\n")})
+	go func() {
+		// More than the pipe and the queue hold
+		for i := 0; i < 4*shellQueueLen; i++ {
+			transport.send("client", bizarre.Message{Type: bizarre.MessageStdin, Stream: 1, Payload: make([]byte, 4096)})
+		}
+		transport.send("client", bizarre.Message{Type: bizarre.MessagePing})
+	}()
+
+	pong, exited := false, false
+	for !pong || !exited {
+		reply, _ := transport.reply(t)
+		switch reply.Type {
+		case bizarre.MessagePong:
+			pong = true
+		case bizarre.MessageExit:
+			exited = true
+		}
+	}
+}
+
+// TestSessionExpiryKills checks that the commands and shells of a client are killed when its session ends.
+func TestSessionExpiryKills(t *testing.T) {
+	transport := startServer(t, ServerConfig{SessionTimeout: 200 * time.Millisecond, ExecConfig: ExecConfig{Enabled: true}})
+	transport.send("client", bizarre.Message{Type: bizarre.MessageCmdExec, Stream: 1, Payload: []byte("sleep 60")})
+	transport.send("client", bizarre.Message{Type: bizarre.MessageShellOpen, Stream: 2, Payload: bizarre.ShellOpen{}.Marshal()})
+	transport.send("client", bizarre.Message{Type: bizarre.MessageStdin, Stream: 2, Payload: []byte("exec sleep 60\n")})
+
+	exited := make(map[uint16]bool)
+	for len(exited) < 2 {
+		reply, _ := transport.reply(t)
+		if reply.Type != bizarre.MessageExit {
+			t.Fatalf("unexpected %s message", reply.Type)
+		}
+		status, err := bizarre.ParseExitStatus(reply.Payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != 128+int(syscall.SIGKILL) {
+			t.Errorf("stream %d: got exit status %d, expected the command to be killed", reply.Stream, status)
+		}
+		exited[reply.Stream] = true
+	}
+}
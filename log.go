@@ -0,0 +1,194 @@
+package bizarre_net
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+
+	"github.com/google/gopacket"
+)
+
+// SubsystemKey is the attribute that tells which part of bizarre-net a message comes from. Loggers are tagged with it
+// through With, eg. logger.With(SubsystemKey, SubsystemPacket), which lets LogConfig give each subsystem a level.
+const SubsystemKey = "subsystem"
+
+const (
+	SubsystemClient    = "client"
+	SubsystemServer    = "server"
+	SubsystemPacket    = "packet" // Per-packet messages, which are sampled
+	SubsystemTransport = "transport"
+	SubsystemSource    = "source"
+	SubsystemAudit     = "audit" // Commands that the server runs, unless they are logged to a file of their own
+)
+
+// LogConfig configures the logger of the command line tools.
+type LogConfig struct {
+	Level  string // A level such as "info", optionally followed by levels per subsystem, eg. "info,packet=debug"
+	Format string // "text" or "json"
+	Sample int    // Only one in this many per-packet messages is logged; 0 or 1 logs all of them
+}
+
+// LogConfigFromFlags binds a flagset to a LogConfig struct, so that the config is filled upon parsing the flags.
+func LogConfigFromFlags(config *LogConfig, flags *flag.FlagSet) {
+	flags.StringVar(&config.Level, "log-level", "info", "Log level (debug, info, warn or error), optionally followed by levels per subsystem: client, server, packet, transport, source or audit (eg. info,packet=debug)")
+	flags.StringVar(&config.Format, "log-format", "text", "Log format: text or json")
+	flags.IntVar(&config.Sample, "log-sample", 1, "Only log one in this many per-packet messages")
+}
+
+// NewLogger returns a logger that writes to w in the format of the config.
+func (config LogConfig) NewLogger(w io.Writer) (*slog.Logger, error) {
+	levels, err := config.parseLevels()
+	if err != nil {
+		return nil, err
+	}
+	// The inner handler lets through whatever the levels allow
+	options := &slog.HandlerOptions{Level: levels.lowest()}
+	var inner slog.Handler
+	switch config.Format {
+	case "", "text":
+		inner = slog.NewTextHandler(w, options)
+	case "json":
+		inner = slog.NewJSONHandler(w, options)
+	default:
+		return nil, fmt.Errorf("unknown log format %q", config.Format)
+	}
+	return slog.New(&levelHandler{inner: inner, levels: levels}), nil
+}
+
+// NewHandler wraps a handler so that it applies the levels and the sampling of the config, for programs that log
+// elsewhere. The handler must not filter out the levels that the config enables.
+func (config LogConfig) NewHandler(inner slog.Handler) (slog.Handler, error) {
+	levels, err := config.parseLevels()
+	if err != nil {
+		return nil, err
+	}
+	return &levelHandler{inner: inner, levels: levels}, nil
+}
+
+// logLevels holds the levels of a LogConfig, and the count of per-packet messages for sampling.
+type logLevels struct {
+	level      slog.Level
+	subsystems map[string]slog.Level
+	sample     uint64
+	packets    atomic.Uint64
+}
+
+func (config LogConfig) parseLevels() (*logLevels, error) {
+	L := &logLevels{level: slog.LevelInfo, subsystems: make(map[string]slog.Level), sample: 1}
+	if config.Sample > 1 {
+		L.sample = uint64(config.Sample)
+	}
+	for _, item := range strings.Split(config.Level, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		subsystem, level, ok := strings.Cut(item, "=")
+		if !ok {
+			level = subsystem
+		}
+		var parsed slog.Level
+		err := parsed.UnmarshalText([]byte(level))
+		if err != nil {
+			return nil, fmt.Errorf("log level %q: %w", item, err)
+		}
+		if ok {
+			L.subsystems[subsystem] = parsed
+		} else {
+			L.level = parsed
+		}
+	}
+	return L, nil
+}
+
+func (L *logLevels) of(subsystem string) slog.Level {
+	if level, ok := L.subsystems[subsystem]; ok {
+		return level
+	}
+	return L.level
+}
+
+func (L *logLevels) lowest() slog.Level {
+	lowest := L.level
+	for _, level := range L.subsystems {
+		lowest = min(lowest, level)
+	}
+	return lowest
+}
+
+// levelHandler filters messages by the level of their subsystem, which it learns from WithAttrs.
+type levelHandler struct {
+	inner     slog.Handler
+	levels    *logLevels
+	subsystem string
+}
+
+func (h *levelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	if level < h.levels.of(h.subsystem) || !h.inner.Enabled(ctx, level) {
+		return false
+	}
+	if h.subsystem == SubsystemPacket && h.levels.sample > 1 {
+		// Loggers ask before building a message, so the messages that are skipped cost almost nothing
+		return (h.levels.packets.Add(1)-1)%h.levels.sample == 0
+	}
+	return true
+}
+
+func (h *levelHandler) Handle(ctx context.Context, record slog.Record) error {
+	return h.inner.Handle(ctx, record)
+}
+
+func (h *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	ret := *h
+	ret.inner = h.inner.WithAttrs(attrs)
+	for _, attr := range attrs {
+		if attr.Key == SubsystemKey {
+			ret.subsystem = attr.Value.String()
+		}
+	}
+	return &ret
+}
+
+func (h *levelHandler) WithGroup(name string) slog.Handler {
+	ret := *h
+	ret.inner = h.inner.WithGroup(name)
+	return &ret
+}
+
+// LogPacket describes an IP packet in a log message, eg. logger.Debug("Received", "packet", LogPacket(pkt)). The
+// description is only built if the message is logged.
+func LogPacket(pkt gopacket.Packet) slog.LogValuer {
+	return packetValue{pkt: pkt, describe: FlowString}
+}
+
+// LogFrame describes an Ethernet frame in a log message, like LogPacket.
+func LogFrame(pkt gopacket.Packet) slog.LogValuer {
+	return packetValue{pkt: pkt, describe: FrameString}
+}
+
+type packetValue struct {
+	pkt      gopacket.Packet
+	describe func(gopacket.Packet) string
+}
+
+func (v packetValue) LogValue() slog.Value {
+	return slog.GroupValue(slog.String("flow", v.describe(v.pkt)), slog.String("type", LayerString(v.pkt)))
+}
+
+// DropReason tells why a client or server dropped a packet or frame.
+type DropReason string
+
+const (
+	DropChatter        DropReason = "chatter"         // Broadcast or multicast traffic, with -drop-broadcast
+	DropNotIP          DropReason = "not-ip"          // Neither an IP packet nor, on TAPs, an Ethernet frame
+	DropMalformed      DropReason = "malformed"       // A message from the transport that could not be parsed
+	DropUnknownStream  DropReason = "unknown-stream"  // A message for a stream that has no source
+	DropNoClient       DropReason = "no-client"       // No client has the destination address of the packet
+	DropNoNetwork      DropReason = "no-network"      // The server has no TUN, TAP or network stack
+	DropTransportError DropReason = "transport-error" // Writing to the transport failed
+	DropNetworkError   DropReason = "network-error"   // Writing to the TUN, TAP or network stack failed
+)
@@ -0,0 +1,45 @@
+package bizarre_net
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestLogLevels(t *testing.T) {
+	var buffer bytes.Buffer
+	logger, err := LogConfig{Level: "warn,packet=debug", Format: "json", Sample: 3}.NewLogger(&buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := logger.With(SubsystemKey, SubsystemClient)
+	packets := logger.With(SubsystemKey, SubsystemPacket)
+	client.Info("skipped")
+	client.Warn("logged")
+	for i := 0; i < 6; i++ {
+		packets.Debug("packet", "i", i)
+	}
+
+	var lines []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buffer.String()), "\n") {
+		var record map[string]interface{}
+		err = json.Unmarshal([]byte(line), &record)
+		if err != nil {
+			t.Fatalf("%q: %s", line, err)
+		}
+		lines = append(lines, record)
+	}
+	if len(lines) != 3 || lines[0]["msg"] != "logged" || lines[0][SubsystemKey] != SubsystemClient {
+		t.Fatalf("unexpected log: %s", buffer.String())
+	}
+	// One in three per-packet messages is logged
+	if lines[1]["i"] != 0.0 || lines[2]["i"] != 3.0 {
+		t.Errorf("unexpected sampling: %s", buffer.String())
+	}
+
+	_, err = LogConfig{Level: "loud"}.NewLogger(&buffer)
+	if err == nil {
+		t.Error("expected an invalid level to be refused")
+	}
+}
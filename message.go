@@ -1,26 +1,401 @@
 package bizarre_net
 
 import (
-	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io/fs"
+	"net/netip"
+	"strings"
+	"time"
 )
 
-// IPv4 messages start with 0x4 and IPv6 messages start with 0x6. These don't need a specific "header" byte.
+// Every message in the tunnel is wrapped in an envelope:
+//
+//	+---------+------+-------+-----------+-----------+---------+
+//	| version | type | flags | stream ID |  length   | payload |
+//	| 1 byte  | 1 B  |  1 B  | 2 B (BE)  | 2 B (BE)  |   ...   |
+//	+---------+------+-------+-----------+-----------+---------+
+//
+// The stream ID identifies the client source that a message belongs to; control messages (hello, ping) use stream 0.
+// The meaning of the flags depends on the message type.
 
-func TryParseHello(buffer []byte) []byte {
-	if bytes.HasPrefix(buffer, HELLO_PREFIX) {
-		return buffer[len(HELLO_PREFIX):]
-	} else {
+const (
+	MESSAGE_VERSION     = 1
+	MESSAGE_HEADER_SIZE = 7
+)
+
+type MessageType uint8
+
+const (
+	MessageHello    MessageType = 0x01 // Sent by the client when connecting; the payload holds the credentials
+	MessageHelloAck MessageType = 0x02 // See HelloAck
+	MessagePing     MessageType = 0x03 // Keepalive probe, which the server answers with a pong on the same transport
+	MessagePong     MessageType = 0x04
+
+	MessageIP       MessageType = 0x10 // An IPv4 or IPv6 packet
+	MessageEthernet MessageType = 0x11 // An Ethernet frame, for TAP sources
+
+	MessageCmdExec MessageType = 0x20 // A command to run on the server
+
+	// Process I/O, shared by the command execution and shell sources
+	MessageStdout MessageType = 0x21
+	MessageStdin  MessageType = 0x22 // FlagEnd signals the end of the input
+	MessageStderr MessageType = 0x23
+	MessageExit   MessageType = 0x24 // The payload is the exit status, as a big-endian int32
+
+	MessageShellOpen   MessageType = 0x30 // Starts a shell; see ShellOpen
+	MessageShellResize MessageType = 0x31 // The terminal was resized; see WindowSize
+
+	// File transfer; requests carry a FileRequest, and errors end the transfer with a MessageFileError
+	MessageFileList  MessageType = 0x40 // Answered with a MessageFileInfo per entry, the last one with FlagEnd
+	MessageFileStat  MessageType = 0x41 // Answered with a MessageFileInfo
+	MessageFileGet   MessageType = 0x42 // Answered with MessageFileData chunks, then a MessageFileDone
+	MessageFilePut   MessageType = 0x43 // Answered with a MessageFileInfo whose size is the offset to send data from
+	MessageFileInfo  MessageType = 0x44 // See FileInfo
+	MessageFileData  MessageType = 0x45 // See FileChunk
+	MessageFileDone  MessageType = 0x46 // See FileDone; incomplete uploads are answered like a MessageFilePut
+	MessageFileError MessageType = 0x47 // The payload is the error message
+
+	MessageForward       MessageType = 0x50 // Asks the server to listen for a remote forward; see Forward
+	MessageForwardResult MessageType = 0x51 // See ForwardResult
+)
+
+const (
+	// FlagEnd marks the last message of a stream in a given direction
+	FlagEnd uint8 = 0x01
+	// FlagAddress on a hello asks the server to assign an address in the tunnel to the network stack of the client
+	FlagAddress uint8 = 0x02
+)
+
+func (t MessageType) String() string {
+	switch t {
+	case MessageHello:
+		return "hello"
+	case MessageHelloAck:
+		return "hello-ack"
+	case MessagePing:
+		return "ping"
+	case MessagePong:
+		return "pong"
+	case MessageIP:
+		return "ip"
+	case MessageEthernet:
+		return "ethernet"
+	case MessageCmdExec:
+		return "cmd-exec"
+	case MessageStdout:
+		return "stdout"
+	case MessageStdin:
+		return "stdin"
+	case MessageStderr:
+		return "stderr"
+	case MessageExit:
+		return "exit"
+	case MessageShellOpen:
+		return "shell-open"
+	case MessageShellResize:
+		return "shell-resize"
+	case MessageFileList:
+		return "file-list"
+	case MessageFileStat:
+		return "file-stat"
+	case MessageFileGet:
+		return "file-get"
+	case MessageFilePut:
+		return "file-put"
+	case MessageFileInfo:
+		return "file-info"
+	case MessageFileData:
+		return "file-data"
+	case MessageFileDone:
+		return "file-done"
+	case MessageFileError:
+		return "file-error"
+	case MessageForward:
+		return "forward"
+	case MessageForwardResult:
+		return "forward-result"
+	default:
+		return fmt.Sprintf("unknown(%#x)", uint8(t))
+	}
+}
+
+type Message struct {
+	Type    MessageType
+	Flags   uint8
+	Stream  uint16
+	Payload []byte
+}
+
+// Marshal returns the wire representation of the message.
+func (m Message) Marshal() []byte {
+	buffer := make([]byte, MESSAGE_HEADER_SIZE+len(m.Payload))
+	buffer[0] = MESSAGE_VERSION
+	buffer[1] = byte(m.Type)
+	buffer[2] = m.Flags
+	binary.BigEndian.PutUint16(buffer[3:], m.Stream)
+	binary.BigEndian.PutUint16(buffer[5:], uint16(len(m.Payload)))
+	copy(buffer[MESSAGE_HEADER_SIZE:], m.Payload)
+	return buffer
+}
+
+// ParseMessage parses the wire representation of a message. The payload is not copied.
+func ParseMessage(buffer []byte) (Message, error) {
+	if len(buffer) < MESSAGE_HEADER_SIZE {
+		return Message{}, fmt.Errorf("message too short: %d bytes", len(buffer))
+	}
+	if buffer[0] != MESSAGE_VERSION {
+		return Message{}, fmt.Errorf("unsupported message version %d", buffer[0])
+	}
+	length := int(binary.BigEndian.Uint16(buffer[5:]))
+	if len(buffer) != MESSAGE_HEADER_SIZE+length {
+		return Message{}, fmt.Errorf("message length mismatch: header says %d bytes, got %d", length, len(buffer)-MESSAGE_HEADER_SIZE)
+	}
+	return Message{
+		Type:    MessageType(buffer[1]),
+		Flags:   buffer[2],
+		Stream:  binary.BigEndian.Uint16(buffer[3:]),
+		Payload: buffer[MESSAGE_HEADER_SIZE:],
+	}, nil
+}
+
+// HelloAck is the payload of MessageHelloAck: the address that the server assigned to the network stack of the
+// client, which is invalid if the client did not ask for one or the server has none to give.
+type HelloAck struct {
+	Address netip.Addr
+}
+
+func (a HelloAck) Marshal() []byte {
+	if !a.Address.IsValid() {
 		return nil
 	}
+	return a.Address.AsSlice()
+}
+
+func ParseHelloAck(buffer []byte) (HelloAck, error) {
+	if len(buffer) == 0 {
+		return HelloAck{}, nil
+	}
+	ip, ok := netip.AddrFromSlice(buffer)
+	if !ok {
+		return HelloAck{}, fmt.Errorf("malformed hello-ack address")
+	}
+	return HelloAck{Address: ip}, nil
+}
+
+// WindowSize is the payload of MessageShellResize.
+type WindowSize struct {
+	Rows, Cols uint16
+}
+
+func (w WindowSize) Marshal() []byte {
+	buffer := make([]byte, 4)
+	binary.BigEndian.PutUint16(buffer, w.Rows)
+	binary.BigEndian.PutUint16(buffer[2:], w.Cols)
+	return buffer
+}
+
+func ParseWindowSize(buffer []byte) (WindowSize, error) {
+	if len(buffer) < 4 {
+		return WindowSize{}, fmt.Errorf("window size too short: %d bytes", len(buffer))
+	}
+	return WindowSize{Rows: binary.BigEndian.Uint16(buffer), Cols: binary.BigEndian.Uint16(buffer[2:])}, nil
+}
+
+// ShellOpen is the payload of MessageShellOpen. A zero window size requests a shell without a terminal, in which
+// case stdout and stderr are kept separate.
+type ShellOpen struct {
+	WindowSize
+	Term string // The value of $TERM on the client
+}
+
+func (o ShellOpen) Marshal() []byte {
+	return append(o.WindowSize.Marshal(), o.Term...)
+}
+
+func ParseShellOpen(buffer []byte) (ShellOpen, error) {
+	size, err := ParseWindowSize(buffer)
+	if err != nil {
+		return ShellOpen{}, err
+	}
+	return ShellOpen{WindowSize: size, Term: string(buffer[4:])}, nil
+}
+
+// ExitMessage returns a MessageExit with the given status.
+func ExitMessage(status int) Message {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(int32(status)))
+	return Message{Type: MessageExit, Flags: FlagEnd, Payload: payload}
+}
+
+// ParseExitStatus returns the exit status in a MessageExit.
+func ParseExitStatus(buffer []byte) (int, error) {
+	if len(buffer) != 4 {
+		return 0, fmt.Errorf("malformed exit status")
+	}
+	return int(int32(binary.BigEndian.Uint32(buffer))), nil
+}
+
+// FileRequest is the payload of file transfer requests. Offset is where a download resumes, and is ignored by the
+// other requests.
+type FileRequest struct {
+	Offset uint64
+	Path   string
+}
+
+func (r FileRequest) Marshal() []byte {
+	buffer := make([]byte, 8, 8+len(r.Path))
+	binary.BigEndian.PutUint64(buffer, r.Offset)
+	return append(buffer, r.Path...)
+}
+
+func ParseFileRequest(buffer []byte) (FileRequest, error) {
+	if len(buffer) < 8 {
+		return FileRequest{}, fmt.Errorf("file request too short: %d bytes", len(buffer))
+	}
+	return FileRequest{Offset: binary.BigEndian.Uint64(buffer), Path: string(buffer[8:])}, nil
+}
+
+// FileInfo is the payload of MessageFileInfo. An empty payload (which ends the listing of an empty directory) is
+// parsed as the zero FileInfo.
+type FileInfo struct {
+	Size    uint64
+	Mode    fs.FileMode
+	ModTime time.Time
+	Name    string
+}
+
+func NewFileInfo(info fs.FileInfo) FileInfo {
+	return FileInfo{Size: uint64(info.Size()), Mode: info.Mode(), ModTime: info.ModTime(), Name: info.Name()}
+}
+
+func (i FileInfo) Marshal() []byte {
+	buffer := make([]byte, 20, 20+len(i.Name))
+	binary.BigEndian.PutUint64(buffer, i.Size)
+	binary.BigEndian.PutUint32(buffer[8:], uint32(i.Mode))
+	binary.BigEndian.PutUint64(buffer[12:], uint64(i.ModTime.Unix()))
+	return append(buffer, i.Name...)
+}
+
+func ParseFileInfo(buffer []byte) (FileInfo, error) {
+	if len(buffer) == 0 {
+		return FileInfo{}, nil
+	}
+	if len(buffer) < 20 {
+		return FileInfo{}, fmt.Errorf("file info too short: %d bytes", len(buffer))
+	}
+	return FileInfo{
+		Size:    binary.BigEndian.Uint64(buffer),
+		Mode:    fs.FileMode(binary.BigEndian.Uint32(buffer[8:])),
+		ModTime: time.Unix(int64(binary.BigEndian.Uint64(buffer[12:])), 0),
+		Name:    string(buffer[20:]),
+	}, nil
+}
+
+// FileChunk is the payload of MessageFileData. Chunks carry their offset, so that the receiver can write them in
+// any order and notice the missing ones.
+type FileChunk struct {
+	Offset uint64
+	Data   []byte
+}
+
+func (c FileChunk) Marshal() []byte {
+	buffer := make([]byte, 8, 8+len(c.Data))
+	binary.BigEndian.PutUint64(buffer, c.Offset)
+	return append(buffer, c.Data...)
+}
+
+func ParseFileChunk(buffer []byte) (FileChunk, error) {
+	if len(buffer) < 8 {
+		return FileChunk{}, fmt.Errorf("file chunk too short: %d bytes", len(buffer))
+	}
+	return FileChunk{Offset: binary.BigEndian.Uint64(buffer), Data: buffer[8:]}, nil
+}
+
+// FileDone is the payload of MessageFileDone: the size and SHA-256 of the whole file.
+type FileDone struct {
+	Size uint64
+	Sum  [sha256.Size]byte
+}
+
+func (d FileDone) Marshal() []byte {
+	buffer := make([]byte, 8, 8+sha256.Size)
+	binary.BigEndian.PutUint64(buffer, d.Size)
+	return append(buffer, d.Sum[:]...)
+}
+
+func ParseFileDone(buffer []byte) (FileDone, error) {
+	if len(buffer) != 8+sha256.Size {
+		return FileDone{}, fmt.Errorf("malformed file checksum")
+	}
+	done := FileDone{Size: binary.BigEndian.Uint64(buffer)}
+	copy(done.Sum[:], buffer[8:])
+	return done, nil
+}
+
+// Forward is the payload of MessageForward: the server listens on Bind, and connects what it accepts to Target, an
+// address in the network stack of the client. Clients repeat the request until they get a result, so servers answer
+// a request for a forward that they already run as if it succeeded.
+type Forward struct {
+	UDP    bool
+	Target netip.AddrPort
+	Bind   string
 }
 
-func TryParseHelloAck(buffer []byte) bool {
-	if bytes.Equal(buffer, HELLO_ACK_MESSAGE) {
-		return true
+func (f Forward) Marshal() []byte {
+	ip := f.Target.Addr().AsSlice()
+	buffer := make([]byte, 0, 4+len(ip)+len(f.Bind))
+	if f.UDP {
+		buffer = append(buffer, 1)
 	} else {
-		return false
+		buffer = append(buffer, 0)
 	}
+	buffer = append(buffer, byte(len(ip)))
+	buffer = append(buffer, ip...)
+	buffer = binary.BigEndian.AppendUint16(buffer, f.Target.Port())
+	return append(buffer, f.Bind...)
 }
 
-var HELLO_PREFIX = []byte{0x01, 0x00}
-var HELLO_ACK_MESSAGE = []byte{0x01, 0x01}
+func ParseForward(buffer []byte) (Forward, error) {
+	if len(buffer) < 2 || len(buffer) < 4+int(buffer[1]) {
+		return Forward{}, fmt.Errorf("forward too short: %d bytes", len(buffer))
+	}
+	end := 2 + int(buffer[1])
+	ip, ok := netip.AddrFromSlice(buffer[2:end])
+	if !ok {
+		return Forward{}, fmt.Errorf("malformed forward target")
+	}
+	return Forward{
+		UDP:    buffer[0] == 1,
+		Target: netip.AddrPortFrom(ip, binary.BigEndian.Uint16(buffer[end:])),
+		Bind:   string(buffer[end+2:]),
+	}, nil
+}
+
+// ForwardResult is the payload of MessageForwardResult: the protocol and bind address of the requested forward, and
+// why the server could not listen on it. The error is empty on success.
+type ForwardResult struct {
+	UDP   bool
+	Bind  string
+	Error string
+}
+
+func (r ForwardResult) Marshal() []byte {
+	buffer := []byte{0}
+	if r.UDP {
+		buffer[0] = 1
+	}
+	return append(buffer, r.Bind+"\x00"+r.Error...)
+}
+
+func ParseForwardResult(buffer []byte) (ForwardResult, error) {
+	if len(buffer) < 1 {
+		return ForwardResult{}, fmt.Errorf("forward result too short: %d bytes", len(buffer))
+	}
+	bind, message, ok := strings.Cut(string(buffer[1:]), "\x00")
+	if !ok {
+		return ForwardResult{}, fmt.Errorf("malformed forward result")
+	}
+	return ForwardResult{UDP: buffer[0] == 1, Bind: bind, Error: message}, nil
+}
@@ -0,0 +1,86 @@
+package bizarre_net
+
+import (
+	"bytes"
+	"io/fs"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	msg := Message{Type: MessageIP, Flags: 0x80, Stream: 0x1234, Payload: []byte{0x45, 0x00}}
+	buffer := msg.Marshal()
+	if !bytes.Equal(buffer, []byte{MESSAGE_VERSION, 0x10, 0x80, 0x12, 0x34, 0x00, 0x02, 0x45, 0x00}) {
+		t.Fatalf("unexpected wire format %x", buffer)
+	}
+	parsed, err := ParseMessage(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Type != msg.Type || parsed.Flags != msg.Flags || parsed.Stream != msg.Stream || !bytes.Equal(parsed.Payload, msg.Payload) {
+		t.Fatalf("got %+v, expected %+v", parsed, msg)
+	}
+}
+
+func TestParseMessageErrors(t *testing.T) {
+	valid := Message{Type: MessageHello, Payload: []byte("hi")}.Marshal()
+	tests := map[string][]byte{
+		"short":     valid[:MESSAGE_HEADER_SIZE-1],
+		"truncated": valid[:len(valid)-1],
+		"version":   append([]byte{MESSAGE_VERSION + 1}, valid[1:]...),
+		// A raw IPv4 packet must not be mistaken for a message
+		"ip": {0x45, 0x00, 0x00, 0x14, 0x00, 0x00, 0x40, 0x00},
+	}
+	for name, buffer := range tests {
+		if _, err := ParseMessage(buffer); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestHelloAckRoundTrip(t *testing.T) {
+	for _, ip := range []string{"10.0.0.2", "fd00::2", ""} {
+		var ack HelloAck
+		if ip != "" {
+			ack.Address = netip.MustParseAddr(ip)
+		}
+		parsed, err := ParseHelloAck(ack.Marshal())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed != ack {
+			t.Errorf("got %+v, expected %+v", parsed, ack)
+		}
+	}
+	if _, err := ParseHelloAck([]byte{10, 0, 0}); err == nil {
+		t.Error("expected a truncated address to be refused")
+	}
+}
+
+func TestExitStatusRoundTrip(t *testing.T) {
+	for _, status := range []int{0, 1, 137, -1} {
+		msg := ExitMessage(status)
+		if msg.Flags&FlagEnd == 0 {
+			t.Errorf("exit message for %d does not end the stream", status)
+		}
+		parsed, err := ParseExitStatus(msg.Payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed != status {
+			t.Errorf("got status %d, expected %d", parsed, status)
+		}
+	}
+}
+
+func TestFileInfoRoundTrip(t *testing.T) {
+	info := FileInfo{Size: 1 << 40, Mode: fs.ModeDir | 0755, ModTime: time.Unix(1700000000, 0), Name: "dir"}
+	parsed, err := ParseFileInfo(info.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Size != info.Size || parsed.Mode != info.Mode || !parsed.ModTime.Equal(info.ModTime) || parsed.Name != info.Name {
+		t.Fatalf("got %+v, expected %+v", parsed, info)
+	}
+}
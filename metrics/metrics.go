@@ -0,0 +1,175 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	bizarre "github.com/CapacitorSet/bizarre-net"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Direction is the direction of a message: sent over the transport, or received from it.
+type Direction string
+
+const (
+	Sent     Direction = "sent"
+	Received Direction = "received"
+)
+
+// Metrics holds the Prometheus metrics of a client or server, in a registry of its own so that several of them can
+// run in a program. The methods of a nil Metrics do nothing.
+type Metrics struct {
+	Registry *prometheus.Registry
+
+	messages          *prometheus.CounterVec
+	bytes             *prometheus.CounterVec
+	sizes             *prometheus.HistogramVec
+	drops             *prometheus.CounterVec
+	handshakeFailures prometheus.Counter
+}
+
+// New creates the metrics of a client or server, whose number of active sessions is returned by sessions.
+func New(sessions func() int) *Metrics {
+	M := &Metrics{
+		Registry: prometheus.NewRegistry(),
+		messages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "bizarre_messages_total",
+			Help: "Messages sent over or received from the transports, by direction.",
+		}, []string{"direction"}),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "bizarre_bytes_total",
+			Help: "Bytes of the messages sent over or received from the transports, by direction.",
+		}, []string{"direction"}),
+		sizes: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "bizarre_message_size_bytes",
+			Help:    "Size of the messages sent over or received from the transports, by direction.",
+			Buckets: prometheus.ExponentialBuckets(64, 2, 6), // Up to 2 KiB, above the largest MTU of the TUN
+		}, []string{"direction"}),
+		drops: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "bizarre_dropped_packets_total",
+			Help: "Packets and frames that were dropped, by reason.",
+		}, []string{"reason"}),
+		handshakeFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "bizarre_handshake_failures_total",
+			Help: "Hellos that could not be sent or answered.",
+		}),
+	}
+	M.Registry.MustRegister(M.messages, M.bytes, M.sizes, M.drops, M.handshakeFailures)
+	M.Registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "bizarre_active_sessions",
+		Help: "Sessions that are up: clients of a server, or the session of a client with its server.",
+	}, func() float64 {
+		return float64(sessions())
+	}))
+	// Drops are reported for every reason, even before they happen
+	for _, reason := range []bizarre.DropReason{
+		bizarre.DropChatter, bizarre.DropNotIP, bizarre.DropMalformed, bizarre.DropUnknownStream,
+		bizarre.DropNoClient, bizarre.DropNoNetwork, bizarre.DropTransportError, bizarre.DropNetworkError,
+	} {
+		M.drops.WithLabelValues(string(reason))
+	}
+	return M
+}
+
+// Message records a message that was sent or received, of the given size in bytes.
+func (M *Metrics) Message(direction Direction, size int) {
+	if M == nil {
+		return
+	}
+	M.messages.WithLabelValues(string(direction)).Inc()
+	M.bytes.WithLabelValues(string(direction)).Add(float64(size))
+	M.sizes.WithLabelValues(string(direction)).Observe(float64(size))
+}
+
+// Drop records a dropped packet.
+func (M *Metrics) Drop(reason bizarre.DropReason) {
+	if M == nil {
+		return
+	}
+	M.drops.WithLabelValues(string(reason)).Inc()
+}
+
+// HandshakeFailed records a hello that could not be sent or was not answered.
+func (M *Metrics) HandshakeFailed() {
+	if M == nil {
+		return
+	}
+	M.handshakeFailures.Inc()
+}
+
+// QueueLength reports the number of messages waiting in the queue of a transport, as returned by length.
+func (M *Metrics) QueueLength(transport string, length func() int) {
+	M.registerPerTransport(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "bizarre_send_queue_length",
+		Help:        "Messages waiting to be sent by transports that can only send them at given times, such as DNS servers.",
+		ConstLabels: prometheus.Labels{"transport": transport},
+	}, func() float64 {
+		return float64(length())
+	}))
+}
+
+// RTT reports the round-trip time of a transport, as returned by rtt; 0 means that it is not known yet.
+func (M *Metrics) RTT(transport string, rtt func() time.Duration) {
+	M.registerPerTransport(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "bizarre_rtt_seconds",
+		Help:        "Latest round-trip time of a transport, measured with hellos and probes.",
+		ConstLabels: prometheus.Labels{"transport": transport},
+	}, func() float64 {
+		return rtt().Seconds()
+	}))
+}
+
+// registerPerTransport registers a metric labelled with the name of a transport. A transport can be used more than once
+// (such as twice in a bond), and the metrics of the copies cannot be told apart, so only the first one is reported.
+func (M *Metrics) registerPerTransport(collector prometheus.Collector) {
+	err := M.Registry.Register(collector)
+	var alreadyRegistered prometheus.AlreadyRegisteredError
+	if err != nil && !errors.As(err, &alreadyRegistered) {
+		panic(err)
+	}
+}
+
+// Handler returns an HTTP handler that serves the metrics in the Prometheus format.
+func (M *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(M.Registry, promhttp.HandlerOpts{})
+}
+
+// Server serves the metrics on /metrics.
+type Server struct {
+	listener net.Listener
+	server   *http.Server
+}
+
+// Listen listens on the address (eg. "127.0.0.1:9917") for requests for the metrics, which Serve then answers.
+func (M *Metrics) Listen(address string) (*Server, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", M.Handler())
+	return &Server{listener: listener, server: &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}}, nil
+}
+
+// Serve answers requests until the server is closed, in which case it returns nil.
+func (S *Server) Serve() error {
+	err := S.server.Serve(S.listener)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Close stops the server, waiting briefly for the requests in progress.
+func (S *Server) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := S.server.Shutdown(ctx)
+	// In case Serve was not called
+	S.listener.Close()
+	return err
+}
@@ -0,0 +1,49 @@
+package metrics
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	bizarre "github.com/CapacitorSet/bizarre-net"
+)
+
+func TestMetrics(t *testing.T) {
+	M := New(func() int { return 2 })
+	M.Message(Sent, 100)
+	M.Message(Sent, 1000)
+	M.Message(Received, 50)
+	M.Drop(bizarre.DropNoClient)
+	M.HandshakeFailed()
+	M.QueueLength("dns", func() int { return 3 })
+	M.RTT("udp", func() time.Duration { return 250 * time.Millisecond })
+	// Such as the same transport listed twice in a bond
+	M.RTT("udp", func() time.Duration { return time.Second })
+	M.QueueLength("dns", func() int { return 4 })
+
+	recorder := httptest.NewRecorder()
+	M.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(recorder.Body)
+	for _, expected := range []string{
+		`bizarre_messages_total{direction="sent"} 2`,
+		`bizarre_bytes_total{direction="sent"} 1100`,
+		`bizarre_bytes_total{direction="received"} 50`,
+		`bizarre_message_size_bytes_bucket{direction="sent",le="128"} 1`,
+		`bizarre_dropped_packets_total{reason="no-client"} 1`,
+		`bizarre_dropped_packets_total{reason="chatter"} 0`,
+		`bizarre_handshake_failures_total 1`,
+		`bizarre_active_sessions 2`,
+		`bizarre_send_queue_length{transport="dns"} 3`,
+		`bizarre_rtt_seconds{transport="udp"} 0.25`,
+	} {
+		if !strings.Contains(string(body), expected) {
+			t.Errorf("missing %s in:\n%s", expected, body)
+		}
+	}
+
+	var nilMetrics *Metrics
+	nilMetrics.Message(Sent, 1)
+	nilMetrics.Drop(bizarre.DropChatter)
+}
@@ -1,6 +1,7 @@
 package bizarre_net
 
 import (
+	"encoding/binary"
 	"fmt"
 	"net"
 
@@ -10,20 +11,34 @@ import (
 
 // TryParse returns a parsed IP packet
 func TryParse(packet []byte) gopacket.Packet {
-	// Fast check; it also "fixes" IPv6 detection (Gopacket parses a packet starting with CE 36 2E 30 38 33 3A 39 as IPv6)
-	if (packet[0] & 0xF0) != 0x60 && (packet[0] & 0xF0) != 0x40 {
+	if len(packet) == 0 {
 		return nil
 	}
-	// Try parsing as IPv4, then as IPv6, then skip
-	if pkt := gopacket.NewPacket(packet, layers.LayerTypeIPv4, gopacket.Default); pkt.ErrorLayer() == nil {
-		return pkt
+	var layerType gopacket.LayerType
+	switch packet[0] >> 4 {
+	case 4:
+		layerType = layers.LayerTypeIPv4
+	case 6:
+		layerType = layers.LayerTypeIPv6
+	default:
+		return nil
 	}
-	if pkt := gopacket.NewPacket(packet, layers.LayerTypeIPv6, gopacket.Default); pkt.ErrorLayer() == nil {
+	if pkt := gopacket.NewPacket(packet, layerType, gopacket.Default); pkt.ErrorLayer() == nil {
 		return pkt
 	}
 	return nil
 }
 
+// TryParseFrame returns a parsed Ethernet frame. Frames whose payload cannot be decoded (eg. non-IP protocols) are
+// returned as well, as long as the Ethernet header is valid.
+func TryParseFrame(frame []byte) gopacket.Packet {
+	pkt := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+	if pkt.Layer(layers.LayerTypeEthernet) == nil {
+		return nil
+	}
+	return pkt
+}
+
 // LayerString returns the specific type of packet (eg. "TCP", "ICMPv6RouterSolicitation")
 func LayerString(pkt gopacket.Packet) string {
 	layers := pkt.Layers()
@@ -75,6 +90,34 @@ func FlowString(pkt gopacket.Packet) string {
 	return fmt.Sprintf("%s => %s proto=%s%s", srcStr, dstStr, protoName, flags)
 }
 
+// FrameString describes an Ethernet frame: its addresses, VLAN tags, and the ARP operation or IP flow it carries.
+func FrameString(pkt gopacket.Packet) string {
+	ethernet := pkt.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	description := fmt.Sprintf("%s => %s", ethernet.SrcMAC, ethernet.DstMAC)
+	etherType := ethernet.EthernetType
+	for _, layer := range pkt.Layers() {
+		if tag, ok := layer.(*layers.Dot1Q); ok {
+			description += fmt.Sprintf(" vlan=%d", tag.VLANIdentifier)
+			etherType = tag.Type
+		}
+	}
+	if arpLayer := pkt.Layer(layers.LayerTypeARP); arpLayer != nil {
+		arp := arpLayer.(*layers.ARP)
+		switch arp.Operation {
+		case layers.ARPRequest:
+			return fmt.Sprintf("%s arp who-has %s tell %s", description, net.IP(arp.DstProtAddress), net.IP(arp.SourceProtAddress))
+		case layers.ARPReply:
+			return fmt.Sprintf("%s arp %s is-at %s", description, net.IP(arp.SourceProtAddress), net.HardwareAddr(arp.SourceHwAddress))
+		default:
+			return fmt.Sprintf("%s arp op=%d", description, arp.Operation)
+		}
+	}
+	if pkt.NetworkLayer() != nil {
+		return description + " " + FlowString(pkt)
+	}
+	return fmt.Sprintf("%s ethertype=%#04x", description, uint16(etherType))
+}
+
 func IsChatter(packet gopacket.Packet) bool {
 	switch layer := packet.NetworkLayer().(type) {
 	case *layers.IPv4:
@@ -88,3 +131,78 @@ func IsChatter(packet gopacket.Packet) bool {
 		return false
 	}
 }
+
+// ClampMSS lowers the MSS option of a TCP SYN packet, so that the segments of the connection fit in the MTU. The
+// checksum is updated incrementally; the packet is changed in place, and ClampMSS returns whether it was changed.
+func ClampMSS(packet []byte, mtu int) bool {
+	if len(packet) == 0 {
+		return false
+	}
+	var segment []byte
+	var mss int // The MTU, without the IP header and the TCP header without options
+	switch packet[0] >> 4 {
+	case 4:
+		headerLength := int(packet[0]&0x0f) * 4
+		if len(packet) < 20 || packet[9] != uint8(layers.IPProtocolTCP) || headerLength < 20 || len(packet) < headerLength {
+			return false
+		}
+		if binary.BigEndian.Uint16(packet[6:])&0x1fff != 0 {
+			// Not the first fragment
+			return false
+		}
+		segment = packet[headerLength:]
+		mss = mtu - 20 - 20
+	case 6:
+		// Extension headers are not followed
+		if len(packet) < 40 || packet[6] != uint8(layers.IPProtocolTCP) {
+			return false
+		}
+		segment = packet[40:]
+		mss = mtu - 40 - 20
+	default:
+		return false
+	}
+	if len(segment) < 20 || segment[13]&0x02 == 0 {
+		// Not a SYN
+		return false
+	}
+	dataOffset := int(segment[12]>>4) * 4
+	if dataOffset < 20 || len(segment) < dataOffset {
+		return false
+	}
+	for i := 20; i < dataOffset; {
+		kind := segment[i]
+		if kind == 0 { // End of options
+			return false
+		}
+		if kind == 1 { // No-op
+			i++
+			continue
+		}
+		if i+1 >= dataOffset || segment[i+1] < 2 || i+int(segment[i+1]) > dataOffset {
+			return false
+		}
+		if kind == 2 && segment[i+1] == 4 {
+			old := binary.BigEndian.Uint16(segment[i+2:])
+			if int(old) <= mss {
+				return false
+			}
+			binary.BigEndian.PutUint16(segment[i+2:], uint16(mss))
+			// The checksum sums 16-bit words from the start of the segment: a field at an odd offset contributes
+			// its bytes swapped
+			oldWord, newWord := old, uint16(mss)
+			if i%2 != 0 {
+				oldWord, newWord = oldWord<<8|oldWord>>8, newWord<<8|newWord>>8
+			}
+			// RFC 1624: HC' = ~(~HC + ~m + m')
+			sum := uint32(^binary.BigEndian.Uint16(segment[16:])) + uint32(^oldWord) + uint32(newWord)
+			for sum>>16 != 0 {
+				sum = sum&0xffff + sum>>16
+			}
+			binary.BigEndian.PutUint16(segment[16:], ^uint16(sum))
+			return true
+		}
+		i += int(segment[i+1])
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+package bizarre_net
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func serialize(t *testing.T, layers ...gopacket.SerializableLayer) []byte {
+	buffer := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{FixLengths: true}, layers...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func TestFrameString(t *testing.T) {
+	src := net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	broadcast := net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	arp := serialize(t,
+		&layers.Ethernet{SrcMAC: src, DstMAC: broadcast, EthernetType: layers.EthernetTypeDot1Q},
+		&layers.Dot1Q{VLANIdentifier: 10, Type: layers.EthernetTypeARP},
+		&layers.ARP{
+			AddrType: layers.LinkTypeEthernet, Protocol: layers.EthernetTypeIPv4, HwAddressSize: 6, ProtAddressSize: 4,
+			Operation: layers.ARPRequest, SourceHwAddress: src, SourceProtAddress: []byte{10, 0, 0, 2},
+			DstHwAddress: make([]byte, 6), DstProtAddress: []byte{10, 0, 0, 1},
+		})
+	// A protocol that is not decoded, on the EtherType for local experiments
+	unknown := serialize(t, &layers.Ethernet{SrcMAC: src, DstMAC: broadcast, EthernetType: 0x88b5}, gopacket.Payload("hello"))
+
+	tests := map[string]struct {
+		frame    []byte
+		expected string
+	}{
+		"arp":     {arp, "02:00:00:00:00:01 => ff:ff:ff:ff:ff:ff vlan=10 arp who-has 10.0.0.1 tell 10.0.0.2"},
+		"unknown": {unknown, "02:00:00:00:00:01 => ff:ff:ff:ff:ff:ff ethertype=0x88b5"},
+	}
+	for name, test := range tests {
+		pkt := TryParseFrame(test.frame)
+		if pkt == nil {
+			t.Errorf("%s: not parsed", name)
+			continue
+		}
+		if description := FrameString(pkt); description != test.expected {
+			t.Errorf("%s: got %q, expected %q", name, description, test.expected)
+		}
+		if IsChatter(pkt) {
+			t.Errorf("%s: broadcast frames without IP are not chatter", name)
+		}
+	}
+}
+
+func TestClampMSS(t *testing.T) {
+	for _, options := range [][]layers.TCPOption{
+		{{OptionType: layers.TCPOptionKindMSS, OptionLength: 4, OptionData: []byte{0x05, 0xb4}}},
+		// A no-op first puts the MSS at an odd offset, which the checksum update must account for
+		{{OptionType: layers.TCPOptionKindNop}, {OptionType: layers.TCPOptionKindMSS, OptionLength: 4, OptionData: []byte{0x05, 0xb4}}},
+	} {
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.IP{10, 0, 0, 2}, DstIP: net.IP{10, 0, 0, 1}}
+		tcp := &layers.TCP{SrcPort: 40000, DstPort: 80, SYN: true, Window: 65535, Options: options}
+		tcp.SetNetworkLayerForChecksum(ip)
+		buffer := gopacket.NewSerializeBuffer()
+		err := gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, ip, tcp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packet := buffer.Bytes()
+		if !ClampMSS(packet, 1400) {
+			t.Fatal("MSS not clamped")
+		}
+		if ClampMSS(packet, 1400) {
+			t.Fatal("MSS clamped twice")
+		}
+
+		clamped := gopacket.NewPacket(packet, layers.LayerTypeIPv4, gopacket.Default).Layer(layers.LayerTypeTCP).(*layers.TCP)
+		for _, option := range clamped.Options {
+			if option.OptionType == layers.TCPOptionKindMSS && (option.OptionData[0] != 0x05 || option.OptionData[1] != 0x50) {
+				t.Errorf("got MSS %x, expected 1360", option.OptionData)
+			}
+		}
+		checksum := clamped.Checksum
+		clamped.SetNetworkLayerForChecksum(ip)
+		err = gopacket.SerializeLayers(gopacket.NewSerializeBuffer(), gopacket.SerializeOptions{ComputeChecksums: true}, clamped, gopacket.Payload(clamped.Payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if clamped.Checksum != checksum {
+			t.Errorf("got checksum %#04x, expected %#04x", checksum, clamped.Checksum)
+		}
+	}
+}
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"log/slog"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/CapacitorSet/bizarre-net/lib/server"
 )
@@ -19,12 +23,28 @@ func main() {
 		return
 	}
 
+	err := server.ApplyConfigFile(flagset, serverConf)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	// Transports and sources log to the default logger
+	logger, err := serverConf.LogConfig.NewLogger(os.Stderr)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	slog.SetDefault(logger)
+
 	srv, err := server.NewServer(serverConf)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
-	err = srv.Run()
+	// Run closes the server when it returns, which removes the routes and NAT rules
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	err = srv.Run(ctx)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
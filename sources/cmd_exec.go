@@ -3,56 +3,73 @@ package sources
 import (
 	"fmt"
 	"io"
-	"log"
-)
+	"os"
 
-const (
-	CMD_EXEC_CMD_HEADER = byte(0xcd)
-	CMD_EXEC_STDOUT_HEADER = byte(0xce)
+	bizarre "github.com/CapacitorSet/bizarre-net"
 )
 
 type CmdExecConfig struct {
 	Command string
 }
 
+// CmdExecSource runs a command on the server, printing its stdout and stderr locally.
 type CmdExecSource struct {
 	CmdExecConfig
+	Stdout, Stderr io.Writer // Where the output of the command goes, by default the standard streams
+
+	done chan int
 }
 
-func (S *CmdExecSource) Start(ch chan []byte) {
-	log.Printf("Sending command %s", S.Command)
-	msg := append([]byte{CMD_EXEC_CMD_HEADER}, []byte(S.Command)...)
-	ch <- msg
+func (S *CmdExecSource) Start(ch chan bizarre.Message) error {
+	logger().Debug("Sending command", "command", S.Command)
+	ch <- bizarre.Message{Type: bizarre.MessageCmdExec, Payload: []byte(S.Command)}
+	return nil
 }
 
-func (S *CmdExecSource) Write(buf []byte) error {
-	panic("CmdExecSource.Write is not implemented")
+// Close does nothing, as the command runs on the server.
+func (S *CmdExecSource) Close() error {
 	return nil
 }
 
+// Write handles the output and the exit status of the command.
+func (S *CmdExecSource) Write(msg bizarre.Message) error {
+	switch msg.Type {
+	case bizarre.MessageStdout:
+		_, err := S.Stdout.Write(msg.Payload)
+		return err
+	case bizarre.MessageStderr:
+		_, err := S.Stderr.Write(msg.Payload)
+		return err
+	case bizarre.MessageExit:
+		status, err := bizarre.ParseExitStatus(msg.Payload)
+		if err != nil {
+			return err
+		}
+		select {
+		case S.done <- status:
+		default:
+			// Only the first exit status counts, and Run may have returned without reading it
+		}
+		return nil
+	default:
+		return fmt.Errorf("unexpected %s message", msg.Type)
+	}
+}
+
+func (S *CmdExecSource) Done() <-chan int {
+	return S.done
+}
+
 var (
-	_ Source = (*CmdExecSource)(nil) // Ensure that interface fields are implemented
+	_ Source   = (*CmdExecSource)(nil) // Ensure that interface fields are implemented
+	_ Finisher = (*CmdExecSource)(nil)
 )
 
-
 // CreateCmdExec creates a CmdExec with the given config, if Name != "".
 func CreateCmdExec(config CmdExecConfig) (CmdExecSource, error) {
 	if config.Command == "" {
 		return CmdExecSource{}, fmt.Errorf("empty command")
 	}
 
-	return CmdExecSource{config}, nil
-}
-
-type StdoutAdder struct {
-	writer io.Writer
+	return CmdExecSource{CmdExecConfig: config, Stdout: os.Stdout, Stderr: os.Stderr, done: make(chan int, 1)}, nil
 }
-
-func (a StdoutAdder) Write(p []byte) (int, error) {
-	n, err := a.writer.Write(append([]byte{CMD_EXEC_STDOUT_HEADER}, p...))
-	return n-1, err
-}
-
-func WithStdoutHeader(w io.Writer) io.Writer {
-	return StdoutAdder{w}
-}
\ No newline at end of file
@@ -0,0 +1,32 @@
+package sources
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	bizarre "github.com/CapacitorSet/bizarre-net"
+)
+
+// TestCmdExecExitOnce checks that repeated exit statuses, which nothing reads once the client stopped, do not block.
+func TestCmdExecExitOnce(t *testing.T) {
+	S, err := CreateCmdExec(CmdExecConfig{Command: "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	S.Stdout, S.Stderr = io.Discard, io.Discard
+	written := make(chan struct{})
+	go func() {
+		S.Write(bizarre.ExitMessage(3))
+		S.Write(bizarre.ExitMessage(4))
+		close(written)
+	}()
+	select {
+	case <-written:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writing the exit status blocked")
+	}
+	if status := <-S.Done(); status != 3 {
+		t.Errorf("got exit status %d, expected 3", status)
+	}
+}
@@ -0,0 +1,414 @@
+package sources
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+
+	bizarre "github.com/CapacitorSet/bizarre-net"
+)
+
+const (
+	// FileChunkSize is the largest amount of file data in a MessageFileData, which transports with smaller messages
+	// lower (see FileConfig.ChunkSize).
+	FileChunkSize = maxChunk - fileChunkHeader
+	// fileChunkHeader is the size of the offset that precedes the data of a MessageFileData.
+	fileChunkHeader = 8
+	// Incomplete transfers are resumed automatically, unless they stop making progress
+	maxStalledAttempts = 3
+)
+
+// ChunkTracker keeps track of which part of a file was received, given chunks that may arrive out of order or not
+// at all.
+type ChunkTracker struct {
+	next  uint64            // Everything before this offset was received
+	ahead map[uint64]uint64 // The chunks received after a missing one, as offset => end
+}
+
+func NewChunkTracker(start uint64) *ChunkTracker {
+	return &ChunkTracker{next: start, ahead: make(map[uint64]uint64)}
+}
+
+func (T *ChunkTracker) Add(offset uint64, length int) {
+	end := offset + uint64(length)
+	if offset > T.next {
+		if end > T.ahead[offset] {
+			T.ahead[offset] = end
+		}
+		return
+	}
+	if end > T.next {
+		T.next = end
+	}
+	// Merge the chunks that are now contiguous
+	for merged := true; merged; {
+		merged = false
+		for offset, end := range T.ahead {
+			if offset <= T.next {
+				if end > T.next {
+					T.next = end
+				}
+				delete(T.ahead, offset)
+				merged = true
+			}
+		}
+	}
+}
+
+// Contiguous returns the size of the part of the file that was received without gaps.
+func (T *ChunkTracker) Contiguous() uint64 {
+	return T.next
+}
+
+// FileSum returns the size and SHA-256 of a file.
+func FileSum(file io.ReaderAt) (bizarre.FileDone, error) {
+	hash := sha256.New()
+	size, err := io.Copy(hash, io.NewSectionReader(file, 0, 1<<62))
+	if err != nil {
+		return bizarre.FileDone{}, err
+	}
+	done := bizarre.FileDone{Size: uint64(size)}
+	copy(done.Sum[:], hash.Sum(nil))
+	return done, nil
+}
+
+// FinishReceiving checks a received file against the size and checksum computed by the sender, truncating it to
+// the part that can be resumed if it is incomplete.
+func FinishReceiving(file *os.File, tracker *ChunkTracker, expected bizarre.FileDone) error {
+	if received := tracker.Contiguous(); received < expected.Size {
+		file.Truncate(int64(received))
+		return fmt.Errorf("transfer incomplete: received %d of %d bytes, retry to resume", received, expected.Size)
+	}
+	err := file.Truncate(int64(expected.Size))
+	if err != nil {
+		return err
+	}
+	actual, err := FileSum(file)
+	if err != nil {
+		return err
+	}
+	if actual.Sum != expected.Sum {
+		return errors.New("checksum mismatch")
+	}
+	return nil
+}
+
+// SendFile sends a file from an offset as MessageFileData chunks of up to chunkSize bytes (0 for FileChunkSize),
+// followed by a MessageFileDone.
+func SendFile(sender MessageSender, file *os.File, offset uint64, chunkSize int) error {
+	if chunkSize == 0 {
+		chunkSize = FileChunkSize
+	}
+	buffer := make([]byte, chunkSize)
+	for {
+		n, err := file.ReadAt(buffer, int64(offset))
+		if n > 0 {
+			chunk := bizarre.FileChunk{Offset: offset, Data: buffer[:n]}
+			sendErr := sender.Send(bizarre.Message{Type: bizarre.MessageFileData, Payload: chunk.Marshal()})
+			if sendErr != nil {
+				return sendErr
+			}
+			offset += uint64(n)
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	done, err := FileSum(file)
+	if err != nil {
+		return err
+	}
+	return sender.Send(bizarre.Message{Type: bizarre.MessageFileDone, Flags: bizarre.FlagEnd, Payload: done.Marshal()})
+}
+
+type FileConfig struct {
+	List   string // Remote path to list
+	Stat   string // Remote path to show information about
+	Get    string // Remote file to download
+	Put    string // Local file to upload
+	To     string // Destination of Get or Put; defaults to the base name of the file
+	Resume bool   // Resume a previous transfer of the same file
+
+	ChunkSize int // Amount of file data in each message; 0 for FileChunkSize
+}
+
+// enabled returns whether an operation is configured.
+func (config FileConfig) enabled() bool {
+	return config.List != "" || config.Stat != "" || config.Get != "" || config.Put != ""
+}
+
+// FileSource lists, downloads and uploads files on the server, within the directory that the server allows.
+type FileSource struct {
+	FileConfig
+
+	ch      chan bizarre.Message
+	file    *os.File // The local file, for transfers
+	tracker *ChunkTracker
+	statted bool // For resumed uploads, whether the remote file was already statted
+
+	attempts    int
+	resumedFrom uint64
+	stalled     int // Number of consecutive attempts without progress
+
+	sending sync.WaitGroup // Goroutines reading from the file to upload it
+	stop    chan struct{}  // Closed when the transfer ends, to stop the goroutines
+	finish  sync.Once
+	done    chan int
+}
+
+var (
+	_ Source   = (*FileSource)(nil) // Ensure that interface fields are implemented
+	_ Finisher = (*FileSource)(nil)
+)
+
+// Send implements MessageSender.
+func (S *FileSource) Send(msg bizarre.Message) error {
+	select {
+	case S.ch <- msg:
+		return nil
+	case <-S.stop:
+		return errors.New("the transfer has ended")
+	}
+}
+
+func (S *FileSource) Start(ch chan bizarre.Message) error {
+	S.ch = ch
+	var err error
+	switch {
+	case S.List != "":
+		S.Send(bizarre.Message{Type: bizarre.MessageFileList, Payload: bizarre.FileRequest{Path: S.List}.Marshal()})
+	case S.Stat != "":
+		S.Send(bizarre.Message{Type: bizarre.MessageFileStat, Payload: bizarre.FileRequest{Path: S.Stat}.Marshal()})
+	case S.Get != "":
+		err = S.startGet()
+	case S.Put != "":
+		err = S.startPut()
+	}
+	if err != nil {
+		S.fail(err)
+	}
+	return nil
+}
+
+func (S *FileSource) startGet() error {
+	flags := os.O_RDWR | os.O_CREATE
+	if !S.Resume {
+		flags |= os.O_TRUNC
+	}
+	var err error
+	S.file, err = os.OpenFile(S.destination(S.Get), flags, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := S.file.Stat()
+	if err != nil {
+		return err
+	}
+	offset := uint64(info.Size())
+	if offset != 0 {
+		logger().Info("Resuming download", "path", S.Get, "offset", offset)
+	}
+	S.resumeFrom(offset)
+	return S.sendGet(offset)
+}
+
+func (S *FileSource) sendGet(offset uint64) error {
+	S.tracker = NewChunkTracker(offset)
+	return S.Send(bizarre.Message{Type: bizarre.MessageFileGet, Payload: bizarre.FileRequest{Offset: offset, Path: S.Get}.Marshal()})
+}
+
+// resumeFrom records that a transfer (re)starts from an offset, returning false if it stopped making progress.
+func (S *FileSource) resumeFrom(offset uint64) bool {
+	if S.attempts > 0 && offset <= S.resumedFrom {
+		S.stalled++
+	} else {
+		S.stalled = 0
+	}
+	S.attempts++
+	S.resumedFrom = offset
+	return S.stalled < maxStalledAttempts
+}
+
+func (S *FileSource) startPut() error {
+	var err error
+	S.file, err = os.Open(S.Put)
+	if err != nil {
+		return err
+	}
+	if S.Resume {
+		// Ask for the size of the remote file first
+		return S.Send(bizarre.Message{Type: bizarre.MessageFileStat, Payload: bizarre.FileRequest{Path: S.destination(S.Put)}.Marshal()})
+	}
+	return S.sendPut(0)
+}
+
+func (S *FileSource) sendPut(offset uint64) error {
+	S.statted = true
+	if offset != 0 {
+		logger().Info("Resuming upload", "path", S.Put, "offset", offset)
+	}
+	return S.Send(bizarre.Message{Type: bizarre.MessageFilePut, Payload: bizarre.FileRequest{Offset: offset, Path: S.destination(S.Put)}.Marshal()})
+}
+
+func (S *FileSource) destination(source string) string {
+	if S.To != "" {
+		return S.To
+	}
+	return path.Base(source)
+}
+
+// Write handles the responses of the server.
+func (S *FileSource) Write(msg bizarre.Message) error {
+	switch msg.Type {
+	case bizarre.MessageFileInfo:
+		info, err := bizarre.ParseFileInfo(msg.Payload)
+		if err != nil {
+			return err
+		}
+		return S.handleInfo(info, msg.Flags&bizarre.FlagEnd != 0)
+	case bizarre.MessageFileData:
+		if S.Get == "" {
+			return fmt.Errorf("unexpected %s message", msg.Type)
+		}
+		chunk, err := bizarre.ParseFileChunk(msg.Payload)
+		if err != nil {
+			return err
+		}
+		_, err = S.file.WriteAt(chunk.Data, int64(chunk.Offset))
+		if err != nil {
+			S.fail(err)
+			return err
+		}
+		S.tracker.Add(chunk.Offset, len(chunk.Data))
+		return nil
+	case bizarre.MessageFileDone:
+		done, err := bizarre.ParseFileDone(msg.Payload)
+		if err != nil {
+			return err
+		}
+		if S.Get != "" {
+			received := S.tracker.Contiguous()
+			if received < done.Size && S.resumeFrom(received) {
+				logger().Info("Download incomplete, resuming", "received", received, "size", done.Size)
+				return S.sendGet(received)
+			}
+			err = FinishReceiving(S.file, S.tracker, done)
+		} else {
+			// The server computed the checksum of what it received
+			var local bizarre.FileDone
+			local, err = FileSum(S.file)
+			if err == nil && local != done {
+				err = errors.New("checksum mismatch")
+			}
+		}
+		if err != nil {
+			S.fail(err)
+			return nil
+		}
+		S.succeed()
+		return nil
+	case bizarre.MessageFileError:
+		if S.Put != "" && S.Resume && !S.statted {
+			// The remote file does not exist (or cannot be statted, in which case the upload reports the error)
+			return S.sendPut(0)
+		}
+		S.fail(fmt.Errorf("remote: %s", msg.Payload))
+		return nil
+	default:
+		return fmt.Errorf("unexpected %s message", msg.Type)
+	}
+}
+
+func (S *FileSource) handleInfo(info bizarre.FileInfo, last bool) error {
+	switch {
+	case S.List != "" || S.Stat != "":
+		if info.Name != "" {
+			fmt.Printf("%s %12d %s %s\n", info.Mode, info.Size, info.ModTime.Format("2006-01-02 15:04"), info.Name)
+		}
+		if last {
+			S.succeed()
+		}
+		return nil
+	case S.Put != "" && !S.statted:
+		local, err := S.file.Stat()
+		if err != nil {
+			return err
+		}
+		offset := info.Size
+		if offset > uint64(local.Size()) {
+			offset = 0
+		}
+		return S.sendPut(offset)
+	case S.Put != "":
+		// The server is ready for the data, starting from the part that it already has
+		if !S.resumeFrom(info.Size) {
+			S.fail(fmt.Errorf("transfer stalled at byte %d", info.Size))
+			return nil
+		}
+		S.sending.Add(1)
+		go func() {
+			err := SendFile(S, S.file, info.Size, S.ChunkSize)
+			S.sending.Done()
+			if err != nil {
+				S.fail(err)
+			}
+		}()
+		return nil
+	default:
+		return fmt.Errorf("unexpected file information")
+	}
+}
+
+// closeFile stops the upload goroutines and closes the local file once they have returned.
+func (S *FileSource) closeFile() {
+	close(S.stop)
+	S.sending.Wait()
+	if S.file != nil {
+		S.file.Close()
+	}
+}
+
+func (S *FileSource) succeed() {
+	S.finish.Do(func() {
+		S.closeFile()
+		S.done <- 0
+	})
+}
+
+func (S *FileSource) fail(err error) {
+	S.finish.Do(func() {
+		S.closeFile()
+		fmt.Fprintln(os.Stderr, err)
+		S.done <- 1
+	})
+}
+
+// Close closes the local file of a transfer that did not finish, which -resume can carry on.
+func (S *FileSource) Close() error {
+	S.finish.Do(S.closeFile)
+	return nil
+}
+
+func (S *FileSource) Done() <-chan int {
+	return S.done
+}
+
+// CreateFileTransfer creates a FileSource with the given config.
+func CreateFileTransfer(config FileConfig) (*FileSource, error) {
+	operations := 0
+	for _, operation := range []string{config.List, config.Stat, config.Get, config.Put} {
+		if operation != "" {
+			operations++
+		}
+	}
+	if operations != 1 {
+		return nil, fmt.Errorf("exactly one of list, stat, get and put must be given")
+	}
+	return &FileSource{FileConfig: config, stop: make(chan struct{}), done: make(chan int, 1)}, nil
+}
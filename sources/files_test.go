@@ -0,0 +1,117 @@
+package sources
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bizarre "github.com/CapacitorSet/bizarre-net"
+)
+
+func TestChunkTracker(t *testing.T) {
+	tracker := NewChunkTracker(100)
+	tracker.Add(100, 10)
+	if tracker.Contiguous() != 110 {
+		t.Fatalf("got %d contiguous bytes, expected 110", tracker.Contiguous())
+	}
+	// Chunks after a missing one do not count until it arrives
+	tracker.Add(130, 10)
+	tracker.Add(120, 10)
+	if tracker.Contiguous() != 110 {
+		t.Fatalf("got %d contiguous bytes, expected 110", tracker.Contiguous())
+	}
+	tracker.Add(110, 10)
+	if tracker.Contiguous() != 140 {
+		t.Fatalf("got %d contiguous bytes, expected 140", tracker.Contiguous())
+	}
+	// Duplicates and chunks before the start are harmless
+	tracker.Add(0, 10)
+	tracker.Add(120, 10)
+	if tracker.Contiguous() != 140 {
+		t.Fatalf("got %d contiguous bytes, expected 140", tracker.Contiguous())
+	}
+}
+
+// TestUploadClose checks that closing an upload stops sending the file before it is closed.
+func TestUploadClose(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "upload")
+	err := os.WriteFile(name, make([]byte, 10*FileChunkSize), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	S, err := CreateFileTransfer(FileConfig{Put: name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := make(chan bizarre.Message)
+	go S.Start(ch)
+	if msg := <-ch; msg.Type != bizarre.MessageFilePut {
+		t.Fatalf("got %s, expected a put request", msg.Type)
+	}
+	// The server is ready for the data
+	err = S.Write(bizarre.Message{Type: bizarre.MessageFileInfo, Payload: bizarre.FileInfo{Name: "upload"}.Marshal()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg := <-ch; msg.Type != bizarre.MessageFileData {
+		t.Fatalf("got %s, expected data", msg.Type)
+	}
+
+	S.Close()
+	select {
+	case msg := <-ch:
+		t.Fatalf("got a %s message after closing", msg.Type)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// messageRecorder is a MessageSender that keeps the messages it is given.
+type messageRecorder []bizarre.Message
+
+func (R *messageRecorder) Send(msg bizarre.Message) error {
+	*R = append(*R, msg)
+	return nil
+}
+
+// TestFileChunksFitTransport checks that the chunks of a file fit in the messages of a transport with a small limit.
+func TestFileChunksFitTransport(t *testing.T) {
+	const maxPayload = 200
+	var config SourceConfig
+	err := config.LimitMTU(maxPayload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(t.TempDir(), "file")
+	err = os.WriteFile(name, make([]byte, 2*FileChunkSize), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var sent messageRecorder
+	err = SendFile(&sent, file, 0, config.FileConfig.ChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := 0
+	for _, msg := range sent {
+		if length := len(msg.Marshal()); length > maxPayload {
+			t.Fatalf("got a %s message of %d bytes, over the limit of %d", msg.Type, length, maxPayload)
+		}
+		if msg.Type == bizarre.MessageFileData {
+			chunk, err := bizarre.ParseFileChunk(msg.Payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			size += len(chunk.Data)
+		}
+	}
+	if size != 2*FileChunkSize {
+		t.Errorf("sent %d bytes, expected %d", size, 2*FileChunkSize)
+	}
+}
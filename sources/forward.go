@@ -0,0 +1,271 @@
+package sources
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	bizarre "github.com/CapacitorSet/bizarre-net"
+)
+
+// Clients repeat the requests for remote forwards until the server answers, as they may be lost
+const forwardRetryInterval = 5 * time.Second
+
+// ForwardList is a list of forwards given with a repeatable flag.
+type ForwardList []string
+
+func (l *ForwardList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *ForwardList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+type ForwardConfig struct {
+	Local  ForwardList // Local ports forwarded to hosts reachable from the server, like ssh -L
+	Remote ForwardList // Server ports forwarded to hosts reachable from the client, like ssh -R
+}
+
+// Forward is a port forward: connections to Listen are forwarded to Target.
+type Forward struct {
+	Network string // tcp or udp
+	Listen  string
+	Target  string
+}
+
+// ParseForward parses a forward in the format of ssh, [bind_address:]port:host:hostport, optionally followed by /tcp
+// or /udp. The bind address defaults to localhost, and IPv6 addresses are written in brackets.
+func ParseForward(spec string) (Forward, error) {
+	forward := Forward{Network: "tcp"}
+	if trimmed, ok := strings.CutSuffix(spec, "/udp"); ok {
+		forward.Network = "udp"
+		spec = trimmed
+	} else {
+		spec = strings.TrimSuffix(spec, "/tcp")
+	}
+	var fields []string
+	start, brackets := 0, 0
+	for i, c := range spec {
+		switch c {
+		case '[':
+			brackets++
+		case ']':
+			brackets--
+		case ':':
+			if brackets == 0 {
+				fields = append(fields, spec[start:i])
+				start = i + 1
+			}
+		}
+	}
+	fields = append(fields, spec[start:])
+	for i, field := range fields {
+		fields[i] = strings.TrimSuffix(strings.TrimPrefix(field, "["), "]")
+	}
+	switch len(fields) {
+	case 3:
+		fields = append([]string{"localhost"}, fields...)
+	case 4:
+	default:
+		return Forward{}, fmt.Errorf("invalid forward %q: expected [bind_address:]port:host:hostport", spec)
+	}
+	if fields[0] == "" || fields[0] == "*" {
+		// As in ssh, an empty bind address listens on every interface
+		fields[0] = ""
+	}
+	forward.Listen = net.JoinHostPort(fields[0], fields[1])
+	forward.Target = net.JoinHostPort(fields[2], fields[3])
+	return forward, nil
+}
+
+// ServeStreams accepts connections until the listener is closed, and proxies each of them to a connection opened
+// with dial.
+func ServeStreams(listener net.Listener, dial func(ctx context.Context) (net.Conn, error)) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+			defer cancel()
+			remote, err := dial(ctx)
+			if err != nil {
+				logger().Warn("Could not forward connection", "peer", conn.RemoteAddr().String(), "error", err)
+				conn.Close()
+				return
+			}
+			Proxy(conn, remote)
+		}()
+	}
+}
+
+// ServeDatagrams relays the datagrams received on a socket until it is closed. Each peer gets its own socket,
+// opened with dial, which is closed after the idle timeout.
+func ServeDatagrams(conn net.PacketConn, dial func(ctx context.Context) (net.Conn, error), idleTimeout time.Duration) error {
+	var lock sync.Mutex
+	flows := make(map[string]net.Conn) // Indexed by peer address
+	buffer := make([]byte, 65535)
+	for {
+		n, peer, err := conn.ReadFrom(buffer)
+		if err != nil {
+			return err
+		}
+		key := peer.String()
+		lock.Lock()
+		flow, ok := flows[key]
+		lock.Unlock()
+		if !ok {
+			ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+			flow, err = dial(ctx)
+			cancel()
+			if err != nil {
+				logger().Warn("Could not forward datagrams", "peer", key, "error", err)
+				continue
+			}
+			lock.Lock()
+			flows[key] = flow
+			lock.Unlock()
+			go func() {
+				replies := make([]byte, 65535)
+				for {
+					flow.SetReadDeadline(time.Now().Add(idleTimeout))
+					n, err := flow.Read(replies)
+					if err != nil {
+						break
+					}
+					conn.WriteTo(replies[:n], peer)
+				}
+				lock.Lock()
+				delete(flows, key)
+				lock.Unlock()
+				flow.Close()
+			}()
+		}
+		// Traffic in either direction keeps the flow alive
+		flow.SetReadDeadline(time.Now().Add(idleTimeout))
+		flow.Write(buffer[:n])
+	}
+}
+
+// LocalForward listens on a local address, and forwards what it accepts to the target through the tunnel.
+type LocalForward struct {
+	Forward
+}
+
+// RemoteForward has the server listen on an address, and forwards what it accepts to the target. The server connects
+// to a port in the network stack of the client, which in turn connects to the target.
+type RemoteForward struct {
+	Forward
+	results chan bizarre.ForwardResult
+}
+
+var (
+	_ Service        = (*LocalForward)(nil) // Ensure that interface fields are implemented
+	_ Service        = (*RemoteForward)(nil)
+	_ messageHandler = (*RemoteForward)(nil)
+)
+
+func (F *LocalForward) Serve(network *NetstackSource) error {
+	dial := func(ctx context.Context) (net.Conn, error) {
+		return network.DialContext(ctx, F.Network, F.Target)
+	}
+	if F.Network == "udp" {
+		conn, err := net.ListenPacket("udp", F.Listen)
+		if err != nil {
+			return err
+		}
+		if err := network.track(conn); err != nil {
+			return err
+		}
+		logger().Info("Forwarding through the tunnel", "network", "udp", "listen", conn.LocalAddr().String(), "target", F.Target)
+		return ServeDatagrams(conn, dial, udpIdleTimeout)
+	}
+	listener, err := net.Listen("tcp", F.Listen)
+	if err != nil {
+		return err
+	}
+	if err := network.track(listener); err != nil {
+		return err
+	}
+	logger().Info("Forwarding through the tunnel", "network", "tcp", "listen", listener.Addr().String(), "target", F.Target)
+	return ServeStreams(listener, dial)
+}
+
+func NewRemoteForward(forward Forward) *RemoteForward {
+	return &RemoteForward{Forward: forward, results: make(chan bizarre.ForwardResult, 1)}
+}
+
+func (F *RemoteForward) Serve(network *NetstackSource) error {
+	dial := func(ctx context.Context) (net.Conn, error) {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, F.Network, F.Target)
+	}
+	request := bizarre.Forward{UDP: F.Network == "udp", Bind: F.Listen}
+	var listener interface{ Close() error }
+	served := make(chan error, 1)
+	if request.UDP {
+		conn, err := network.ListenUDP()
+		if err != nil {
+			return err
+		}
+		if err := network.track(conn); err != nil {
+			return err
+		}
+		listener = conn
+		request.Target = conn.LocalAddr().(*net.UDPAddr).AddrPort()
+		go func() { served <- ServeDatagrams(conn, dial, udpIdleTimeout) }()
+	} else {
+		tcpListener, err := network.ListenTCP()
+		if err != nil {
+			return err
+		}
+		if err := network.track(tcpListener); err != nil {
+			return err
+		}
+		listener = tcpListener
+		request.Target = tcpListener.Addr().(*net.TCPAddr).AddrPort()
+		go func() { served <- ServeStreams(tcpListener, dial) }()
+	}
+
+	msg := bizarre.Message{Type: bizarre.MessageForward, Payload: request.Marshal()}
+	for {
+		err := network.Send(msg)
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		select {
+		case result := <-F.results:
+			if result.Error != "" {
+				listener.Close()
+				return fmt.Errorf("the server cannot listen on %s: %s", F.Listen, result.Error)
+			}
+			logger().Info("Forwarding from the server", "network", F.Network, "listen", F.Listen, "target", F.Target)
+			return <-served
+		case <-time.After(forwardRetryInterval):
+			// The request or its result was lost
+		}
+	}
+}
+
+func (F *RemoteForward) handle(msg bizarre.Message) bool {
+	if msg.Type != bizarre.MessageForwardResult {
+		return false
+	}
+	result, err := bizarre.ParseForwardResult(msg.Payload)
+	if err != nil || result.UDP != (F.Network == "udp") || result.Bind != F.Listen {
+		return false
+	}
+	select {
+	case F.results <- result:
+	default:
+		// A result for a repeated request
+	}
+	return true
+}
@@ -0,0 +1,92 @@
+package sources
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseForward(t *testing.T) {
+	tests := map[string]Forward{
+		"8080:example.com:80":          {Network: "tcp", Listen: "localhost:8080", Target: "example.com:80"},
+		"0.0.0.0:5353:10.0.0.1:53/udp": {Network: "udp", Listen: "0.0.0.0:5353", Target: "10.0.0.1:53"},
+		"*:22:localhost:22/tcp":        {Network: "tcp", Listen: ":22", Target: "localhost:22"},
+		"[::1]:8080:[fd00::1]:80":      {Network: "tcp", Listen: "[::1]:8080", Target: "[fd00::1]:80"},
+	}
+	for spec, expected := range tests {
+		forward, err := ParseForward(spec)
+		if err != nil {
+			t.Errorf("%s: %s", spec, err)
+			continue
+		}
+		if forward != expected {
+			t.Errorf("%s: got %+v, expected %+v", spec, forward, expected)
+		}
+	}
+	for _, spec := range []string{"8080", "80:example.com", "a:b:c:d:e"} {
+		if _, err := ParseForward(spec); err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+}
+
+func TestForwardDatagrams(t *testing.T) {
+	target, err := net.ListenPacket("udp", localAddress(t)+":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		buffer := make([]byte, 1500)
+		for {
+			n, peer, err := target.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			target.WriteTo(buffer[:n], peer)
+		}
+	}()
+
+	server, err := CreateNetstack(NetstackConfig{Enabled: true, Forward: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := CreateNetstack(NetstackConfig{Enabled: true, IP: "10.0.0.2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wire(client, server)
+
+	local, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	go ServeDatagrams(local, func(ctx context.Context) (net.Conn, error) {
+		return client.DialContext(ctx, "udp", target.LocalAddr().String())
+	}, time.Minute)
+
+	conn, err := net.Dial("udp", local.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reply := make([]byte, 1500)
+	// The first datagram may be lost while the stacks resolve each other, so retry
+	for attempt := 0; attempt < 5; attempt++ {
+		_, err = conn.Write([]byte("ping"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, err := conn.Read(reply)
+		if err == nil {
+			if string(reply[:n]) != "ping" {
+				t.Fatalf("got %q, expected the echo", reply[:n])
+			}
+			return
+		}
+	}
+	t.Fatal("no reply through the forward")
+}
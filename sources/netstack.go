@@ -0,0 +1,536 @@
+package sources
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	bizarre "github.com/CapacitorSet/bizarre-net"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+const (
+	netstackNIC       = 1
+	netstackQueueSize = 512
+	dialTimeout       = 10 * time.Second
+	udpIdleTimeout    = time.Minute // UDP flows are closed after this long without traffic
+)
+
+// The default addresses of the stack in the tunnel
+const (
+	ClientNetstackIP = "10.0.0.2" // Used by clients whose server does not assign them an address
+	ServerNetstackIP = "10.0.0.1" // Servers open the connections of remote forwards from this address
+)
+
+type NetstackConfig struct {
+	Enabled bool
+	Forward bool   // Proxy the flows for every address to their destination, as servers do
+	IP      string // The address of the stack in the tunnel; on clients, empty to wait for one from the server
+	DNS     string // The DNS server that clients resolve names with, through the tunnel
+	MTU     int
+
+	// AllowLocal lets forwarded flows reach loopback, link-local and unspecified addresses, which are those of the
+	// host itself (or of its link) rather than of the network beyond it
+	AllowLocal bool
+}
+
+// NetstackSource is a userspace TCP/IP stack, which can stand in for a TUN without requiring root.
+//
+// On servers, it terminates the TCP and UDP flows in the IP packets it receives, and proxies them to their
+// destination with ordinary sockets. On clients, Services (such as a SOCKS proxy) open connections through it from
+// its address.
+type NetstackSource struct {
+	NetstackConfig
+	Services []Service
+
+	ch       chan bizarre.Message
+	stack    *stack.Stack
+	endpoint *channel.Endpoint
+	resolver *net.Resolver
+
+	lock      sync.Mutex
+	listeners []io.Closer   // The listeners of the services, which are closed along with the stack
+	addressed chan struct{} // Closed once the stack has an address, which the services wait for
+	closed    chan struct{}
+}
+
+// Service runs on top of a client NetstackSource.
+type Service interface {
+	Serve(network *NetstackSource) error
+}
+
+// messageHandler is implemented by services that handle messages from the server other than IP packets. handle
+// returns whether the message was meant for the service.
+type messageHandler interface {
+	handle(bizarre.Message) bool
+}
+
+var (
+	_ Source        = (*NetstackSource)(nil) // Ensure that interface fields are implemented
+	_ MessageSender = (*NetstackSource)(nil)
+)
+
+// Send implements MessageSender, for the services.
+func (S *NetstackSource) Send(msg bizarre.Message) error {
+	select {
+	case S.ch <- msg:
+		return nil
+	case <-S.closed:
+		return net.ErrClosed
+	}
+}
+
+// Start runs the services and sends the packets that the stack emits.
+func (S *NetstackSource) Start(ch chan bizarre.Message) error {
+	S.ch = ch
+	for _, service := range S.Services {
+		go func(service Service) {
+			select {
+			case <-S.addressed:
+			case <-S.closed:
+				return
+			}
+			err := service.Serve(S)
+			if err != nil && !S.isClosed() {
+				logger().Warn("Service failed", "service", fmt.Sprintf("%T", service), "error", err)
+			}
+		}(service)
+	}
+	for {
+		pkt := S.endpoint.ReadContext(context.Background())
+		if pkt == nil {
+			// The endpoint was closed
+			return nil
+		}
+		view := pkt.ToView()
+		pkt.DecRef()
+		ch <- bizarre.Message{Type: bizarre.MessageIP, Payload: append([]byte(nil), view.AsSlice()...)}
+		view.Release()
+	}
+}
+
+// Close stops the services and the stack.
+func (S *NetstackSource) Close() error {
+	S.lock.Lock()
+	if S.isClosed() {
+		S.lock.Unlock()
+		return nil
+	}
+	close(S.closed)
+	listeners := S.listeners
+	S.listeners = nil
+	S.lock.Unlock()
+
+	var errs []error
+	for _, listener := range listeners {
+		errs = append(errs, listener.Close())
+	}
+	S.endpoint.Close()
+	S.stack.Close()
+	S.stack.Wait()
+	return errors.Join(errs...)
+}
+
+func (S *NetstackSource) isClosed() bool {
+	select {
+	case <-S.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// NeedsAddress returns whether the stack is still waiting for an address, as client stacks that were not given one do.
+func (S *NetstackSource) NeedsAddress() bool {
+	select {
+	case <-S.addressed:
+		return false
+	default:
+		return true
+	}
+}
+
+// SetAddress gives an address to a stack that has none, such as the one that the server assigned to the client,
+// and starts the services. It does nothing if the stack already has an address.
+func (S *NetstackSource) SetAddress(ip netip.Addr) error {
+	S.lock.Lock()
+	defer S.lock.Unlock()
+	if !S.NeedsAddress() {
+		return nil
+	}
+	err := S.addAddress(ip)
+	if err != nil {
+		return err
+	}
+	S.IP = ip.String()
+	close(S.addressed)
+	return nil
+}
+
+func (S *NetstackSource) addAddress(ip netip.Addr) error {
+	address, protocol := fullAddress(ip, 0)
+	return tcpipError(S.stack.AddProtocolAddress(netstackNIC, tcpip.ProtocolAddress{
+		Protocol:          protocol,
+		AddressWithPrefix: address.Addr.WithPrefix(),
+	}, stack.AddressProperties{}))
+}
+
+// track registers a listener of a service, so that Close closes it. If the stack is already closed, it closes the
+// listener at once and fails.
+func (S *NetstackSource) track(listener io.Closer) error {
+	S.lock.Lock()
+	defer S.lock.Unlock()
+	if S.isClosed() {
+		listener.Close()
+		return net.ErrClosed
+	}
+	S.listeners = append(S.listeners, listener)
+	return nil
+}
+
+// Write injects a packet into the stack, or passes other messages to the services.
+func (S *NetstackSource) Write(msg bizarre.Message) error {
+	if msg.Type != bizarre.MessageIP {
+		for _, service := range S.Services {
+			if handler, ok := service.(messageHandler); ok && handler.handle(msg) {
+				return nil
+			}
+		}
+		return fmt.Errorf("unexpected %s message", msg.Type)
+	}
+	if len(msg.Payload) == 0 {
+		return fmt.Errorf("empty packet")
+	}
+	var protocol tcpip.NetworkProtocolNumber
+	switch header.IPVersion(msg.Payload) {
+	case header.IPv4Version:
+		protocol = header.IPv4ProtocolNumber
+	case header.IPv6Version:
+		protocol = header.IPv6ProtocolNumber
+	default:
+		return fmt.Errorf("not an IP packet")
+	}
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(msg.Payload)})
+	S.endpoint.InjectInbound(protocol, pkt)
+	pkt.DecRef()
+	return nil
+}
+
+// fullAddress converts an IP and port to the format of the stack.
+func fullAddress(ip netip.Addr, port uint16) (tcpip.FullAddress, tcpip.NetworkProtocolNumber) {
+	ip = ip.Unmap()
+	protocol := ipv4.ProtocolNumber
+	if ip.Is6() {
+		protocol = ipv6.ProtocolNumber
+	}
+	return tcpip.FullAddress{NIC: netstackNIC, Addr: tcpip.AddrFromSlice(ip.AsSlice()), Port: port}, protocol
+}
+
+// DialContext connects to an address through the tunnel. Host names are resolved through the tunnel as well, and
+// their addresses are tried in turn, starting with those of the family of the address of the stack.
+func (S *NetstackSource) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portString)
+	}
+	var ips []netip.Addr
+	if ip, err := netip.ParseAddr(host); err == nil {
+		ips = append(ips, ip)
+	} else {
+		resolved, err := S.resolver.LookupNetIP(ctx, lookupNetwork(network), host)
+		if err != nil {
+			return nil, err
+		}
+		ips = S.sortByFamily(resolved)
+	}
+	var errs []error
+	for _, ip := range ips {
+		conn, err := S.dial(ctx, network, ip, uint16(port))
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+func (S *NetstackSource) dial(ctx context.Context, network string, ip netip.Addr, port uint16) (net.Conn, error) {
+	remote, protocol := fullAddress(ip, port)
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		return gonet.DialContextTCP(ctx, S.stack, remote, protocol)
+	case "udp", "udp4", "udp6":
+		return gonet.DialUDP(S.stack, nil, &remote, protocol)
+	default:
+		return nil, fmt.Errorf("unsupported network %q", network)
+	}
+}
+
+// lookupNetwork returns the network to resolve the names of a network with: "ip4" or "ip6" for networks of one family.
+func lookupNetwork(network string) string {
+	switch network {
+	case "tcp4", "udp4":
+		return "ip4"
+	case "tcp6", "udp6":
+		return "ip6"
+	default:
+		return "ip"
+	}
+}
+
+// sortByFamily moves the addresses of the family of the address of the stack first, as the stack cannot reach the
+// others.
+func (S *NetstackSource) sortByFamily(ips []netip.Addr) []netip.Addr {
+	local, err := netip.ParseAddr(S.IP)
+	if err != nil {
+		return ips
+	}
+	otherFamily := func(ip netip.Addr) int {
+		if ip.Unmap().Is4() == local.Unmap().Is4() {
+			return 0
+		}
+		return 1
+	}
+	ips = slices.Clone(ips)
+	slices.SortStableFunc(ips, func(a, b netip.Addr) int {
+		return otherFamily(a) - otherFamily(b)
+	})
+	return ips
+}
+
+// ListenTCP listens on an ephemeral port of the address of the stack.
+func (S *NetstackSource) ListenTCP() (*gonet.TCPListener, error) {
+	address, protocol, err := S.localAddress()
+	if err != nil {
+		return nil, err
+	}
+	return gonet.ListenTCP(S.stack, address, protocol)
+}
+
+// ListenUDP opens an unconnected UDP socket on an ephemeral port of the address of the stack.
+func (S *NetstackSource) ListenUDP() (*gonet.UDPConn, error) {
+	address, protocol, err := S.localAddress()
+	if err != nil {
+		return nil, err
+	}
+	return gonet.DialUDP(S.stack, &address, nil, protocol)
+}
+
+func (S *NetstackSource) localAddress() (tcpip.FullAddress, tcpip.NetworkProtocolNumber, error) {
+	ip, err := netip.ParseAddr(S.IP)
+	if err != nil {
+		return tcpip.FullAddress{}, 0, fmt.Errorf("the network stack has no address")
+	}
+	address, protocol := fullAddress(ip, 0)
+	return address, protocol, nil
+}
+
+// netAddress returns the address of the endpoint in the format of package net.
+func netAddress(address tcpip.Address, port uint16) string {
+	return net.JoinHostPort(address.String(), strconv.Itoa(int(port)))
+}
+
+// allowsDestination returns whether flows may be forwarded to an address.
+func (S *NetstackSource) allowsDestination(address tcpip.Address) bool {
+	if S.AllowLocal {
+		return true
+	}
+	addr, _ := netip.AddrFromSlice(address.AsSlice())
+	addr = addr.Unmap()
+	return !addr.IsLoopback() && !addr.IsLinkLocalUnicast() && !addr.IsLinkLocalMulticast() && !addr.IsUnspecified()
+}
+
+func (S *NetstackSource) forwardTCP(request *tcp.ForwarderRequest) {
+	id := request.ID()
+	destination := netAddress(id.LocalAddress, id.LocalPort)
+	if !S.allowsDestination(id.LocalAddress) {
+		logger().Warn("Refused to forward TCP to a local address", "destination", destination)
+		request.Complete(true)
+		return
+	}
+	outbound, err := net.DialTimeout("tcp", destination, dialTimeout)
+	if err != nil {
+		logger().Warn("Could not forward TCP", "destination", destination, "error", err)
+		request.Complete(true)
+		return
+	}
+	var queue waiter.Queue
+	endpoint, tcpErr := request.CreateEndpoint(&queue)
+	if tcpErr != nil {
+		logger().Warn("Could not forward TCP", "destination", destination, "error", tcpErr)
+		request.Complete(true)
+		outbound.Close()
+		return
+	}
+	request.Complete(false)
+	Proxy(gonet.NewTCPConn(&queue, endpoint), outbound)
+}
+
+func (S *NetstackSource) forwardUDP(request *udp.ForwarderRequest) bool {
+	id := request.ID()
+	destination := netAddress(id.LocalAddress, id.LocalPort)
+	if !S.allowsDestination(id.LocalAddress) {
+		logger().Warn("Refused to forward UDP to a local address", "destination", destination)
+		return false
+	}
+	var queue waiter.Queue
+	endpoint, tcpErr := request.CreateEndpoint(&queue)
+	if tcpErr != nil {
+		logger().Warn("Could not forward UDP", "destination", destination, "error", tcpErr)
+		return false
+	}
+	inbound := gonet.NewUDPConn(&queue, endpoint)
+	go func() {
+		outbound, err := net.Dial("udp", destination)
+		if err != nil {
+			logger().Warn("Could not forward UDP", "destination", destination, "error", err)
+			inbound.Close()
+			return
+		}
+		ProxyDatagrams(inbound, outbound, udpIdleTimeout)
+	}()
+	return true
+}
+
+// closeWriter is implemented by connections that support half-closing, like TCP.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// Proxy copies data between two connections until both directions are done, then closes them.
+func Proxy(a, b net.Conn) {
+	done := make(chan struct{})
+	copyHalf := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		if c, ok := dst.(closeWriter); ok {
+			c.CloseWrite()
+		} else {
+			dst.Close()
+		}
+		done <- struct{}{}
+	}
+	go copyHalf(a, b)
+	go copyHalf(b, a)
+	<-done
+	<-done
+	a.Close()
+	b.Close()
+}
+
+// ProxyDatagrams copies datagrams between two connected sockets until neither has received anything for the idle
+// timeout, then closes them.
+func ProxyDatagrams(a, b net.Conn, idleTimeout time.Duration) {
+	done := make(chan struct{}, 2)
+	copyHalf := func(dst, src net.Conn) {
+		buffer := make([]byte, 65535)
+		for {
+			src.SetReadDeadline(time.Now().Add(idleTimeout))
+			n, err := src.Read(buffer)
+			if err != nil {
+				break
+			}
+			// Traffic in either direction keeps the flow alive
+			dst.SetReadDeadline(time.Now().Add(idleTimeout))
+			_, err = dst.Write(buffer[:n])
+			if err != nil {
+				break
+			}
+		}
+		done <- struct{}{}
+	}
+	go copyHalf(a, b)
+	go copyHalf(b, a)
+	<-done
+	a.Close()
+	b.Close()
+	<-done
+}
+
+// CreateNetstack creates a NetstackSource with the given config.
+func CreateNetstack(config NetstackConfig) (*NetstackSource, error) {
+	if !config.Enabled {
+		return nil, fmt.Errorf("netstack not enabled")
+	}
+	if config.MTU == 0 {
+		config.MTU = 1500
+	}
+	S := &NetstackSource{NetstackConfig: config, addressed: make(chan struct{}), closed: make(chan struct{})}
+	S.stack = stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol, icmp.NewProtocol4, icmp.NewProtocol6},
+	})
+	S.endpoint = channel.New(netstackQueueSize, uint32(config.MTU), "")
+	if err := S.stack.CreateNIC(netstackNIC, S.endpoint); err != nil {
+		return nil, fmt.Errorf("creating NIC: %s", err)
+	}
+	S.stack.SetRouteTable([]tcpip.Route{
+		{Destination: header.IPv4EmptySubnet, NIC: netstackNIC},
+		{Destination: header.IPv6EmptySubnet, NIC: netstackNIC},
+	})
+	sack := tcpip.TCPSACKEnabled(true)
+	S.stack.SetTransportProtocolOption(tcp.ProtocolNumber, &sack)
+
+	if config.IP != "" {
+		ip, err := netip.ParseAddr(config.IP)
+		if err != nil {
+			return nil, fmt.Errorf("parsing netstack IP: %w", err)
+		}
+		err = S.addAddress(ip)
+		if err != nil {
+			return nil, fmt.Errorf("adding address: %w", err)
+		}
+		close(S.addressed)
+	}
+	S.resolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return S.DialContext(ctx, network, config.DNS)
+		},
+	}
+	if !config.Forward {
+		return S, nil
+	}
+
+	// Accept packets for every destination, and answer from the address they were sent to
+	if err := S.stack.SetPromiscuousMode(netstackNIC, true); err != nil {
+		return nil, fmt.Errorf("enabling promiscuous mode: %s", err)
+	}
+	if err := S.stack.SetSpoofing(netstackNIC, true); err != nil {
+		return nil, fmt.Errorf("enabling spoofing: %s", err)
+	}
+	tcpForwarder := tcp.NewForwarder(S.stack, 0, 1024, S.forwardTCP)
+	S.stack.SetTransportProtocolHandler(tcp.ProtocolNumber, tcpForwarder.HandlePacket)
+	udpForwarder := udp.NewForwarder(S.stack, S.forwardUDP)
+	S.stack.SetTransportProtocolHandler(udp.ProtocolNumber, udpForwarder.HandlePacket)
+	return S, nil
+}
+
+// tcpipError converts an error of the stack to an error, as its nil values are not nil errors.
+func tcpipError(err tcpip.Error) error {
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("%s", err)
+}
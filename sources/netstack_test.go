@@ -0,0 +1,318 @@
+package sources
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	bizarre "github.com/CapacitorSet/bizarre-net"
+	"github.com/miekg/dns"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+)
+
+// TestNetstackForwardsTCP connects a plain stack (standing in for a client with a TUN) to a NetstackSource, and
+// checks that a connection through it reaches a local listener.
+func TestNetstackForwardsTCP(t *testing.T) {
+	// Loopback addresses are not routable through a stack, so listen on another local address
+	listener, err := net.Listen("tcp", localAddress(t)+":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(conn, conn)
+		conn.Close()
+	}()
+
+	netstack, err := CreateNetstack(NetstackConfig{Enabled: true, Forward: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol},
+	})
+	endpoint := channel.New(64, 1500, "")
+	client.CreateNIC(1, endpoint)
+	client.AddProtocolAddress(1, tcpip.ProtocolAddress{
+		Protocol:          ipv4.ProtocolNumber,
+		AddressWithPrefix: tcpip.AddrFrom4([4]byte{10, 0, 0, 2}).WithPrefix(),
+	}, stack.AddressProperties{})
+	client.SetRouteTable([]tcpip.Route{{Destination: header.IPv4EmptySubnet, NIC: 1}})
+
+	// Wire the two stacks together
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		for {
+			pkt := endpoint.ReadContext(ctx)
+			if pkt == nil {
+				return
+			}
+			view := pkt.ToView()
+			pkt.DecRef()
+			netstack.Write(bizarre.Message{Type: bizarre.MessageIP, Payload: append([]byte(nil), view.AsSlice()...)})
+			view.Release()
+		}
+	}()
+	fromNetstack := make(chan bizarre.Message)
+	go netstack.Start(fromNetstack)
+	go func() {
+		for msg := range fromNetstack {
+			pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(msg.Payload)})
+			endpoint.InjectInbound(ipv4.ProtocolNumber, pkt)
+			pkt.DecRef()
+		}
+	}()
+
+	addr := listener.Addr().(*net.TCPAddr)
+	dialCtx, dialCancel := context.WithTimeout(ctx, 10*time.Second)
+	defer dialCancel()
+	conn, err := gonet.DialContextTCP(dialCtx, client, tcpip.FullAddress{NIC: 1, Addr: tcpip.AddrFrom4Slice(addr.IP.To4()), Port: uint16(addr.Port)}, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 4)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != "ping" {
+		t.Fatalf("got %q, expected the echo", reply)
+	}
+}
+
+func localAddress(t *testing.T) string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range addrs {
+		if ip, ok := addr.(*net.IPNet); ok && !ip.IP.IsLoopback() && ip.IP.To4() != nil {
+			return ip.IP.String()
+		}
+	}
+	t.Skip("no non-loopback IPv4 address")
+	return ""
+}
+
+// startDNSServer starts a DNS server on a local address, which answers A and AAAA queries with the given addresses
+// of each name, and returns its address.
+func startDNSServer(t *testing.T, names map[string][]string) string {
+	conn, err := net.ListenPacket("udp", localAddress(t)+":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{PacketConn: conn, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, query *dns.Msg) {
+		reply := new(dns.Msg)
+		reply.SetReply(query)
+		for _, question := range query.Question {
+			for _, address := range names[question.Name] {
+				ip := net.ParseIP(address)
+				header := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: 60}
+				if question.Qtype == dns.TypeA && ip.To4() != nil {
+					reply.Answer = append(reply.Answer, &dns.A{Hdr: header, A: ip})
+				} else if question.Qtype == dns.TypeAAAA && ip.To4() == nil {
+					reply.Answer = append(reply.Answer, &dns.AAAA{Hdr: header, AAAA: ip})
+				}
+			}
+		}
+		w.WriteMsg(reply)
+	})}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+	return conn.LocalAddr().String()
+}
+
+// startEchoServer starts a TCP server on a local address that echoes what it receives, and returns its address.
+func startEchoServer(t *testing.T) *net.TCPAddr {
+	listener, err := net.Listen("tcp", localAddress(t)+":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr)
+}
+
+// TestNetstackDialHostName checks that host names are resolved through the tunnel, and that an IPv4 stack connects
+// to their IPv4 address even if they have IPv6 addresses as well.
+func TestNetstackDialHostName(t *testing.T) {
+	target := startEchoServer(t)
+	dnsServer := startDNSServer(t, map[string][]string{
+		"dual.example.": {"2001:db8::1", "2001:db8::2", target.IP.String()},
+	})
+	server, err := CreateNetstack(NetstackConfig{Enabled: true, Forward: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := CreateNetstack(NetstackConfig{Enabled: true, IP: "10.0.0.2", DNS: dnsServer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wire(client, server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := client.DialContext(ctx, "tcp", net.JoinHostPort("dual.example", strconv.Itoa(target.Port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 4)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != "ping" {
+		t.Fatalf("got %q, expected the echo", reply)
+	}
+}
+
+func TestSortByFamily(t *testing.T) {
+	ips := []netip.Addr{
+		netip.MustParseAddr("2001:db8::1"),
+		netip.MustParseAddr("192.0.2.1"),
+		netip.MustParseAddr("2001:db8::2"),
+		netip.MustParseAddr("192.0.2.2"),
+	}
+	v4 := &NetstackSource{NetstackConfig: NetstackConfig{IP: "10.0.0.2"}}
+	expected := []netip.Addr{ips[1], ips[3], ips[0], ips[2]}
+	if sorted := v4.sortByFamily(ips); !slices.Equal(sorted, expected) {
+		t.Errorf("got %v, expected %v", sorted, expected)
+	}
+	v6 := &NetstackSource{NetstackConfig: NetstackConfig{IP: "fd00::2"}}
+	expected = []netip.Addr{ips[0], ips[2], ips[1], ips[3]}
+	if sorted := v6.sortByFamily(ips); !slices.Equal(sorted, expected) {
+		t.Errorf("got %v, expected %v", sorted, expected)
+	}
+}
+
+// wire connects a client and a server NetstackSource, as the tunnel would.
+func wire(client, server *NetstackSource) {
+	fromClient := make(chan bizarre.Message)
+	fromServer := make(chan bizarre.Message)
+	go client.Start(fromClient)
+	go server.Start(fromServer)
+	go func() {
+		for msg := range fromClient {
+			server.Write(msg)
+		}
+	}()
+	go func() {
+		for msg := range fromServer {
+			client.Write(msg)
+		}
+	}()
+}
+
+// TestNetstackClose checks that closing a stack stops Start and the listeners of its services.
+func TestNetstackClose(t *testing.T) {
+	netstack, err := CreateNetstack(NetstackConfig{Enabled: true, IP: ClientNetstackIP})
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan error, 1)
+	go func() { started <- netstack.Start(make(chan bizarre.Message)) }()
+
+	socks := &SOCKSServer{SOCKSConfig{Address: "127.0.0.1:0"}}
+	served := make(chan error, 1)
+	go func() { served <- socks.Serve(netstack) }()
+	// Wait for the proxy to listen
+	for deadline := time.Now().Add(time.Second); ; {
+		netstack.lock.Lock()
+		listening := len(netstack.listeners) == 1
+		netstack.lock.Unlock()
+		if listening {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the SOCKS proxy did not listen")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := netstack.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-started:
+		if err != nil {
+			t.Errorf("Start returned %s after Close", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Start did not return after Close")
+	}
+	select {
+	case <-served:
+	case <-time.After(time.Second):
+		t.Error("the SOCKS proxy did not stop after Close")
+	}
+	if err := netstack.Send(bizarre.Message{Type: bizarre.MessageIP}); err == nil {
+		t.Error("Send succeeded after Close")
+	}
+}
+
+// TestNetstackLocalDestinations checks that flows to the addresses of the host itself are only forwarded if allowed.
+func TestNetstackLocalDestinations(t *testing.T) {
+	for _, test := range []struct {
+		address string
+		local   bool
+	}{
+		{"127.0.0.1", true},
+		{"::1", true},
+		{"::ffff:127.0.0.1", true},
+		{"169.254.169.254", true},
+		{"fe80::1", true},
+		{"0.0.0.0", true},
+		{"::", true},
+		{"192.0.2.1", false},
+		{"2001:db8::1", false},
+	} {
+		address := tcpip.AddrFromSlice(netip.MustParseAddr(test.address).AsSlice())
+		refusing := &NetstackSource{}
+		if refusing.allowsDestination(address) == test.local {
+			t.Errorf("%s: got allowed %t by default", test.address, !test.local)
+		}
+		allowing := &NetstackSource{NetstackConfig: NetstackConfig{AllowLocal: true}}
+		if !allowing.allowsDestination(address) {
+			t.Errorf("%s: refused with AllowLocal", test.address)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package sources
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// PrefixList is a list of prefixes in CIDR notation, usable as a flag that is comma-separated and repeatable.
+type PrefixList []string
+
+func (L *PrefixList) String() string {
+	return strings.Join(*L, ",")
+}
+
+func (L *PrefixList) Set(value string) error {
+	for _, prefix := range strings.Split(value, ",") {
+		if prefix = strings.TrimSpace(prefix); prefix != "" {
+			*L = append(*L, prefix)
+		}
+	}
+	return nil
+}
+
+// markValue is a firewall mark, usable as a flag in decimal or hexadecimal (eg. 0x10).
+type markValue uint32
+
+func (m *markValue) String() string {
+	return fmt.Sprintf("%#x", uint32(*m))
+}
+
+func (m *markValue) Set(value string) error {
+	mark, err := strconv.ParseUint(value, 0, 32)
+	if err != nil {
+		return err
+	}
+	*m = markValue(mark)
+	return nil
+}
+
+// parsePrefixes parses a list of prefixes; single addresses are taken as host prefixes.
+func parsePrefixes(list []string) ([]*net.IPNet, error) {
+	var prefixes []*net.IPNet
+	for _, prefix := range list {
+		if !strings.Contains(prefix, "/") {
+			ip := net.ParseIP(prefix)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid prefix %s", prefix)
+			}
+			prefixes = append(prefixes, hostPrefix(ip))
+			continue
+		}
+		_, subnet, err := net.ParseCIDR(prefix)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, subnet)
+	}
+	return prefixes, nil
+}
+
+func hostPrefix(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+func family(prefix *net.IPNet) int {
+	if prefix.IP.To4() != nil {
+		return netlink.FAMILY_V4
+	}
+	return netlink.FAMILY_V6
+}
+
+// splitDefault replaces default routes with their two halves, which take precedence over the default route of the
+// host without replacing it, like OpenVPN's def1.
+func splitDefault(prefixes []*net.IPNet) []*net.IPNet {
+	var ret []*net.IPNet
+	for _, prefix := range prefixes {
+		ones, bits := prefix.Mask.Size()
+		if ones != 0 {
+			ret = append(ret, prefix)
+			continue
+		}
+		mask := net.CIDRMask(1, bits)
+		low := &net.IPNet{IP: make(net.IP, bits/8), Mask: mask}
+		high := &net.IPNet{IP: make(net.IP, bits/8), Mask: mask}
+		high.IP[0] = 0x80
+		ret = append(ret, low, high)
+	}
+	return ret
+}
+
+// routing is the routes and rules that a TUN installed, so that they can be removed.
+type routing struct {
+	routes []netlink.Route
+	rules  []netlink.Rule
+}
+
+// prefixes returns the prefixes that the config routes through the TUN, given its addresses, and the ones that it
+// excludes.
+func (config TUNConfig) prefixes(addresses []*net.IPNet) (routed, excluded []*net.IPNet, err error) {
+	routed, err = parsePrefixes(config.Routes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing routes: %w", err)
+	}
+	excluded, err = parsePrefixes(config.Exclude)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing excluded routes: %w", err)
+	}
+	if config.DefaultRoute {
+		// Only for the IP versions that the TUN has an address of
+		hasFamily := make(map[int]bool)
+		for _, address := range addresses {
+			hasFamily[family(address)] = true
+		}
+		if hasFamily[netlink.FAMILY_V4] {
+			routed = append(routed, &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)})
+		}
+		if hasFamily[netlink.FAMILY_V6] {
+			routed = append(routed, &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)})
+		}
+	}
+	return routed, excluded, nil
+}
+
+// Captures returns whether the routes of the TUN would apply to unmarked packets to the IP, which is the case when
+// they are in the main table and cover the IP, unless it is excluded. Routes in other tables are only looked up
+// through rules, such as the one for FwMark.
+func (config TUNConfig) Captures(ip net.IP) (bool, error) {
+	if config.Name == "" || config.Table != 0 || config.FwMark != 0 {
+		return false, nil
+	}
+	addresses, err := parseAddresses(config.IP)
+	if err != nil {
+		return false, fmt.Errorf("parsing TUN subnet: %w", err)
+	}
+	routed, excluded, err := config.prefixes(addresses)
+	if err != nil {
+		return false, err
+	}
+	for _, prefix := range excluded {
+		if prefix.Contains(ip) {
+			return false, nil
+		}
+	}
+	for _, prefix := range routed {
+		if prefix.Contains(ip) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// setRoutes routes the prefixes in the config through the TUN, and the excluded prefixes and the endpoints of the
+// transports through the routes that they had before. Packets to the endpoints must not enter the tunnel that they
+// carry.
+func setRoutes(config TUNConfig, index int, addresses []*net.IPNet) (routing, error) {
+	var R routing
+	routed, excluded, err := config.prefixes(addresses)
+	if err != nil {
+		return R, err
+	}
+	table := config.Table
+	if table == 0 && config.FwMark != 0 {
+		table = int(config.FwMark)
+	}
+	if table == 0 {
+		table = unix.RT_TABLE_MAIN
+		routed = splitDefault(routed)
+	}
+
+	// The routes of the excluded prefixes must be looked up before the TUN takes them over
+	var bypasses []netlink.Route
+	for _, prefix := range excluded {
+		route, err := currentRoute(prefix, table)
+		if err != nil {
+			return R, fmt.Errorf("excluding %s: %w", prefix, err)
+		}
+		bypasses = append(bypasses, route)
+	}
+	endpoints := make(map[string]netlink.Route)
+	for _, ip := range config.endpoints {
+		route, err := currentRoute(hostPrefix(ip), table)
+		if err != nil {
+			return R, fmt.Errorf("excluding endpoint %s: %w", ip, err)
+		}
+		endpoints[ip.String()] = route
+	}
+
+	for _, prefix := range routed {
+		route := netlink.Route{LinkIndex: index, Dst: prefix, Scope: netlink.SCOPE_LINK, Table: table}
+		err = R.addRoute(route)
+		if err != nil {
+			return R, fmt.Errorf("routing %s: %w", prefix, err)
+		}
+	}
+	for _, route := range bypasses {
+		err = R.addRoute(route)
+		if err != nil {
+			return R, fmt.Errorf("excluding %s: %w", route.Dst, err)
+		}
+	}
+	for _, ip := range config.endpoints {
+		// Only endpoints that the new routes capture need a route of their own
+		routedThrough, err := isRoutedThrough(ip, index)
+		if err != nil {
+			return R, err
+		}
+		if routedThrough {
+			route := endpoints[ip.String()]
+			err = R.addRoute(route)
+			if err != nil {
+				return R, fmt.Errorf("excluding endpoint %s: %w", ip, err)
+			}
+		}
+	}
+
+	if config.FwMark != 0 {
+		for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+			rule := netlink.NewRule()
+			rule.Family = family
+			rule.Mark = config.FwMark
+			rule.Table = table
+			err = netlink.RuleAdd(rule)
+			if errors.Is(err, unix.EAFNOSUPPORT) {
+				// IPv6 is disabled on this host
+				continue
+			} else if err != nil {
+				return R, fmt.Errorf("adding a rule for fwmark %#x: %w", config.FwMark, err)
+			}
+			R.rules = append(R.rules, *rule)
+		}
+	}
+	return R, nil
+}
+
+func (R *routing) addRoute(route netlink.Route) error {
+	err := netlink.RouteAdd(&route)
+	if err != nil {
+		return err
+	}
+	R.routes = append(R.routes, route)
+	return nil
+}
+
+// remove deletes the rules and the routes, including the ones that do not go through the TUN and thus would outlive
+// it.
+func (R *routing) remove() error {
+	var errs []error
+	for _, rule := range R.rules {
+		if err := netlink.RuleDel(&rule); err != nil && !errors.Is(err, unix.ENOENT) {
+			errs = append(errs, err)
+		}
+	}
+	for _, route := range R.routes {
+		if err := netlink.RouteDel(&route); err != nil && !errors.Is(err, unix.ESRCH) {
+			errs = append(errs, err)
+		}
+	}
+	R.routes, R.rules = nil, nil
+	return errors.Join(errs...)
+}
+
+// currentRoute returns a route for the prefix in the given table through the gateway and interface that the host
+// currently uses for it.
+func currentRoute(prefix *net.IPNet, table int) (netlink.Route, error) {
+	routes, err := netlink.RouteGet(prefix.IP)
+	if err != nil {
+		return netlink.Route{}, err
+	}
+	if len(routes) == 0 {
+		return netlink.Route{}, errors.New("no route")
+	}
+	route := netlink.Route{LinkIndex: routes[0].LinkIndex, Dst: prefix, Gw: routes[0].Gw, Table: table}
+	if route.Gw == nil {
+		route.Scope = netlink.SCOPE_LINK
+	}
+	return route, nil
+}
+
+// isRoutedThrough returns whether the host routes packets to the IP through the interface with the given index. Like
+// Interface.IsRoutedThrough, but it asks the kernel, which also knows of policy routing and IPv6.
+func isRoutedThrough(ip net.IP, index int) (bool, error) {
+	routes, err := netlink.RouteGet(ip)
+	if err != nil {
+		return false, err
+	}
+	return len(routes) != 0 && routes[0].LinkIndex == index, nil
+}
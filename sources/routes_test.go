@@ -0,0 +1,56 @@
+package sources
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestParsePrefixes(t *testing.T) {
+	prefixes, err := parsePrefixes([]string{"10.1.2.3/16", "192.0.2.1", "2001:db8::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "[10.1.0.0/16 192.0.2.1/32 2001:db8::1/128]"
+	if got := fmt.Sprint(prefixes); got != expected {
+		t.Errorf("got %s, expected %s", got, expected)
+	}
+	if _, err := parsePrefixes([]string{"example.com"}); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestSplitDefault(t *testing.T) {
+	prefixes, err := parsePrefixes([]string{"0.0.0.0/0", "10.0.0.0/8", "::/0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "[0.0.0.0/1 128.0.0.0/1 10.0.0.0/8 ::/1 8000::/1]"
+	if got := fmt.Sprint(splitDefault(prefixes)); got != expected {
+		t.Errorf("got %s, expected %s", got, expected)
+	}
+}
+
+func TestCaptures(t *testing.T) {
+	config := TUNConfig{Name: "bizarre0", IP: "10.0.0.2/24,fd00::2/64", Routes: []string{"192.0.2.0/24"}, Exclude: []string{"198.51.100.0/24"}}
+	tests := map[string]bool{
+		"192.0.2.1":    true,
+		"203.0.113.1":  false,
+		"198.51.100.1": false,
+		"2001:db8::1":  false,
+	}
+	for ip, expected := range tests {
+		if captured, _ := config.Captures(net.ParseIP(ip)); captured != expected {
+			t.Errorf("%s: got %t, expected %t", ip, captured, expected)
+		}
+	}
+
+	config.DefaultRoute = true
+	tests["203.0.113.1"] = true
+	tests["2001:db8::1"] = true
+	for ip, expected := range tests {
+		if captured, _ := config.Captures(net.ParseIP(ip)); captured != expected {
+			t.Errorf("%s with the default route: got %t, expected %t", ip, captured, expected)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package sources
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	bizarre "github.com/CapacitorSet/bizarre-net"
+	"golang.org/x/term"
+)
+
+type ShellConfig struct {
+	Enabled bool
+}
+
+// ShellSource opens an interactive shell on the server. If stdin is a terminal, it is put in raw mode and the
+// server allocates a PTY; otherwise the shell reads stdin as a stream, which allows piping scripts into it.
+type ShellSource struct {
+	ShellConfig
+	Stdout, Stderr io.Writer // Where the output of the shell goes, by default the standard streams
+
+	stdinFd  int
+	lock     sync.Mutex  // Guards oldState and restored, since Start runs concurrently with Write and Close
+	oldState *term.State // The terminal state to restore on exit, if stdin is a terminal
+	restored bool        // Whether the shell has exited, after which the terminal is not put in raw mode again
+	done     chan int
+}
+
+var (
+	_ Source   = (*ShellSource)(nil) // Ensure that interface fields are implemented
+	_ Finisher = (*ShellSource)(nil)
+)
+
+func (S *ShellSource) windowSize() bizarre.WindowSize {
+	cols, rows, err := term.GetSize(S.stdinFd)
+	if err != nil {
+		logger().Warn("Could not read the terminal size", "error", err)
+		return bizarre.WindowSize{Rows: 24, Cols: 80}
+	}
+	return bizarre.WindowSize{Rows: uint16(rows), Cols: uint16(cols)}
+}
+
+func (S *ShellSource) Start(ch chan bizarre.Message) error {
+	open := bizarre.ShellOpen{Term: os.Getenv("TERM")}
+	if term.IsTerminal(S.stdinFd) {
+		open.WindowSize = S.windowSize()
+		S.makeRaw()
+
+		resizeChan := make(chan os.Signal, 1)
+		signal.Notify(resizeChan, syscall.SIGWINCH)
+		go func() {
+			for range resizeChan {
+				ch <- bizarre.Message{Type: bizarre.MessageShellResize, Payload: S.windowSize().Marshal()}
+			}
+		}()
+	}
+	ch <- bizarre.Message{Type: bizarre.MessageShellOpen, Payload: open.Marshal()}
+
+	buffer := make([]byte, maxChunk)
+	for {
+		n, err := os.Stdin.Read(buffer)
+		if n > 0 {
+			// The buffer is reused, so the payload must be copied
+			ch <- bizarre.Message{Type: bizarre.MessageStdin, Payload: append([]byte(nil), buffer[:n]...)}
+		}
+		if err == io.EOF {
+			ch <- bizarre.Message{Type: bizarre.MessageStdin, Flags: bizarre.FlagEnd}
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("reading stdin: %w", err)
+		}
+	}
+}
+
+// Write handles the output and the exit status of the shell.
+func (S *ShellSource) Write(msg bizarre.Message) error {
+	switch msg.Type {
+	case bizarre.MessageStdout:
+		_, err := S.Stdout.Write(msg.Payload)
+		return err
+	case bizarre.MessageStderr:
+		_, err := S.Stderr.Write(msg.Payload)
+		return err
+	case bizarre.MessageExit:
+		status, err := bizarre.ParseExitStatus(msg.Payload)
+		if err != nil {
+			return err
+		}
+		S.restoreTerminal()
+		select {
+		case S.done <- status:
+		default:
+			// Only the first exit status counts, and Run may have returned without reading it
+		}
+		return nil
+	default:
+		return fmt.Errorf("unexpected %s message", msg.Type)
+	}
+}
+
+// Close restores the terminal, which Start puts in raw mode.
+func (S *ShellSource) Close() error {
+	S.restoreTerminal()
+	return nil
+}
+
+func (S *ShellSource) makeRaw() {
+	S.lock.Lock()
+	defer S.lock.Unlock()
+	if S.restored {
+		return
+	}
+	oldState, err := term.MakeRaw(S.stdinFd)
+	if err != nil {
+		logger().Warn("Could not set the terminal in raw mode", "error", err)
+		return
+	}
+	S.oldState = oldState
+}
+
+func (S *ShellSource) restoreTerminal() {
+	S.lock.Lock()
+	defer S.lock.Unlock()
+	S.restored = true
+	if S.oldState != nil {
+		term.Restore(S.stdinFd, S.oldState)
+		S.oldState = nil
+	}
+}
+
+func (S *ShellSource) Done() <-chan int {
+	return S.done
+}
+
+// CreateShell creates a ShellSource with the given config.
+func CreateShell(config ShellConfig) (ShellSource, error) {
+	if !config.Enabled {
+		return ShellSource{}, fmt.Errorf("shell not enabled")
+	}
+	return ShellSource{ShellConfig: config, Stdout: os.Stdout, Stderr: os.Stderr, stdinFd: int(os.Stdin.Fd()), done: make(chan int, 1)}, nil
+}
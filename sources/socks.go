@@ -0,0 +1,284 @@
+package sources
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// SOCKS5 constants, from RFC 1928
+const (
+	socksVersion = 5
+
+	socksNoAuth       = 0x00
+	socksNoAcceptable = 0xff
+
+	socksConnect      = 0x01
+	socksBind         = 0x02
+	socksUDPAssociate = 0x03
+
+	socksIPv4   = 0x01
+	socksDomain = 0x03
+	socksIPv6   = 0x04
+
+	socksSucceeded           = 0x00
+	socksGeneralFailure      = 0x01
+	socksHostUnreachable     = 0x04
+	socksConnectionRefused   = 0x05
+	socksCommandNotSupported = 0x07
+)
+
+type SOCKSConfig struct {
+	Address string // The local address to listen on, eg. 127.0.0.1:1080
+}
+
+// SOCKSServer is a SOCKS5 proxy whose connections go through the tunnel. It supports CONNECT and UDP ASSOCIATE,
+// without authentication, and resolves host names through the tunnel.
+type SOCKSServer struct {
+	SOCKSConfig
+}
+
+var (
+	_ Service = (*SOCKSServer)(nil) // Ensure that interface fields are implemented
+)
+
+func (S *SOCKSServer) Serve(network *NetstackSource) error {
+	listener, err := net.Listen("tcp", S.Address)
+	if err != nil {
+		return err
+	}
+	if err := network.track(listener); err != nil {
+		return err
+	}
+	logger().Info("SOCKS5 proxy listening", "address", listener.Addr().String())
+	return S.serve(listener, network)
+}
+
+func (S *SOCKSServer) serve(listener net.Listener, network *NetstackSource) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			err := S.handle(conn, network)
+			if err != nil {
+				logger().Warn("SOCKS5 client failed", "client", conn.RemoteAddr().String(), "error", err)
+			}
+		}()
+	}
+}
+
+// readAddress reads the address type, address and port of a request, returning it in host:port form.
+func readAddress(r io.Reader) (string, error) {
+	var addrType [1]byte
+	if _, err := io.ReadFull(r, addrType[:]); err != nil {
+		return "", err
+	}
+	var host string
+	switch addrType[0] {
+	case socksIPv4, socksIPv6:
+		ip := make([]byte, 4)
+		if addrType[0] == socksIPv6 {
+			ip = make([]byte, 16)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case socksDomain:
+		var length [1]byte
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			return "", err
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		return "", fmt.Errorf("unknown address type %d", addrType[0])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// appendAddress appends an address in the format of SOCKS5 requests and replies.
+func appendAddress(buffer []byte, address netip.AddrPort) []byte {
+	ip := address.Addr().Unmap()
+	if ip.Is4() {
+		buffer = append(buffer, socksIPv4)
+	} else {
+		buffer = append(buffer, socksIPv6)
+	}
+	buffer = append(buffer, ip.AsSlice()...)
+	return binary.BigEndian.AppendUint16(buffer, address.Port())
+}
+
+func reply(conn net.Conn, code byte, bound netip.AddrPort) error {
+	if !bound.IsValid() {
+		bound = netip.AddrPortFrom(netip.IPv4Unspecified(), 0)
+	}
+	_, err := conn.Write(appendAddress([]byte{socksVersion, code, 0}, bound))
+	return err
+}
+
+func (S *SOCKSServer) handle(conn net.Conn, network *NetstackSource) error {
+	defer conn.Close()
+
+	// Method negotiation
+	var header [2]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return err
+	}
+	if header[0] != socksVersion {
+		return fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return err
+	}
+	method := byte(socksNoAcceptable)
+	for _, m := range methods {
+		if m == socksNoAuth {
+			method = socksNoAuth
+		}
+	}
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return err
+	}
+	if method == socksNoAcceptable {
+		return errors.New("no supported authentication method")
+	}
+
+	// Request
+	var request [3]byte
+	if _, err := io.ReadFull(conn, request[:]); err != nil {
+		return err
+	}
+	destination, err := readAddress(conn)
+	if err != nil {
+		return err
+	}
+	switch request[1] {
+	case socksConnect:
+		remote, err := network.DialContext(context.Background(), "tcp", destination)
+		if err != nil {
+			code := byte(socksHostUnreachable)
+			if strings.Contains(err.Error(), "refused") {
+				code = socksConnectionRefused
+			}
+			reply(conn, code, netip.AddrPort{})
+			return fmt.Errorf("connecting to %s: %w", destination, err)
+		}
+		if err := reply(conn, socksSucceeded, netip.AddrPort{}); err != nil {
+			remote.Close()
+			return err
+		}
+		Proxy(conn, remote)
+		return nil
+	case socksUDPAssociate:
+		return S.associate(conn, destination, network)
+	default: // Including socksBind
+		reply(conn, socksCommandNotSupported, netip.AddrPort{})
+		return fmt.Errorf("unsupported command %d", request[1])
+	}
+}
+
+// associate relays UDP datagrams for a client until its control connection is closed. Only the datagrams sent from the
+// host of the control connection are relayed, and from the port that the client gave in its request (its source
+// address, in host:port form), or if it gave none, from the port of the first datagram.
+func (S *SOCKSServer) associate(conn net.Conn, source string, network *NetstackSource) error {
+	clientIP := conn.RemoteAddr().(*net.TCPAddr).AddrPort().Addr().Unmap()
+	var clientPort uint16
+	if _, port, err := net.SplitHostPort(source); err == nil {
+		parsed, _ := strconv.ParseUint(port, 10, 16)
+		clientPort = uint16(parsed)
+	}
+
+	// The relay listens on the address that the client connected to
+	local := conn.LocalAddr().(*net.TCPAddr)
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP})
+	if err != nil {
+		reply(conn, socksGeneralFailure, netip.AddrPort{})
+		return err
+	}
+	defer relay.Close()
+	if err := reply(conn, socksSucceeded, relay.LocalAddr().(*net.UDPAddr).AddrPort()); err != nil {
+		return err
+	}
+	go func() {
+		// The association ends with the control connection
+		io.Copy(io.Discard, conn)
+		relay.Close()
+	}()
+
+	flows := make(map[string]net.Conn) // Remote sockets, indexed by destination
+	defer func() {
+		for _, flow := range flows {
+			flow.Close()
+		}
+	}()
+	buffer := make([]byte, 65535)
+	for {
+		n, client, err := relay.ReadFromUDPAddrPort(buffer)
+		if err != nil {
+			return nil
+		}
+		if client.Addr().Unmap() != clientIP || (clientPort != 0 && client.Port() != clientPort) {
+			// Someone else would get the replies
+			continue
+		}
+		clientPort = client.Port()
+		// RSV (2 bytes), FRAG, then the address
+		if n < 4 || buffer[2] != 0 {
+			// Fragmentation is not supported
+			continue
+		}
+		reader := bytes.NewReader(buffer[3:n])
+		destination, err := readAddress(reader)
+		if err != nil {
+			continue
+		}
+		payload := buffer[n-reader.Len() : n]
+
+		flow, ok := flows[destination]
+		if !ok {
+			flow, err = network.DialContext(context.Background(), "udp", destination)
+			if err != nil {
+				logger().Warn("Could not forward SOCKS5 UDP", "destination", destination, "error", err)
+				continue
+			}
+			flows[destination] = flow
+			go S.relayReplies(relay, client, flow)
+		}
+		flow.Write(payload)
+	}
+}
+
+// relayReplies sends the datagrams received on a remote socket back to the SOCKS client.
+func (S *SOCKSServer) relayReplies(relay *net.UDPConn, client netip.AddrPort, flow net.Conn) {
+	buffer := make([]byte, 65535)
+	for {
+		n, err := flow.Read(buffer)
+		if err != nil {
+			return
+		}
+		from, err := netip.ParseAddrPort(flow.RemoteAddr().String())
+		if err != nil {
+			return
+		}
+		datagram := appendAddress([]byte{0, 0, 0}, from)
+		relay.WriteToUDPAddrPort(append(datagram, buffer[:n]...), client)
+	}
+}
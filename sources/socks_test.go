@@ -0,0 +1,163 @@
+package sources
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startSOCKS starts a SOCKS proxy on a client stack wired to a server stack, which resolves host names with the given
+// DNS server, and returns the address of the proxy.
+func startSOCKS(t *testing.T, dnsServer string) string {
+	server, err := CreateNetstack(NetstackConfig{Enabled: true, Forward: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := CreateNetstack(NetstackConfig{Enabled: true, IP: "10.0.0.2", DNS: dnsServer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wire(client, server)
+
+	proxy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { proxy.Close() })
+	go (&SOCKSServer{}).serve(proxy, client)
+	return proxy.Addr().String()
+}
+
+// socksRequest connects to the proxy and sends a request for the command and address (in the format of SOCKS5
+// requests), followed by the payload. It returns the connection and the address in the reply.
+func socksRequest(t *testing.T, proxy string, command byte, address []byte, payload string) (net.Conn, *net.UDPAddr) {
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	request := []byte{socksVersion, 1, socksNoAuth, socksVersion, command, 0}
+	request = append(request, address...)
+	request = append(request, payload...)
+	_, err = conn.Write(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response := make([]byte, 2+10)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	_, err = io.ReadFull(conn, response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(response[:2], []byte{socksVersion, socksNoAuth}) {
+		t.Fatalf("unexpected method selection %x", response[:2])
+	}
+	if response[3] != socksSucceeded {
+		t.Fatalf("command %d failed with code %d", command, response[3])
+	}
+	bound := &net.UDPAddr{IP: net.IP(response[6:10]), Port: int(binary.BigEndian.Uint16(response[10:]))}
+	return conn, bound
+}
+
+func ipv4Address(ip net.IP, port int) []byte {
+	address := append([]byte{socksIPv4}, ip.To4()...)
+	return binary.BigEndian.AppendUint16(address, uint16(port))
+}
+
+func expectEcho(t *testing.T, conn net.Conn) {
+	t.Helper()
+	reply := make([]byte, 4)
+	_, err := io.ReadFull(conn, reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != "ping" {
+		t.Fatalf("got %q, expected the echo", reply)
+	}
+}
+
+func TestSOCKSConnect(t *testing.T) {
+	target := startEchoServer(t)
+	proxy := startSOCKS(t, "")
+	conn, _ := socksRequest(t, proxy, socksConnect, ipv4Address(target.IP, target.Port), "ping")
+	expectEcho(t, conn)
+}
+
+// TestSOCKSConnectHostName checks that the host names in requests are resolved through the tunnel.
+func TestSOCKSConnectHostName(t *testing.T) {
+	target := startEchoServer(t)
+	dnsServer := startDNSServer(t, map[string][]string{"echo.example.": {target.IP.String()}})
+	proxy := startSOCKS(t, dnsServer)
+	name := "echo.example"
+	address := append([]byte{socksDomain, byte(len(name))}, name...)
+	address = binary.BigEndian.AppendUint16(address, uint16(target.Port))
+	conn, _ := socksRequest(t, proxy, socksConnect, address, "ping")
+	expectEcho(t, conn)
+}
+
+func TestSOCKSUDPAssociate(t *testing.T) {
+	target, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(localAddress(t))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		buffer := make([]byte, 1500)
+		for {
+			n, peer, err := target.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			target.WriteTo(buffer[:n], peer)
+		}
+	}()
+	proxy := startSOCKS(t, "")
+
+	socket, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socket.Close()
+	// The client announces the port it sends from
+	announced := ipv4Address(net.IPv4zero, socket.LocalAddr().(*net.UDPAddr).Port)
+	_, relay := socksRequest(t, proxy, socksUDPAssociate, announced, "")
+	targetAddr := target.LocalAddr().(*net.UDPAddr)
+	datagram := append([]byte{0, 0, 0}, ipv4Address(targetAddr.IP, targetAddr.Port)...)
+	datagram = append(datagram, "ping"...)
+
+	// Datagrams from other ports than the announced one are not relayed
+	other, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	_, err = other.WriteTo(datagram, relay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buffer := make([]byte, 1500)
+	other.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	if _, err := other.Read(buffer); err == nil {
+		t.Error("a datagram from another port was relayed")
+	}
+
+	_, err = socket.WriteTo(datagram, relay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket.SetReadDeadline(time.Now().Add(10 * time.Second))
+	n, err := socket.Read(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The reply is prefixed with the address it came from
+	expected := append([]byte{0, 0, 0}, ipv4Address(targetAddr.IP, targetAddr.Port)...)
+	expected = append(expected, "ping"...)
+	if !bytes.Equal(buffer[:n], expected) {
+		t.Fatalf("got %x, expected %x", buffer[:n], expected)
+	}
+}
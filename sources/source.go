@@ -3,46 +3,234 @@ package sources
 import (
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
+
+	bizarre "github.com/CapacitorSet/bizarre-net"
 )
 
+// maxChunk is the largest payload that MessageWriter puts in a single message.
+const maxChunk = 1024
+
+// Source produces messages to be sent through the tunnel, and handles the messages received on its stream.
+// The client sets the stream ID of the messages.
 type Source interface {
-	Start(chan []byte)
-	Write([]byte) error
+	// Start sends the messages of the source to the channel. It returns nil when the source has nothing more to
+	// send or was closed, and an error if it fails.
+	Start(chan bizarre.Message) error
+	Write(bizarre.Message) error
+	// Close stops the source and undoes its changes to the host, such as routes.
+	Close() error
+}
+
+// Finisher is implemented by sources that complete, such as remote commands. Done yields the exit status.
+type Finisher interface {
+	Done() <-chan int
+}
+
+// MessageSender sends messages to the other end of the tunnel.
+type MessageSender interface {
+	Send(bizarre.Message) error
+}
+
+// MessageWriter is an io.Writer that sends what is written to it as messages of the given type.
+type MessageWriter struct {
+	Sender MessageSender
+	Type   bizarre.MessageType
+}
+
+func (w MessageWriter) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		end := written + maxChunk
+		if end > len(p) {
+			end = len(p)
+		}
+		err := w.Sender.Send(bizarre.Message{Type: w.Type, Payload: p[written:end]})
+		if err != nil {
+			return written, err
+		}
+		written = end
+	}
+	return written, nil
 }
 
 type SourceConfig struct {
-	TUNConfig TUNConfig
+	TUNConfig     TUNConfig
+	TAPConfig     TAPConfig
 	CmdExecConfig CmdExecConfig
+	ShellConfig   ShellConfig
+	FileConfig    FileConfig
+
+	NetstackConfig NetstackConfig
+	SOCKSConfig    SOCKSConfig
+	ForwardConfig  ForwardConfig
+}
+
+// logger returns the logger of the sources: the default one, tagged with their subsystem.
+func logger() *slog.Logger {
+	return slog.Default().With(bizarre.SubsystemKey, bizarre.SubsystemSource)
+}
+
+// PrintsOutput returns whether a source prints to the standard streams, which per-packet logs would garble.
+func (config SourceConfig) PrintsOutput() bool {
+	return config.CmdExecConfig.Command != "" || config.ShellConfig.Enabled || config.FileConfig.enabled()
+}
+
+// LimitMTU fits the packets and frames of the network sources, as well as the chunks of file transfers, in the
+// messages of the transports, given the size of the largest message they carry (0 if unlimited), unless their MTU was
+// set explicitly.
+func (config *SourceConfig) LimitMTU(maxPayload int) error {
+	if maxPayload == 0 || maxPayload > bizarre.MESSAGE_HEADER_SIZE+0xffff {
+		maxPayload = bizarre.MESSAGE_HEADER_SIZE + 0xffff // The length of a message is 16 bits
+	}
+	mtu := maxPayload - bizarre.MESSAGE_HEADER_SIZE
+	if mtu > defaultMTU {
+		// Larger packets would only be fragmented by the other side
+		mtu = defaultMTU
+	}
+	// Minimum MTU is 68 per RFC (60 bytes of IP header + 8 bytes of payload)
+	if mtu < 68 {
+		return fmt.Errorf("the transport cannot carry IP packets: MTU %d < 68", mtu)
+	}
+	if mtu < 1280 {
+		logger().Warn("The MTU is too low for IPv6, which needs 1280", "mtu", mtu)
+	}
+	if config.TUNConfig.MTU == 0 {
+		config.TUNConfig.MTU = mtu
+	}
+	if config.TAPConfig.MTU == 0 {
+		config.TAPConfig.MTU = mtu - ethernetOverhead
+	}
+	if config.NetstackConfig.MTU == 0 {
+		config.NetstackConfig.MTU = mtu
+	}
+	if config.FileConfig.ChunkSize == 0 {
+		config.FileConfig.ChunkSize = min(maxPayload-bizarre.MESSAGE_HEADER_SIZE-fileChunkHeader, FileChunkSize)
+	}
+	return nil
+}
+
+// ExcludeEndpoints keeps the given addresses, which the transports send messages to, out of the routes of the TUN.
+func (config *SourceConfig) ExcludeEndpoints(endpoints []net.IP) {
+	config.TUNConfig.endpoints = endpoints
 }
 
 // PartialConfigFromFlags binds a flagset to a SourceConfig struct, so that the config is filled upon parsing the flags.
 func PartialConfigFromFlags(config *SourceConfig, flags *flag.FlagSet) {
 	flags.StringVar(&config.TUNConfig.Name, "tun", "", "Name of the TUN interface (allows general-purpose navigation; requires root)")
-	flags.StringVar(&config.TUNConfig.IP, "tun-ip", "", "TUN address in subnet form (eg. 192.168.100.1/24)")
+	flags.StringVar(&config.TUNConfig.IP, "tun-ip", "", "TUN addresses in subnet form, comma-separated (eg. 192.168.100.1/24,fd00::1/64)")
 	flags.BoolVar(&config.TUNConfig.DefaultRoute, "default-route", true, "Route all traffic to the TUN interface")
+	flags.Var(&config.TUNConfig.Routes, "route", "Prefixes to route through the TUN, comma-separated (repeatable)")
+	flags.Var(&config.TUNConfig.Exclude, "exclude", "Prefixes that are not routed through the TUN, comma-separated (repeatable)")
+	flags.IntVar(&config.TUNConfig.Table, "route-table", 0, "Routing table for the routes of the TUN (default: the main table, or the -fwmark value)")
+	flags.Var((*markValue)(&config.TUNConfig.FwMark), "fwmark", "Only route packets with this firewall mark through the TUN, using policy routing")
+	flags.IntVar(&config.TUNConfig.MTU, "tun-mtu", 0, "MTU of the TUN interface (default: the largest packet that the transport carries)")
+	flags.StringVar(&config.TAPConfig.Name, "tap", "", "Name of a TAP interface, which carries Ethernet frames to bridge LANs (requires root)")
+	flags.StringVar(&config.TAPConfig.IP, "tap-ip", "", "TAP address in subnet form (optional)")
+	flags.StringVar(&config.TAPConfig.Bridge, "tap-bridge", "", "Linux bridge to add the TAP interface to")
 
 	flags.StringVar(&config.CmdExecConfig.Command, "cmd", "", "Command to run on the remote host")
+	flags.BoolVar(&config.ShellConfig.Enabled, "shell", false, "Open an interactive shell on the remote host")
+
+	flags.StringVar(&config.FileConfig.List, "ls", "", "List a directory on the remote host")
+	flags.StringVar(&config.FileConfig.Stat, "stat", "", "Show information about a file on the remote host")
+	flags.StringVar(&config.FileConfig.Get, "get", "", "Download a file from the remote host")
+	flags.StringVar(&config.FileConfig.Put, "put", "", "Upload a file to the remote host")
+	flags.StringVar(&config.FileConfig.To, "to", "", "Destination of -get or -put (default: the base name of the file)")
+	flags.BoolVar(&config.FileConfig.Resume, "resume", false, "Resume an interrupted -get or -put")
+
+	flags.StringVar(&config.SOCKSConfig.Address, "socks", "", "Run a SOCKS5 proxy through the tunnel on this address (eg. 127.0.0.1:1080)")
+	flags.Var(&config.ForwardConfig.Local, "L", "Forward a local port through the tunnel, as [bind_address:]port:host:hostport[/udp] (repeatable)")
+	flags.Var(&config.ForwardConfig.Remote, "R", "Forward a port of the server to the client side, as [bind_address:]port:host:hostport[/udp] (repeatable)")
+	flags.StringVar(&config.NetstackConfig.IP, "netstack-ip", "", "Address in the tunnel of the userspace network stack (default: assigned by the server on clients, "+ServerNetstackIP+" on servers)")
+	flags.StringVar(&config.NetstackConfig.DNS, "netstack-dns", "1.1.1.1:53", "DNS server used to resolve names through the tunnel")
 }
 
-// NewSource creates a Source from a SourceConfig.
-func NewSource(config SourceConfig) (Source, error) {
-	// todo: handle multiple sources
+// NewSources creates every Source that is configured in a SourceConfig.
+func NewSources(config SourceConfig) (_ []Source, err error) {
+	var ret []Source
+	defer func() {
+		if err != nil {
+			// Undo the changes of the sources that were created, such as the routes of a TUN
+			for _, source := range ret {
+				source.Close()
+			}
+		}
+	}()
 	if config.TUNConfig.Name != "" {
 		tun, err := CreateTUN(config.TUNConfig)
 		if err != nil {
 			return nil, err
 		}
-		log.Printf("New interface: %s with IP %s", tun.Name, tun.IP.String())
-		return &tun, nil
-	} else if config.CmdExecConfig.Command != "" {
+		logger().Info("New interface", "name", tun.Name, "ip", tun.AddressString())
+		ret = append(ret, &tun)
+	}
+	if config.TAPConfig.Name != "" {
+		tap, err := CreateTAP(config.TAPConfig)
+		if err != nil {
+			return nil, err
+		}
+		logger().Info("New TAP interface", "name", tap.Name)
+		ret = append(ret, &tap)
+	}
+	if config.CmdExecConfig.Command != "" {
 		cmd, err := CreateCmdExec(config.CmdExecConfig)
 		if err != nil {
 			return nil, err
 		}
-		log.Printf("Running command %s", cmd.Command)
-		return &cmd, nil
-	} else {
+		logger().Info("Running command", "command", cmd.Command)
+		ret = append(ret, &cmd)
+	}
+	if config.ShellConfig.Enabled {
+		shell, err := CreateShell(config.ShellConfig)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, &shell)
+	}
+	if config.FileConfig.enabled() {
+		files, err := CreateFileTransfer(config.FileConfig)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, files)
+	}
+	var services []Service
+	if config.SOCKSConfig.Address != "" {
+		services = append(services, &SOCKSServer{config.SOCKSConfig})
+	}
+	for _, spec := range config.ForwardConfig.Local {
+		forward, err := ParseForward(spec)
+		if err != nil {
+			return nil, err
+		}
+		services = append(services, &LocalForward{forward})
+	}
+	for _, spec := range config.ForwardConfig.Remote {
+		forward, err := ParseForward(spec)
+		if err != nil {
+			return nil, err
+		}
+		services = append(services, NewRemoteForward(forward))
+	}
+	if len(services) != 0 {
+		// The services share a userspace network stack, whose address is assigned by the server unless it is given
+		config.NetstackConfig.Enabled = true
+		netstack, err := CreateNetstack(config.NetstackConfig)
+		if err != nil {
+			return nil, err
+		}
+		netstack.Services = services
+		if config.NetstackConfig.IP != "" {
+			logger().Info("New userspace network stack", "ip", config.NetstackConfig.IP)
+		} else {
+			logger().Info("New userspace network stack, waiting for an address from the server")
+		}
+		ret = append(ret, netstack)
+	}
+	if len(ret) == 0 {
 		return nil, fmt.Errorf("no source selected")
 	}
-}
\ No newline at end of file
+	return ret, nil
+}
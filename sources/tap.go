@@ -0,0 +1,122 @@
+package sources
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	bizarre "github.com/CapacitorSet/bizarre-net"
+	"github.com/milosgajdos/tenus"
+	"github.com/songgao/water"
+)
+
+type TAPConfig struct {
+	Name   string // The name of the network interface
+	IP     string // The address and netmask in CIDR notation, if any; interfaces in a bridge usually have none
+	Bridge string // The name of a Linux bridge to add the interface to, if any
+	MTU    int    // 0 to fit the frames in the messages of the transport
+}
+
+// The Ethernet header and a VLAN tag, which frames carry on top of the MTU
+const ethernetOverhead = 14 + 4
+
+// TAPSource carries Ethernet frames rather than IP packets, so that it can bridge two LANs and non-IP protocols.
+type TAPSource struct {
+	TAP  *water.Interface
+	Name string
+	MTU  int
+}
+
+func (S *TAPSource) Start(ch chan bizarre.Message) error {
+	buffer := make([]byte, S.MTU+ethernetOverhead)
+	for {
+		n, err := S.TAP.Read(buffer)
+		if errors.Is(err, os.ErrClosed) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("reading from %s: %w", S.Name, err)
+		}
+		// Frames are processed concurrently with the next read, so each one needs a copy
+		ch <- bizarre.Message{Type: bizarre.MessageEthernet, Payload: append([]byte(nil), buffer[:n]...)}
+	}
+}
+
+// Close closes the TAP, which deletes the interface.
+func (S *TAPSource) Close() error {
+	return S.TAP.Close()
+}
+
+func (S *TAPSource) Write(msg bizarre.Message) error {
+	if msg.Type != bizarre.MessageEthernet {
+		return fmt.Errorf("unexpected %s message", msg.Type)
+	}
+	_, err := S.TAP.Write(msg.Payload)
+	return err
+}
+
+var (
+	_ Source = (*TAPSource)(nil) // Ensure that interface fields are implemented
+)
+
+// CreateTAP creates a TAP with the given config, if Name != "".
+func CreateTAP(config TAPConfig) (TAPSource, error) {
+	if config.Name == "" {
+		return TAPSource{}, nil
+	}
+
+	ioctlLock.Lock()
+	defer ioctlLock.Unlock()
+
+	if _, err := net.InterfaceByName(config.Name); err == nil {
+		return TAPSource{}, fmt.Errorf("an interface with this name already exists")
+	}
+
+	tap, err := water.New(water.Config{
+		DeviceType: water.TAP,
+		PlatformSpecificParams: water.PlatformSpecificParams{
+			Name: config.Name,
+		},
+	})
+	if err != nil {
+		return TAPSource{}, fmt.Errorf("creating TAP: %w", err)
+	}
+
+	link, err := tenus.NewLinkFrom(config.Name)
+	if err != nil {
+		return TAPSource{}, fmt.Errorf("reading TAP: %w", err)
+	}
+	if config.IP != "" {
+		ip, subnet, err := net.ParseCIDR(config.IP)
+		if err != nil {
+			return TAPSource{}, fmt.Errorf("parsing TAP subnet: %w", err)
+		}
+		err = link.SetLinkIp(ip, subnet)
+		if err != nil {
+			return TAPSource{}, fmt.Errorf("configuring TAP: %w", err)
+		}
+	}
+	if config.Bridge != "" {
+		bridge, err := tenus.BridgeFromName(config.Bridge)
+		if err != nil {
+			return TAPSource{}, fmt.Errorf("finding bridge %s: %w", config.Bridge, err)
+		}
+		err = bridge.AddSlaveIfc(link.NetInterface())
+		if err != nil {
+			return TAPSource{}, fmt.Errorf("adding TAP to bridge %s: %w", config.Bridge, err)
+		}
+	}
+	if config.MTU == 0 {
+		config.MTU = defaultMTU
+	}
+	err = link.SetLinkMTU(config.MTU)
+	if err != nil {
+		return TAPSource{}, fmt.Errorf("setting TAP MTU: %w", err)
+	}
+	err = link.SetLinkUp()
+	if err != nil {
+		return TAPSource{}, fmt.Errorf("configuring TAP: %w", err)
+	}
+
+	return TAPSource{TAP: tap, Name: config.Name, MTU: config.MTU}, nil
+}
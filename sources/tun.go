@@ -1,53 +1,94 @@
 package sources
 
 import (
+	"errors"
 	"fmt"
-	"log"
 	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 
+	bizarre "github.com/CapacitorSet/bizarre-net"
 	"github.com/milosgajdos/tenus"
 	"github.com/songgao/water"
 )
 
+// The MTU of interfaces whose MTU is not set
+const defaultMTU = 1500
+
 type TUNConfig struct {
-	Name         string // The name of the network interface
-	IP           string // The address and netmask in CIDR notation, eg. "10.0.0.1/24"
-	DefaultRoute bool
+	Name         string     // The name of the network interface
+	IP           string     // The addresses and netmasks in CIDR notation, comma-separated, eg. "10.0.0.1/24,fd00::1/64"
+	DefaultRoute bool       // Route all traffic through the TUN
+	Routes       PrefixList // Prefixes to route through the TUN, eg. "10.1.0.0/16"
+	Exclude      PrefixList // Prefixes that keep their current route
+	Table        int        // The routing table of the routes (default: the main table, or FwMark if set)
+	FwMark       uint32     // If not 0, only packets with this firewall mark use the routes
+	MTU          int        // 0 to fit the packets in the messages of the transport
+
+	endpoints []net.IP // The endpoints of the transports, which must not be routed through the TUN
 }
 
 type TUNSource struct {
 	TUN        *water.Interface
 	Name       string
-	*net.IPNet // IP and netmask
+	*net.IPNet // The first IP and netmask
+	Addresses  []*net.IPNet
+	MTU        int
+
+	routing routing
 }
 
-func (S *TUNSource) Start(ch chan []byte) {
-	buffer := make([]byte, 4096)
+func (S *TUNSource) Start(ch chan bizarre.Message) error {
+	buffer := make([]byte, S.MTU)
 	for {
 		n, err := S.TUN.Read(buffer)
-		if err != nil {
-			log.Printf("tunLoop: " + err.Error())
-			continue
+		if errors.Is(err, os.ErrClosed) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("reading from %s: %w", S.Name, err)
 		}
-		ch <- buffer[:n]
+		// Packets are processed concurrently with the next read, so each one needs a copy
+		packet := append([]byte(nil), buffer[:n]...)
+		bizarre.ClampMSS(packet, S.MTU)
+		ch <- bizarre.Message{Type: bizarre.MessageIP, Payload: packet}
 	}
 }
 
-func (S *TUNSource) Write(buf []byte) error {
-	_, err := S.TUN.Write(buf)
+func (S *TUNSource) Write(msg bizarre.Message) error {
+	if msg.Type != bizarre.MessageIP {
+		return fmt.Errorf("unexpected %s message", msg.Type)
+	}
+	// Hosts behind the TUN must not send segments that the transport cannot carry back either
+	bizarre.ClampMSS(msg.Payload, S.MTU)
+	_, err := S.TUN.Write(msg.Payload)
 	return err
 }
 
+// AddressString lists the addresses of the TUN, eg. "10.0.0.1, fd00::1".
+func (S *TUNSource) AddressString() string {
+	ips := make([]string, len(S.Addresses))
+	for i, address := range S.Addresses {
+		ips[i] = address.IP.String()
+	}
+	return strings.Join(ips, ", ")
+}
+
+// Close removes the routes of the TUN and closes it.
+func (S *TUNSource) Close() error {
+	err := S.routing.remove()
+	return errors.Join(err, S.TUN.Close())
+}
+
 var (
 	_ Source = (*TUNSource)(nil) // Ensure that interface fields are implemented
 
 	ioctlLock = &sync.Mutex{}
 )
 
-
 // CreateTUN creates a TUN with the given config, if Name != "".
-func CreateTUN(config TUNConfig) (TUNSource, error) {
+func CreateTUN(config TUNConfig) (_ TUNSource, err error) {
 	if config.Name == "" {
 		return TUNSource{}, nil
 	}
@@ -75,35 +116,95 @@ func CreateTUN(config TUNConfig) (TUNSource, error) {
 	if err != nil {
 		return TUNSource{}, fmt.Errorf("creating TUN: %w", err)
 	}
+	defer func() {
+		if err != nil {
+			tun.Close()
+		}
+	}()
 
 	link, err := tenus.NewLinkFrom(config.Name)
 	if err != nil {
 		return TUNSource{}, fmt.Errorf("reading TUN: %w", err)
 	}
-	ip, subnet, err := net.ParseCIDR(config.IP)
+	addresses, err := parseAddresses(config.IP)
 	if err != nil {
 		return TUNSource{}, fmt.Errorf("parsing TUN subnet: %w", err)
 	}
-	subnet.IP = ip
-	err = link.SetLinkIp(ip, subnet)
+	err = disableAutoconf(config.Name)
 	if err != nil {
 		return TUNSource{}, fmt.Errorf("configuring TUN: %w", err)
 	}
+	for _, address := range addresses {
+		err = link.SetLinkIp(address.IP, address)
+		if err != nil {
+			return TUNSource{}, fmt.Errorf("configuring TUN: %w", err)
+		}
+	}
+	if config.MTU == 0 {
+		config.MTU = defaultMTU
+	}
+	err = link.SetLinkMTU(config.MTU)
+	if err != nil {
+		return TUNSource{}, fmt.Errorf("setting TUN MTU: %w", err)
+	}
 	err = link.SetLinkUp()
 	if err != nil {
 		return TUNSource{}, fmt.Errorf("configuring TUN: %w", err)
 	}
 
-	if config.DefaultRoute {
-		err = link.SetLinkDefaultGw(&ip)
-		if err != nil {
-			return TUNSource{}, fmt.Errorf("creating default route: %w", err)
-		}
+	routing, err := setRoutes(config, link.NetInterface().Index, addresses)
+	if err != nil {
+		routing.remove()
+		return TUNSource{}, err
 	}
 
 	return TUNSource{
-		TUN:   tun,
-		Name:  config.Name,
-		IPNet: subnet,
+		TUN:       tun,
+		Name:      config.Name,
+		IPNet:     addresses[0],
+		Addresses: addresses,
+		MTU:       config.MTU,
+		routing:   routing,
 	}, nil
 }
+
+// parseAddresses parses a comma-separated list of addresses in CIDR notation. Unlike with net.ParseCIDR, the IPs keep
+// their host part.
+func parseAddresses(list string) ([]*net.IPNet, error) {
+	var addresses []*net.IPNet
+	for _, cidr := range strings.Split(list, ",") {
+		ip, subnet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, err
+		}
+		subnet.IP = ip
+		addresses = append(addresses, subnet)
+	}
+	return addresses, nil
+}
+
+// disableAutoconf stops the kernel from sending router solicitations and neighbor discovery probes on the interface,
+// and from configuring it from router advertisements: the tunnel is point-to-point, and addresses are static. DAD is
+// disabled too, so that IPv6 addresses are usable as soon as the interface is up.
+func disableAutoconf(name string) error {
+	dir := filepath.Join("/proc/sys/net/ipv6/conf", name)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		// IPv6 is disabled on this host
+		return nil
+	}
+	settings := map[string]string{
+		"accept_ra":            "0",
+		"autoconf":             "0",
+		"router_solicitations": "0",
+		"accept_dad":           "0",
+		"dad_transmits":        "0",
+		"addr_gen_mode":        "1", // No link-local address
+	}
+	for setting, value := range settings {
+		err := os.WriteFile(filepath.Join(dir, setting), []byte(value), 0644)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("setting %s: %w", setting, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package sources
+
+import (
+	"testing"
+)
+
+func TestParseAddresses(t *testing.T) {
+	addresses, err := parseAddresses("10.0.0.2/24, fd00::2/64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"10.0.0.2/24", "fd00::2/64"}
+	if len(addresses) != len(expected) {
+		t.Fatalf("got %v, expected %v", addresses, expected)
+	}
+	for i, address := range addresses {
+		if address.String() != expected[i] {
+			t.Errorf("got %s, expected %s", address, expected[i])
+		}
+	}
+	for _, list := range []string{"", "10.0.0.2", "10.0.0.2/24,"} {
+		if _, err := parseAddresses(list); err == nil {
+			t.Errorf("%q: expected an error", list)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package generic
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"github.com/CapacitorSet/bizarre-net/lib/client"
 	"io/ioutil"
@@ -26,6 +27,13 @@ func waitErrChan(t *testing.T, ch chan *rpc.Call) {
 	}
 }
 
+// requireInterface skips the test unless it runs in the network namespace created by tools/setup.
+func requireInterface(t *testing.T, name string) {
+	if _, err := net.InterfaceByName(name); err != nil {
+		t.Skipf("%s not found: set up the environment with tools/setup and run the test in its namespace", name)
+	}
+}
+
 type HostConfig struct {
 	Config string
 	TunIP  string
@@ -39,6 +47,8 @@ type TestConfig struct {
 type EmptyArgs struct{}
 
 func (T TestConfig) ClientTest(t *testing.T) {
+	requireInterface(t, "ceth0")
+
 	// Launch client
 	clientConfigFile, err := ioutil.TempFile("", "ClientTest")
 	if err != nil {
@@ -52,7 +62,11 @@ func (T TestConfig) ClientTest(t *testing.T) {
 		t.Fatal(err)
 	}
 	log.Println("Creating client")
-	client, err := client.NewClient(clientConfigFile.Name(), nil)
+	clientConfig, err := client.ReadConfig(clientConfigFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := client.NewClient(clientConfig)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -82,9 +96,9 @@ func (T TestConfig) ClientTest(t *testing.T) {
 
 	log.Println("Launching client")
 	go func() {
-		err := client.Run()
+		err := client.Run(context.Background())
 		if err != nil {
-			t.Fatal(err)
+			t.Error(err)
 		}
 	}()
 
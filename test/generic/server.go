@@ -1,6 +1,7 @@
 package generic
 
 import (
+	"context"
 	"fmt"
 	"github.com/CapacitorSet/bizarre-net/lib/server"
 	"io/ioutil"
@@ -31,7 +32,12 @@ func (S *Server) New(args *EmptyArgs, reply *error) error {
 		S.Error(err)
 		return err
 	}
-	srv, err := server.NewServer(serverConfigFile.Name(), nil)
+	serverConfig, err := server.ReadConfig(serverConfigFile.Name())
+	if err != nil {
+		S.Error(err)
+		return err
+	}
+	srv, err := server.NewServer(serverConfig)
 	if err != nil {
 		S.Error(err)
 		return err
@@ -41,7 +47,7 @@ func (S *Server) New(args *EmptyArgs, reply *error) error {
 }
 
 func (S Server) Run(args *EmptyArgs, reply *error) error {
-	err := S.Server.Run()
+	err := S.Server.Run(context.Background())
 	if err != nil {
 		S.Error(err)
 		return err
@@ -77,7 +83,9 @@ func (S Server) RPCStop(args *EmptyArgs, reply *error) error {
 }
 
 func (T TestConfig) ServerTest(t *testing.T) {
-	server := &Server{TestConfig: T, T: t, Server: nil, doneChan: make(chan bool, 1)}
+	requireInterface(t, "seth0")
+
+	server := &Server{TestConfig: T, T: t, doneChan: make(chan bool, 1)}
 	err := rpc.Register(server)
 	if err != nil {
 		t.Fatal(err)
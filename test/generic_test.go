@@ -41,3 +41,7 @@ func TestUDP(t *testing.T) {
 	testServer(t, "udp")
 }
 
+
+func TestUDP6(t *testing.T) {
+	testServer(t, "udp6")
+}
@@ -5,16 +5,16 @@ import (
 	"testing"
 )
 
-const clientConfig = `Transport = "udp"
-SendHello = false
+const clientConfig = `transport = ["udp"]
+sendHello = false
 
 [tun]
-Prefix = "testbizarre"
-IP = "20.20.20.1/24"
-SetDefaultGW = false
+name = "testbizarre0"
+ip = "20.20.20.1/24"
+defaultRoute = false
 
 [udp]
-IP = "192.168.1.2:1917"`
+endpoint = "192.168.1.2:1917"`
 
 var testConfig = generic.TestConfig{
 	Client: generic.HostConfig{
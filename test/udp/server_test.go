@@ -4,14 +4,14 @@ import (
 	"testing"
 )
 
-const serverConfig = `Transport = "udp"
+const serverConfig = `transport = ["udp"]
 
 [tun]
-Prefix = "testbizarre"
-IP = "20.20.20.2/24"
+name = "testbizarre1"
+ip = "20.20.20.2/24"
 
 [udp]
-IP = "0.0.0.0:1917"`
+endpoint = "0.0.0.0:1917"`
 
 func TestServer(t *testing.T) {
 	testConfig.ServerTest(t)
@@ -0,0 +1,35 @@
+package udp6
+
+import (
+	"github.com/CapacitorSet/bizarre-net/test/generic"
+	"testing"
+)
+
+// The tunnel is dual-stack, and the test requests go over IPv6
+const clientConfig = `transport = ["udp"]
+sendHello = false
+
+[tun]
+name = "testbizarre0"
+ip = "20.20.20.1/24,fd20::1/64"
+defaultRoute = false
+
+[udp]
+endpoint = "192.168.1.1:1917"`
+
+var testConfig = generic.TestConfig{
+	Client: generic.HostConfig{
+		Config: clientConfig,
+		TunIP:  "fd20::1",
+		VethIP: "192.168.1.2",
+	},
+	Server: generic.HostConfig{
+		Config: serverConfig,
+		TunIP:  "fd20::2",
+		VethIP: "192.168.1.1",
+	},
+}
+
+func TestClient(t *testing.T) {
+	testConfig.ClientTest(t)
+}
@@ -0,0 +1,19 @@
+package udp6
+
+import (
+	"testing"
+)
+
+const serverConfig = `transport = ["udp"]
+
+[tun]
+name = "testbizarre1"
+ip = "20.20.20.2/24,fd20::2/64"
+defaultRoute = false
+
+[udp]
+endpoint = "0.0.0.0:1917"`
+
+func TestServer(t *testing.T) {
+	testConfig.ServerTest(t)
+}
@@ -2,9 +2,11 @@ package transports
 
 import (
 	"encoding/base32"
+	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"net"
 	"strconv"
 	"strings"
 	"sync"
@@ -13,9 +15,22 @@ import (
 	"github.com/miekg/dns"
 )
 
+// TXT strings are limited to 255 characters, which hold this much base32-encoded data
+const dnsTXTMaxPayload = 255 * 5 / 8
+
+// The labels of domain names are limited to 63 characters, and whole names to 255 bytes in the wire format (254
+// characters with the final dot)
+const (
+	dnsMaxLabel = 63
+	dnsMaxName  = 254
+)
+
 var (
 	_ ServerTransport = (*DNSServerTransport)(nil)
 	_ ClientTransport = (*DNSClientTransport)(nil)
+	_ PayloadLimiter  = (*DNSServerTransport)(nil)
+	_ PayloadLimiter  = (*DNSClientTransport)(nil)
+	_ Queuer          = (*DNSServerTransport)(nil)
 
 	Encoder = base32.HexEncoding.WithPadding(base32.NoPadding)
 )
@@ -27,13 +42,57 @@ type DNSConfig struct {
 	RootDomain string // The DNS domain to be appended
 }
 
+func init() {
+	Register(Registration{
+		Name:       "dns",
+		Preference: 20,
+		NewConfig: func() interface{} {
+			return &DNSConfig{Port: 53, RootDomain: "biz"}
+		},
+		BindFlags: func(config interface{}, flags *flag.FlagSet) {
+			c := config.(*DNSConfig)
+			flags.StringVar(&c.Endpoint, "dns-address", c.Endpoint, "DNS server address")
+			flags.IntVar(&c.Port, "dns-port", c.Port, "DNS server port")
+			flags.StringVar(&c.RootDomain, "dns-root", c.RootDomain, "DNS root domain including TLD")
+		},
+		IsConfigured: func(config interface{}) bool {
+			return config.(*DNSConfig).Endpoint != ""
+		},
+		IsServerConfigured: func(config interface{}) bool {
+			return config.(*DNSConfig).Port != 0
+		},
+		NewServer: func(config interface{}) (ServerTransport, error) {
+			c := config.(*DNSConfig)
+			dns, err := CreateDNSServer(*c)
+			if err != nil {
+				return nil, err
+			}
+			logger().Info("Listening on DNS", "port", c.Port)
+			return &dns, nil
+		},
+		NewClient: func(config interface{}) (ClientTransport, error) {
+			c := config.(*DNSConfig)
+			dns, err := CreateDNSClient(*c)
+			if err != nil {
+				return nil, err
+			}
+			logger().Info("Using DNS transport", "address", c.Endpoint)
+			return &dns, nil
+		},
+		Endpoints: func(config interface{}) ([]net.IP, error) {
+			return net.LookupIP(config.(*DNSConfig).Endpoint)
+		},
+	})
+}
+
 type DNSServerTransport struct {
 	Server dns.Server
 	RootDomain string
 
 	SendQueue
 
-	ch chan<- Packet
+	ch      chan<- Packet
+	packets *slog.Logger
 }
 
 // SendQueue is a structure that stores packets waiting to be sent.
@@ -47,10 +106,15 @@ type SendQueue struct {
 func (Q *SendQueue) Push(packet Packet) {
 	Q.Lock()
 	Q.queue = append(Q.queue, packet)
-	log.Printf("New queue length: %d", len(Q.queue))
 	Q.Unlock()
 }
 
+func (Q *SendQueue) Len() int {
+	Q.Lock()
+	defer Q.Unlock()
+	return len(Q.queue)
+}
+
 func (Q *SendQueue) TryGet() (ok bool, p Packet) {
 	Q.Lock()
 	if len(Q.queue) == 0 {
@@ -59,7 +123,6 @@ func (Q *SendQueue) TryGet() (ok bool, p Packet) {
 	}
 	ret := Q.queue[0]
 	Q.queue = Q.queue[1:]
-	log.Printf("New queue length: %d", len(Q.queue))
 	Q.Unlock()
 	return true, ret
 }
@@ -68,10 +131,9 @@ func (T *DNSServerTransport) handleDnsRequest(rw dns.ResponseWriter, msg *dns.Ms
 	m := new(dns.Msg)
 	m.SetReply(msg)
 	m.Compress = false
-	domain := strings.TrimSuffix(msg.Question[0].Name, "." + T.RootDomain)
-	data, err := Encoder.DecodeString(domain)
+	data, err := decodeQueryName(msg.Question[0].Name, T.RootDomain)
 	if err != nil {
-		log.Printf("could not interpret string: %s", err)
+		T.packets.Warn("Could not decode DNS query", "error", err)
 		rw.WriteMsg(m)
 		return
 	}
@@ -96,7 +158,7 @@ func (T *DNSServerTransport) handleDnsRequest(rw dns.ResponseWriter, msg *dns.Ms
 		text := Encoder.EncodeToString(pkt.Payload)
 		rr, err := dns.NewRR(fmt.Sprintf("%s TXT %s", "bizarre-net.capacitorset.github.com", text))
 		if err != nil {
-			log.Printf("Failed to send data: %s", err)
+			T.packets.Warn("Could not encode DNS reply", "error", err)
 		} else {
 			m.Answer = append(m.Answer, rr)
 		}
@@ -105,10 +167,20 @@ func (T *DNSServerTransport) handleDnsRequest(rw dns.ResponseWriter, msg *dns.Ms
 	rw.WriteMsg(m)
 }
 
-func (T *DNSServerTransport) Listen(ch chan<- Packet) {
+func (T *DNSServerTransport) Listen(ch chan<- Packet) error {
 	T.ch = ch
 	dns.HandleFunc(".", T.handleDnsRequest)
-	T.Server.ListenAndServe()
+	// Returns nil after Shutdown
+	return T.Server.ListenAndServe()
+}
+
+func (T *DNSServerTransport) Close() error {
+	return T.Server.Shutdown()
+}
+
+// MaxPayload returns the largest payload whose encoding fits in a TXT string.
+func (T *DNSServerTransport) MaxPayload() int {
+	return dnsTXTMaxPayload
 }
 
 func (T *DNSServerTransport) WriteTo(payload []byte, address interface{}) (int, error) {
@@ -116,6 +188,7 @@ func (T *DNSServerTransport) WriteTo(payload []byte, address interface{}) (int,
 		Payload: payload,
 		Address: address,
 	})
+	T.packets.Debug("Queued DNS reply", "queue", T.SendQueue.Len())
 	// todo: wait for the packet to be sent
 	return len(payload), nil
 }
@@ -138,37 +211,55 @@ func (T *DNSServerTransport) WriterTo(address interface{}) io.Writer {
 type DNSClientTransport struct {
 	Endpoint string
 	RootDomain string
+	maxPayload int
 
-	ch chan<- []byte
+	ch        chan<- []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+	packets   *slog.Logger
 }
 
-func (T *DNSClientTransport) Listen(ch chan<- []byte) {
+func (T *DNSClientTransport) MaxPayload() int {
+	return T.maxPayload
+}
+
+// Listen only waits for the transport to be closed: replies arrive in the answers to the queries that Write sends.
+func (T *DNSClientTransport) Listen(ch chan<- []byte) error {
 	T.ch = ch
+	<-T.closed
+	return nil
+}
+
+func (T *DNSClientTransport) Close() error {
+	T.closeOnce.Do(func() { close(T.closed) })
+	return nil
 }
 
 func (T *DNSClientTransport) Write(payload []byte) (int, error) {
 	// Encode the payload as base32 (which is DNS-safe) and add a root domain for correct routing (can be just "." if there are no relays)
-	domain := Encoder.EncodeToString(payload) + "." + T.RootDomain
-	if len(payload) > 255 {
-		return 0, fmt.Errorf("payload too long for DNS")
+	if len(payload) > T.maxPayload {
+		return 0, fmt.Errorf("payload too long for DNS: %d > %d bytes", len(payload), T.maxPayload)
 	}
+	domain := encodeQueryName(payload, T.RootDomain)
 	m := new(dns.Msg)
 	m.SetQuestion(domain, dns.TypeTXT)
 	reply, err := dns.Exchange(m, T.Endpoint)
+	if err != nil {
+		return 0, err
+	}
 	if len(reply.Answer) != 0 {
 		if t, ok := reply.Answer[0].(*dns.TXT); ok {
 			data, err := Encoder.DecodeString(t.Txt[0])
 			if err != nil {
-				log.Printf("Failed to parse reply: %s", err)
+				T.packets.Warn("Could not decode DNS reply", "error", err)
 			} else {
-				log.Printf("Sending %x on %#v", data, T.ch)
 				T.ch <- data
 			}
 		} else {
-			log.Printf("Response is not a TXT record")
+			T.packets.Warn("DNS reply is not a TXT record")
 		}
 	}
-	return len(payload), err
+	return len(payload), nil
 }
 
 func CreateDNSServer(config DNSConfig) (DNSServerTransport, error) {
@@ -178,24 +269,56 @@ func CreateDNSServer(config DNSConfig) (DNSServerTransport, error) {
 			Net: "udp",
 		},
 		RootDomain: config.RootDomain + ".",
+		packets:    packetLogger(),
 	}, nil
 }
 
-func CreateDNSClient(config DNSConfig) (DNSClientTransport, error) {
-	l := 0
-	mtu := 0
-	// Find the MTU such that the whole domain is under 255 bytes
-	for l < 255 {
-		mtu += 1
-		l = Encoder.EncodedLen(mtu) + len(config.RootDomain + ".")
+// encodeQueryName encodes a payload as a domain name under the root domain (which ends with a dot), splitting it into
+// labels of at most 63 characters.
+func encodeQueryName(payload []byte, rootDomain string) string {
+	data := Encoder.EncodeToString(payload)
+	var labels []string
+	for len(data) > dnsMaxLabel {
+		labels = append(labels, data[:dnsMaxLabel])
+		data = data[dnsMaxLabel:]
 	}
-	log.Printf("MTU for DNS should be %d", mtu)
+	labels = append(labels, data, rootDomain)
+	return strings.Join(labels, ".")
+}
+
+// decodeQueryName decodes the payload of a domain name made by encodeQueryName.
+func decodeQueryName(name string, rootDomain string) ([]byte, error) {
+	data := strings.ReplaceAll(strings.TrimSuffix(name, "."+rootDomain), ".", "")
+	return Encoder.DecodeString(data)
+}
+
+// dnsQueryMaxPayload returns the largest payload whose encoding, split into labels and followed by the root domain,
+// fits in a domain name.
+func dnsQueryMaxPayload(rootDomain string) int {
+	payload := 0
+	for {
+		encoded := Encoder.EncodedLen(payload + 1)
+		labels := (encoded + dnsMaxLabel - 1) / dnsMaxLabel
+		// One dot after each label of data
+		if encoded+labels+len(rootDomain) > dnsMaxName {
+			return payload
+		}
+		payload++
+	}
+}
+
+func CreateDNSClient(config DNSConfig) (DNSClientTransport, error) {
+	rootDomain := config.RootDomain + "."
+	maxPayload := dnsQueryMaxPayload(rootDomain)
 	// Minimum MTU is 68 per RFC (60 bytes of IP header + 8 bytes of payload)
-	if mtu < 68 {
-		return DNSClientTransport{}, fmt.Errorf("MTU too low: %d < 68", mtu)
+	if maxPayload < 68 {
+		return DNSClientTransport{}, fmt.Errorf("MTU too low: %d < 68", maxPayload)
 	}
 	return DNSClientTransport{
 		Endpoint: fmt.Sprintf("%s:%d", config.Endpoint, config.Port),
-		RootDomain: config.RootDomain + ".",
+		RootDomain: rootDomain,
+		maxPayload: maxPayload,
+		closed: make(chan struct{}),
+		packets: packetLogger(),
 	}, nil
 }
\ No newline at end of file
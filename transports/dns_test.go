@@ -0,0 +1,37 @@
+package transports
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// TestDNSQueryMaxPayload checks that a query carrying the largest payload can be packed, and decodes to the payload.
+func TestDNSQueryMaxPayload(t *testing.T) {
+	for _, rootDomain := range []string{"biz.", "tunnel.example.com."} {
+		client, err := CreateDNSClient(DNSConfig{Endpoint: "127.0.0.1", Port: 53, RootDomain: rootDomain[:len(rootDomain)-1]})
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload := bytes.Repeat([]byte{0xff, 0x00, 0x45}, client.MaxPayload()/3+1)[:client.MaxPayload()]
+		m := new(dns.Msg)
+		m.SetQuestion(encodeQueryName(payload, rootDomain), dns.TypeTXT)
+		_, err = m.Pack()
+		if err != nil {
+			t.Fatalf("%s: packing %d bytes: %s", rootDomain, len(payload), err)
+		}
+		decoded, err := decodeQueryName(m.Question[0].Name, rootDomain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decoded, payload) {
+			t.Errorf("%s: decoded %x, expected %x", rootDomain, decoded, payload)
+		}
+
+		// In the wire format, names take a byte more than their text form, for the length of the first label
+		if length := len(encodeQueryName(append(payload, 0), rootDomain)) + 1; length <= 255 {
+			t.Errorf("%s: a payload of %d bytes would fit in %d bytes", rootDomain, len(payload)+1, length)
+		}
+	}
+}
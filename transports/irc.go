@@ -0,0 +1,420 @@
+package transports
+
+import (
+	"bufio"
+	"encoding/ascii85"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	_ ServerTransport = (*IRCServerTransport)(nil)
+	_ ClientTransport = (*IRCClientTransport)(nil)
+)
+
+const (
+	// ircChunkLen is the maximum length of the encoded data in a single line. IRC lines are limited to 512 bytes,
+	// and the server prepends the sender's "nick!user@host" when relaying, so we keep a generous margin.
+	ircChunkLen = 320
+	// ircBurst is how many lines can be sent back-to-back before rate limiting kicks in
+	ircBurst = 5
+	// ircMaxPayload is the largest packet sent over IRC, the size of the largest IP packet
+	ircMaxPayload = 65535
+	// ircMaxChunks is the number of lines that the largest packet takes, with base85 (the longer encoding)
+	ircMaxChunks = ((ircMaxPayload+3)/4*5 + ircChunkLen - 1) / ircChunkLen
+	// ircMaxPartial is how many senders can have a partially received packet at the same time
+	ircMaxPartial = 64
+)
+
+type IRCConfig struct {
+	Server   string        // The IRC server to connect to, eg. "irc.example.com:6667"
+	Nick     string        // Our nickname
+	Peer     string        // The nickname of the bizarre-net server (clients only)
+	Encoding string        // How packets are encoded in text lines: "base64" or "base85"
+	Interval time.Duration // The minimum interval between lines after the initial burst, to avoid flood kicks
+}
+
+func init() {
+	Register(Registration{
+		Name:       "irc",
+		Preference: 40,
+		NewConfig: func() interface{} {
+			return &IRCConfig{Encoding: "base64", Interval: 500 * time.Millisecond}
+		},
+		BindFlags: func(config interface{}, flags *flag.FlagSet) {
+			c := config.(*IRCConfig)
+			flags.StringVar(&c.Server, "irc-server", c.Server, "IRC server address (eg. irc.example.com:6667)")
+			flags.StringVar(&c.Nick, "irc-nick", c.Nick, "IRC nickname (random for clients if empty)")
+			flags.StringVar(&c.Peer, "irc-peer", c.Peer, "IRC nickname of the bizarre-net server")
+			flags.StringVar(&c.Encoding, "irc-encoding", c.Encoding, "Encoding of packets in IRC messages (base64 or base85)")
+			flags.DurationVar(&c.Interval, "irc-interval", c.Interval, "Minimum interval between IRC messages, to avoid flood kicks")
+		},
+		IsConfigured: func(config interface{}) bool {
+			return config.(*IRCConfig).Server != ""
+		},
+		NewServer: func(config interface{}) (ServerTransport, error) {
+			c := config.(*IRCConfig)
+			irc, err := CreateIRCServer(*c)
+			if err != nil {
+				return nil, err
+			}
+			logger().Info("Listening on IRC", "server", c.Server, "nick", c.Nick)
+			return &irc, nil
+		},
+		NewClient: func(config interface{}) (ClientTransport, error) {
+			c := config.(*IRCConfig)
+			irc, err := CreateIRCClient(*c)
+			if err != nil {
+				return nil, err
+			}
+			logger().Info("Using IRC transport", "server", c.Server)
+			return &irc, nil
+		},
+		Endpoints: func(config interface{}) ([]net.IP, error) {
+			return hostIPs(config.(*IRCConfig).Server)
+		},
+	})
+}
+
+// rateLimiter implements the classic ircd flood control: each line costs Interval, and the sender may be at most
+// ircBurst lines ahead of the current time.
+type rateLimiter struct {
+	sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+// Wait blocks until a line may be sent.
+func (r *rateLimiter) Wait() {
+	r.Lock()
+	now := time.Now()
+	if r.next.Before(now) {
+		r.next = now
+	}
+	delay := r.next.Sub(now) - ircBurst*r.interval
+	r.next = r.next.Add(r.interval)
+	r.Unlock()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+type ircCodec interface {
+	EncodeToString([]byte) string
+	DecodeString(string) ([]byte, error)
+}
+
+type base85Codec struct{}
+
+func (base85Codec) EncodeToString(src []byte) string {
+	dst := make([]byte, ascii85.MaxEncodedLen(len(src)))
+	n := ascii85.Encode(dst, src)
+	return string(dst[:n])
+}
+
+func (base85Codec) DecodeString(src string) ([]byte, error) {
+	// Every 'z' stands for 4 zero bytes, so the output can be longer than the input
+	dst := make([]byte, 4*len(src))
+	n, _, err := ascii85.Decode(dst, []byte(src), true)
+	if err != nil {
+		return nil, err
+	}
+	return dst[:n], nil
+}
+
+func newIRCCodec(encoding string) (ircCodec, error) {
+	switch encoding {
+	case "", "base64":
+		return base64.RawStdEncoding, nil
+	case "base85":
+		return base85Codec{}, nil
+	default:
+		return nil, fmt.Errorf("unknown IRC encoding %q", encoding)
+	}
+}
+
+// ircFragment is a partially received packet.
+type ircFragment struct {
+	seq    string
+	chunks []string
+	next   int
+}
+
+// ircConn is a registered connection to an IRC server, shared by the client and server transports.
+// Packets are sent as PRIVMSGs of the form "<seq> <index>/<count> <data>", where seq is a per-sender sequence tag
+// and data is a chunk of the encoded packet.
+type ircConn struct {
+	conn    net.Conn
+	codec   ircCodec
+	limiter rateLimiter
+
+	writeLock sync.Mutex // Held while writing a line
+	sendLock  sync.Mutex // Held while sending the lines of a packet, which must not interleave with another one
+	seq       uint16
+
+	// Indexed by the nickname of the sender
+	fragments map[string]*ircFragment
+}
+
+func dialIRC(config IRCConfig) (*ircConn, error) {
+	codec, err := newIRCCodec(config.Encoding)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.Dial("tcp", config.Server)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to IRC server: %w", err)
+	}
+	c := &ircConn{
+		conn:      conn,
+		codec:     codec,
+		limiter:   rateLimiter{interval: config.Interval},
+		fragments: make(map[string]*ircFragment),
+	}
+	c.writeLine("NICK " + config.Nick)
+	c.writeLine("USER " + config.Nick + " 0 * :bizarre-net")
+	return c, nil
+}
+
+// register waits until the server accepts the connection.
+func (c *ircConn) register(reader *bufio.Reader) error {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("registering on IRC server: %w", err)
+		}
+		_, command, params := parseIRCLine(line)
+		switch command {
+		case "001": // RPL_WELCOME
+			return nil
+		case "PING":
+			c.writeLine("PONG :" + strings.Join(params, " "))
+		case "432", "433", "436": // Erroneous nickname, nickname in use, nickname collision
+			return fmt.Errorf("IRC server rejected nickname: %s", strings.Join(params, " "))
+		case "ERROR":
+			return fmt.Errorf("IRC server error: %s", strings.Join(params, " "))
+		}
+	}
+}
+
+func (c *ircConn) writeLine(line string) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	_, err := io.WriteString(c.conn, line+"\r\n")
+	return err
+}
+
+// Send encodes a payload and sends it as one or more PRIVMSGs.
+func (c *ircConn) Send(target string, payload []byte) (int, error) {
+	if len(payload) > ircMaxPayload {
+		return 0, fmt.Errorf("payload too long for IRC: %d > %d bytes", len(payload), ircMaxPayload)
+	}
+	data := c.codec.EncodeToString(payload)
+	count := (len(data) + ircChunkLen - 1) / ircChunkLen
+	if count == 0 {
+		count = 1
+	}
+	c.sendLock.Lock()
+	defer c.sendLock.Unlock()
+	c.seq++
+	seq := strconv.FormatUint(uint64(c.seq), 16)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * ircChunkLen
+		if end > len(data) {
+			end = len(data)
+		}
+		c.limiter.Wait()
+		err := c.writeLine(fmt.Sprintf("PRIVMSG %s :%s %d/%d %s", target, seq, i, count, data[i*ircChunkLen:end]))
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(payload), nil
+}
+
+// receive handles a PRIVMSG, returning the packet if it is complete.
+func (c *ircConn) receive(sender string, text string) ([]byte, error) {
+	fields := strings.SplitN(text, " ", 3)
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("malformed message from %s", sender)
+	}
+	seq, position, data := fields[0], fields[1], fields[2]
+	var index, count int
+	_, err := fmt.Sscanf(position, "%d/%d", &index, &count)
+	if err != nil || index < 0 || index >= count || count > ircMaxChunks || len(data) > ircChunkLen {
+		return nil, fmt.Errorf("malformed sequence tag from %s: %q", sender, position)
+	}
+
+	fragment := c.fragments[sender]
+	if index == 0 {
+		// Lines from a given sender arrive in order, so a new packet replaces any partial one: each sender has at
+		// most one, and only so many senders can have one
+		if fragment == nil && count > 1 && len(c.fragments) >= ircMaxPartial {
+			return nil, fmt.Errorf("too many partial packets, dropping packet %s from %s", seq, sender)
+		}
+		fragment = &ircFragment{seq: seq, chunks: make([]string, count)}
+		c.fragments[sender] = fragment
+	} else if fragment == nil || fragment.seq != seq || fragment.next != index || len(fragment.chunks) != count {
+		delete(c.fragments, sender)
+		return nil, fmt.Errorf("lost part of packet %s from %s", seq, sender)
+	}
+	fragment.chunks[index] = data
+	fragment.next = index + 1
+	if fragment.next < count {
+		return nil, nil
+	}
+	delete(c.fragments, sender)
+	return c.codec.DecodeString(strings.Join(fragment.chunks, ""))
+}
+
+// Listen reads lines from the server, calling handler for each complete packet, until the connection is closed.
+func (c *ircConn) Listen(reader *bufio.Reader, handler func(sender string, payload []byte)) error {
+	for {
+		line, err := reader.ReadString('\n')
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err == io.EOF {
+			return errors.New("the IRC server closed the connection")
+		} else if err != nil {
+			return err
+		}
+		prefix, command, params := parseIRCLine(line)
+		switch command {
+		case "PING":
+			c.writeLine("PONG :" + strings.Join(params, " "))
+		case "PRIVMSG":
+			if len(params) != 2 {
+				continue
+			}
+			sender := strings.SplitN(prefix, "!", 2)[0]
+			payload, err := c.receive(sender, params[1])
+			if err != nil {
+				logger().Warn("Could not decode IRC message", "error", err)
+				continue
+			}
+			if payload != nil {
+				handler(sender, payload)
+			}
+		}
+	}
+}
+
+func (c *ircConn) Close() error {
+	c.writeLine("QUIT")
+	return c.conn.Close()
+}
+
+// parseIRCLine splits a line into its prefix (without the colon), command and parameters.
+func parseIRCLine(line string) (prefix string, command string, params []string) {
+	line = strings.TrimRight(line, "\r\n")
+	if strings.HasPrefix(line, ":") {
+		prefix, line, _ = strings.Cut(line[1:], " ")
+	}
+	line, trailing, hasTrailing := strings.Cut(line, " :")
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return prefix, "", nil
+	}
+	command, params = strings.ToUpper(fields[0]), fields[1:]
+	if hasTrailing {
+		params = append(params, trailing)
+	}
+	return prefix, command, params
+}
+
+type IRCServerTransport struct {
+	*ircConn
+	reader *bufio.Reader
+}
+
+func (T *IRCServerTransport) Listen(ch chan<- Packet) error {
+	return T.ircConn.Listen(T.reader, func(sender string, payload []byte) {
+		ch <- Packet{Payload: payload, Address: sender}
+	})
+}
+
+// WriteTo sends a payload to a client. The address is the client's nickname.
+func (T *IRCServerTransport) WriteTo(payload []byte, address interface{}) (int, error) {
+	return T.ircConn.Send(address.(string), payload)
+}
+
+type IRCWriter struct {
+	*IRCServerTransport
+	Nick string
+}
+
+func (w IRCWriter) Write(p []byte) (int, error) {
+	return w.IRCServerTransport.WriteTo(p, w.Nick)
+}
+
+// WriterTo returns an io.Writer that writes to an address
+func (T *IRCServerTransport) WriterTo(address interface{}) io.Writer {
+	return IRCWriter{T, address.(string)}
+}
+
+type IRCClientTransport struct {
+	*ircConn
+	reader *bufio.Reader
+	Peer   string
+}
+
+func (T *IRCClientTransport) Listen(ch chan<- []byte) error {
+	return T.ircConn.Listen(T.reader, func(sender string, payload []byte) {
+		if !strings.EqualFold(sender, T.Peer) {
+			logger().Debug("Ignoring IRC message from another user", "sender", sender)
+			return
+		}
+		ch <- payload
+	})
+}
+
+func (T *IRCClientTransport) Write(payload []byte) (int, error) {
+	return T.ircConn.Send(T.Peer, payload)
+}
+
+func CreateIRCServer(config IRCConfig) (IRCServerTransport, error) {
+	conn, err := dialIRC(config)
+	if err != nil {
+		return IRCServerTransport{}, err
+	}
+	reader := bufio.NewReader(conn.conn)
+	err = conn.register(reader)
+	if err != nil {
+		conn.conn.Close()
+		return IRCServerTransport{}, err
+	}
+	return IRCServerTransport{ircConn: conn, reader: reader}, nil
+}
+
+func CreateIRCClient(config IRCConfig) (IRCClientTransport, error) {
+	if config.Peer == "" {
+		return IRCClientTransport{}, fmt.Errorf("no IRC peer nickname")
+	}
+	if config.Nick == "" {
+		session, err := newSessionID()
+		if err != nil {
+			return IRCClientTransport{}, err
+		}
+		// Nicknames are usually limited to 9 characters
+		config.Nick = "biz" + session[:6]
+	}
+	conn, err := dialIRC(config)
+	if err != nil {
+		return IRCClientTransport{}, err
+	}
+	reader := bufio.NewReader(conn.conn)
+	err = conn.register(reader)
+	if err != nil {
+		conn.conn.Close()
+		return IRCClientTransport{}, err
+	}
+	return IRCClientTransport{ircConn: conn, reader: reader, Peer: config.Peer}, nil
+}
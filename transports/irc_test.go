@@ -0,0 +1,235 @@
+package transports
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// ircTestServer is a minimal IRC server that only knows about registration, PING and PRIVMSG between nicks.
+type ircTestServer struct {
+	sync.Mutex
+	listener net.Listener
+	clients  map[string]net.Conn
+}
+
+func startIRCServer(t *testing.T) *ircTestServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		listener.Close()
+	})
+	server := &ircTestServer{listener: listener, clients: make(map[string]net.Conn)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.handle(conn)
+		}
+	}()
+	return server
+}
+
+func (S *ircTestServer) Address() string {
+	return S.listener.Addr().String()
+}
+
+func (S *ircTestServer) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	nick := ""
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		_, command, params := parseIRCLine(line)
+		switch command {
+		case "NICK":
+			S.Lock()
+			if _, taken := S.clients[params[0]]; taken {
+				S.Unlock()
+				fmt.Fprintf(conn, ":test 433 * %s :Nickname is already in use\r\n", params[0])
+				continue
+			}
+			nick = params[0]
+			S.clients[nick] = conn
+			S.Unlock()
+		case "USER":
+			// Ping before welcoming, like many real servers do
+			fmt.Fprintf(conn, "PING :test\r\n:test 001 %s :Welcome\r\n", nick)
+		case "PRIVMSG":
+			S.Lock()
+			target := S.clients[params[0]]
+			S.Unlock()
+			if target != nil {
+				fmt.Fprintf(target, ":%s!%s@test PRIVMSG %s :%s\r\n", nick, nick, params[0], params[1])
+			}
+		}
+	}
+}
+
+func TestParseIRCLine(t *testing.T) {
+	prefix, command, params := parseIRCLine(":alice!a@host privmsg bob :1f 0/1 data: with colon\r\n")
+	if prefix != "alice!a@host" || command != "PRIVMSG" {
+		t.Fatalf("got prefix %q, command %q", prefix, command)
+	}
+	if len(params) != 2 || params[0] != "bob" || params[1] != "1f 0/1 data: with colon" {
+		t.Fatalf("got params %q", params)
+	}
+}
+
+func testIRCRoundTrip(t *testing.T, encoding string) {
+	ircServer := startIRCServer(t)
+	serverConfig := IRCConfig{Server: ircServer.Address(), Nick: "bizsrv", Encoding: encoding, Interval: time.Millisecond}
+	server, err := CreateIRCServer(serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverChan := make(chan Packet)
+	go server.Listen(serverChan)
+
+	clientConfig := IRCConfig{Server: ircServer.Address(), Peer: "bizsrv", Encoding: encoding, Interval: time.Millisecond}
+	client, err := CreateIRCClient(clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientChan := make(chan []byte)
+	go client.Listen(clientChan)
+
+	// Large enough to be split over several lines
+	upstream := bytes.Repeat([]byte{0x45, 0x00, 0xff, 0x3a}, 350)
+	_, err = client.Write(upstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := receive(t, serverChan)
+	if !bytes.Equal(packet.Payload, upstream) {
+		t.Fatalf("server received %x, expected %x", packet.Payload, upstream)
+	}
+
+	// Packets sent at the same time arrive whole
+	var wg sync.WaitGroup
+	for i := byte(0); i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client.Write(bytes.Repeat([]byte{i}, 1000))
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		packet := receive(t, serverChan)
+		if len(packet.Payload) != 1000 {
+			t.Fatalf("server received %d bytes, expected 1000", len(packet.Payload))
+		}
+	}
+	wg.Wait()
+
+	downstream := []byte("short reply")
+	_, err = server.WriterTo(packet.Address).Write(downstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := receive(t, clientChan)
+	if !bytes.Equal(payload, downstream) {
+		t.Fatalf("client received %x, expected %x", payload, downstream)
+	}
+}
+
+func TestIRCRoundTripBase64(t *testing.T) {
+	testIRCRoundTrip(t, "base64")
+}
+
+func TestIRCRoundTripBase85(t *testing.T) {
+	testIRCRoundTrip(t, "base85")
+}
+
+func TestBase85ZeroRuns(t *testing.T) {
+	// IP headers often have runs of zero bytes, which base85 shortens to a single 'z'
+	payloads := [][]byte{
+		make([]byte, 40),
+		append([]byte{0x45, 0x00, 0x00, 0x28, 0, 0, 0, 0, 0, 0, 0, 0, 0x40, 0x06}, make([]byte, 26)...),
+		{1, 0, 0, 0, 0, 2},
+	}
+	codec := base85Codec{}
+	for _, payload := range payloads {
+		encoded := codec.EncodeToString(payload)
+		decoded, err := codec.DecodeString(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decoded, payload) {
+			t.Errorf("%q decoded to %x, expected %x", encoded, decoded, payload)
+		}
+	}
+}
+
+func TestIRCNickInUse(t *testing.T) {
+	ircServer := startIRCServer(t)
+	config := IRCConfig{Server: ircServer.Address(), Nick: "bizsrv"}
+	_, err := CreateIRCServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = CreateIRCServer(config)
+	if err == nil || !strings.Contains(err.Error(), "rejected nickname") {
+		t.Fatalf("expected the nickname to be rejected, got %v", err)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	limiter := rateLimiter{interval: 20 * time.Millisecond}
+	start := time.Now()
+	for i := 0; i < ircBurst; i++ {
+		limiter.Wait()
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Millisecond {
+		t.Fatalf("the initial burst took %s", elapsed)
+	}
+	for i := 0; i < 3; i++ {
+		limiter.Wait()
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Fatalf("lines after the burst were not delayed (%s)", elapsed)
+	}
+}
+
+// TestIRCReceiveLimits checks that other users of the channel cannot make the transport buffer unbounded data.
+func TestIRCReceiveLimits(t *testing.T) {
+	c := &ircConn{codec: base64.RawStdEncoding, fragments: make(map[string]*ircFragment)}
+	for _, text := range []string{"1 0/2000000000 AAAA", "1 -1/2 AAAA", "1 0/2 " + strings.Repeat("A", ircChunkLen+1)} {
+		_, err := c.receive("mallory", text)
+		if err == nil {
+			t.Errorf("%.30s: expected an error", text)
+		}
+	}
+	if len(c.fragments) != 0 {
+		t.Fatalf("got %d partial packets", len(c.fragments))
+	}
+
+	for i := 0; i < ircMaxPartial; i++ {
+		_, err := c.receive(fmt.Sprintf("user%d", i), "1 0/2 AAAA")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := c.receive("mallory", "1 0/2 AAAA")
+	if err == nil {
+		t.Error("expected the partial packet to be refused")
+	}
+	// Packets that fit in a line do not need to be buffered
+	payload, err := c.receive("alice", "1 0/1 AAAA")
+	if err != nil || len(payload) != 3 {
+		t.Errorf("got %x (%v), expected 3 bytes", payload, err)
+	}
+}
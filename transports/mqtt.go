@@ -0,0 +1,273 @@
+package transports
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+var (
+	_ ServerTransport = (*MQTTServerTransport)(nil)
+	_ ClientTransport = (*MQTTClientTransport)(nil)
+)
+
+// How long Close waits for the messages in flight to be delivered, in milliseconds
+const mqttQuiesce = 250
+
+type MQTTConfig struct {
+	Broker   string // The broker URL, eg. "tcp://broker.example.com:1883"
+	Topic    string // The topic prefix; clients publish on <Topic>/up/<session> and subscribe to <Topic>/down/<session>
+	Username string
+	Password string
+}
+
+func init() {
+	Register(Registration{
+		Name:       "mqtt",
+		Preference: 30,
+		NewConfig: func() interface{} {
+			return &MQTTConfig{Topic: "bizarre"}
+		},
+		BindFlags: func(config interface{}, flags *flag.FlagSet) {
+			c := config.(*MQTTConfig)
+			flags.StringVar(&c.Broker, "mqtt-broker", c.Broker, "MQTT broker URL (eg. tcp://broker.example.com:1883)")
+			flags.StringVar(&c.Topic, "mqtt-topic", c.Topic, "MQTT topic prefix")
+			flags.StringVar(&c.Username, "mqtt-username", c.Username, "MQTT username")
+			flags.StringVar(&c.Password, "mqtt-password", c.Password, "MQTT password")
+		},
+		IsConfigured: func(config interface{}) bool {
+			return config.(*MQTTConfig).Broker != ""
+		},
+		NewServer: func(config interface{}) (ServerTransport, error) {
+			c := config.(*MQTTConfig)
+			mqtt, err := CreateMQTTServer(*c)
+			if err != nil {
+				return nil, err
+			}
+			logger().Info("Listening on MQTT", "broker", c.Broker)
+			return &mqtt, nil
+		},
+		NewClient: func(config interface{}) (ClientTransport, error) {
+			c := config.(*MQTTConfig)
+			mqtt, err := CreateMQTTClient(*c)
+			if err != nil {
+				return nil, err
+			}
+			logger().Info("Using MQTT transport", "broker", c.Broker)
+			return &mqtt, nil
+		},
+		Endpoints: func(config interface{}) ([]net.IP, error) {
+			broker, err := url.Parse(config.(*MQTTConfig).Broker)
+			if err != nil {
+				return nil, err
+			}
+			return net.LookupIP(broker.Hostname())
+		},
+	})
+}
+
+func (config MQTTConfig) upstreamTopic(session string) string {
+	return config.Topic + "/up/" + session
+}
+
+func (config MQTTConfig) downstreamTopic(session string) string {
+	return config.Topic + "/down/" + session
+}
+
+// connectMQTT connects to the broker with the given client ID.
+func connectMQTT(config MQTTConfig, clientID string) (mqtt.Client, error) {
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(config.Broker)
+	opts.SetClientID(clientID)
+	opts.SetUsername(config.Username)
+	opts.SetPassword(config.Password)
+	opts.SetAutoReconnect(true)
+	// Messages are datagrams: there is no point in replaying them after a reconnection
+	opts.SetCleanSession(true)
+	client := mqtt.NewClient(opts)
+	token := client.Connect()
+	token.Wait()
+	if err := token.Error(); err != nil {
+		return nil, fmt.Errorf("connecting to MQTT broker: %w", err)
+	}
+	return client, nil
+}
+
+// subscribeMQTT subscribes to a topic, and blocks until the subscription is acknowledged.
+func subscribeMQTT(client mqtt.Client, topic string, handler mqtt.MessageHandler) error {
+	token := client.Subscribe(topic, 0, handler)
+	token.Wait()
+	if err := token.Error(); err != nil {
+		return fmt.Errorf("subscribing to %s: %w", topic, err)
+	}
+	return nil
+}
+
+// newSessionID returns a random identifier that is safe to use as a topic level.
+func newSessionID() (string, error) {
+	buf := make([]byte, 8)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// enqueue hands a received message over to Listen. It runs on the goroutine of paho that also handles keepalives, so
+// it never blocks: if Listen falls behind and the queue is full, the message is dropped.
+func enqueue[T any](recv chan<- T, value T, topic string) bool {
+	select {
+	case recv <- value:
+		return true
+	default:
+		logger().Warn("Dropping MQTT message: the receive queue is full", "topic", topic)
+		return false
+	}
+}
+
+type MQTTServerTransport struct {
+	Client mqtt.Client
+	Config MQTTConfig
+
+	recv   chan Packet
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (T *MQTTServerTransport) Listen(ch chan<- Packet) error {
+	for {
+		select {
+		case packet := <-T.recv:
+			ch <- packet
+		case <-T.closed:
+			return nil
+		}
+	}
+}
+
+func (T *MQTTServerTransport) Close() error {
+	T.once.Do(func() {
+		close(T.closed)
+		T.Client.Disconnect(mqttQuiesce)
+	})
+	return nil
+}
+
+// WriteTo publishes a payload on the downstream topic of a session. The address is the session ID.
+func (T *MQTTServerTransport) WriteTo(payload []byte, address interface{}) (int, error) {
+	token := T.Client.Publish(T.Config.downstreamTopic(address.(string)), 0, false, payload)
+	token.Wait()
+	if err := token.Error(); err != nil {
+		return 0, err
+	}
+	return len(payload), nil
+}
+
+type MQTTWriter struct {
+	*MQTTServerTransport
+	Session string
+}
+
+func (w MQTTWriter) Write(p []byte) (int, error) {
+	return w.MQTTServerTransport.WriteTo(p, w.Session)
+}
+
+// WriterTo returns an io.Writer that writes to an address
+func (T *MQTTServerTransport) WriterTo(address interface{}) io.Writer {
+	return MQTTWriter{T, address.(string)}
+}
+
+type MQTTClientTransport struct {
+	Client  mqtt.Client
+	Config  MQTTConfig
+	Session string
+
+	recv   chan []byte
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (T *MQTTClientTransport) Listen(ch chan<- []byte) error {
+	for {
+		select {
+		case payload := <-T.recv:
+			ch <- payload
+		case <-T.closed:
+			return nil
+		}
+	}
+}
+
+func (T *MQTTClientTransport) Close() error {
+	T.once.Do(func() {
+		close(T.closed)
+		T.Client.Disconnect(mqttQuiesce)
+	})
+	return nil
+}
+
+func (T *MQTTClientTransport) Write(payload []byte) (int, error) {
+	token := T.Client.Publish(T.Config.upstreamTopic(T.Session), 0, false, payload)
+	token.Wait()
+	if err := token.Error(); err != nil {
+		return 0, err
+	}
+	return len(payload), nil
+}
+
+func CreateMQTTServer(config MQTTConfig) (MQTTServerTransport, error) {
+	sessionID, err := newSessionID()
+	if err != nil {
+		return MQTTServerTransport{}, err
+	}
+	client, err := connectMQTT(config, "bizarre-server-"+sessionID)
+	if err != nil {
+		return MQTTServerTransport{}, err
+	}
+
+	recv := make(chan Packet, 64)
+	closed := make(chan struct{})
+	// Subscribe to the upstream topic of every session; the last topic level identifies the client
+	err = subscribeMQTT(client, config.upstreamTopic("+"), func(_ mqtt.Client, msg mqtt.Message) {
+		levels := strings.Split(msg.Topic(), "/")
+		enqueue(recv, Packet{Payload: msg.Payload(), Address: levels[len(levels)-1]}, msg.Topic())
+	})
+	if err != nil {
+		client.Disconnect(0)
+		return MQTTServerTransport{}, err
+	}
+
+	return MQTTServerTransport{Client: client, Config: config, recv: recv, closed: closed}, nil
+}
+
+func CreateMQTTClient(config MQTTConfig) (MQTTClientTransport, error) {
+	session, err := newSessionID()
+	if err != nil {
+		return MQTTClientTransport{}, err
+	}
+	client, err := connectMQTT(config, "bizarre-"+session)
+	if err != nil {
+		return MQTTClientTransport{}, err
+	}
+
+	// Subscribe before anything is sent, so that no reply is lost
+	recv := make(chan []byte, 64)
+	closed := make(chan struct{})
+	err = subscribeMQTT(client, config.downstreamTopic(session), func(_ mqtt.Client, msg mqtt.Message) {
+		enqueue(recv, msg.Payload(), msg.Topic())
+	})
+	if err != nil {
+		client.Disconnect(0)
+		return MQTTClientTransport{}, err
+	}
+
+	return MQTTClientTransport{Client: client, Config: config, Session: session, recv: recv, closed: closed}, nil
+}
@@ -0,0 +1,140 @@
+package transports
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+)
+
+// startBroker runs an embedded MQTT broker on a random port and returns its URL.
+func startBroker(t *testing.T) string {
+	broker := mochi.New(&mochi.Options{InlineClient: false})
+	err := broker.AddHook(new(auth.AllowHook), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcp := listeners.NewTCP(listeners.Config{ID: "test", Address: "127.0.0.1:0"})
+	err = broker.AddListener(tcp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = broker.Serve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		broker.Close()
+	})
+	return "tcp://" + tcp.Address()
+}
+
+func receive[T any](t *testing.T, ch <-chan T) T {
+	select {
+	case value := <-ch:
+		return value
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a message")
+		panic("unreachable")
+	}
+}
+
+func TestMQTTRoundTrip(t *testing.T) {
+	config := MQTTConfig{Broker: startBroker(t), Topic: "bizarre-test"}
+
+	server, err := CreateMQTTServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverChan := make(chan Packet)
+	go server.Listen(serverChan)
+
+	client, err := CreateMQTTClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientChan := make(chan []byte)
+	go client.Listen(clientChan)
+
+	upstream := []byte{0x45, 0x00, 0x01, 0x02}
+	_, err = client.Write(upstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := receive(t, serverChan)
+	if !bytes.Equal(packet.Payload, upstream) {
+		t.Fatalf("server received %x, expected %x", packet.Payload, upstream)
+	}
+	if packet.Address != client.Session {
+		t.Fatalf("server received from session %v, expected %s", packet.Address, client.Session)
+	}
+
+	downstream := []byte{0x45, 0x00, 0x03, 0x04}
+	_, err = server.WriterTo(packet.Address).Write(downstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := receive(t, clientChan)
+	if !bytes.Equal(payload, downstream) {
+		t.Fatalf("client received %x, expected %x", payload, downstream)
+	}
+}
+
+func TestMQTTSessionsAreSeparate(t *testing.T) {
+	config := MQTTConfig{Broker: startBroker(t), Topic: "bizarre-test"}
+
+	server, err := CreateMQTTServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := CreateMQTTClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := CreateMQTTClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aliceChan := make(chan []byte, 1)
+	go alice.Listen(aliceChan)
+	bobChan := make(chan []byte, 1)
+	go bob.Listen(bobChan)
+
+	_, err = server.WriteTo([]byte("for bob"), bob.Session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload := receive(t, bobChan); string(payload) != "for bob" {
+		t.Fatalf("bob received %q", payload)
+	}
+	select {
+	case payload := <-aliceChan:
+		t.Fatalf("alice received %q, which was meant for bob", payload)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+// TestMQTTEnqueueDoesNotBlock checks that messages are dropped rather than stalling the MQTT client when nothing reads
+// them.
+func TestMQTTEnqueueDoesNotBlock(t *testing.T) {
+	recv := make(chan []byte, 1)
+	done := make(chan bool)
+	go func() {
+		enqueue(recv, []byte("first"), "test")
+		done <- enqueue(recv, []byte("second"), "test")
+	}()
+	select {
+	case ok := <-done:
+		if ok {
+			t.Error("expected the second message to be dropped")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("enqueueing blocked")
+	}
+	if payload := <-recv; string(payload) != "first" {
+		t.Errorf("got %q, expected the first message", payload)
+	}
+}
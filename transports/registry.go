@@ -0,0 +1,81 @@
+package transports
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+)
+
+// Registration describes a transport, so that it can be selected by name (eg. with -transport=<name>).
+// Transports in other packages can register themselves from an init function.
+type Registration struct {
+	Name string
+	// Preference orders the transports that are used when none is selected explicitly; lower is preferred.
+	Preference int
+
+	// NewConfig returns a pointer to a config struct filled with the defaults. The struct is also the schema of
+	// the transport's section in config files.
+	NewConfig func() interface{}
+	// BindFlags binds the transport's flags to a config returned by NewConfig. Flags should be prefixed by the
+	// transport name to avoid collisions (eg. -udp-address).
+	BindFlags func(config interface{}, flags *flag.FlagSet)
+	// IsConfigured reports whether enough of the config was filled for the transport to be used without being
+	// selected explicitly. Optional.
+	IsConfigured func(config interface{}) bool
+	// IsServerConfigured does the same for the server side, if it needs other fields than the client side (eg. a
+	// port to listen on rather than an address to connect to). Optional; IsConfigured is used if nil.
+	IsServerConfigured func(config interface{}) bool
+
+	// NewServer and NewClient create the transport from a config returned by NewConfig. Either can be nil if the
+	// transport only has one side.
+	NewServer func(config interface{}) (ServerTransport, error)
+	NewClient func(config interface{}) (ClientTransport, error)
+	// Endpoints resolves the addresses that the client side sends messages to over IP (the server, or a relay such
+	// as a broker), so that the client can keep them out of the tunnel before it connects. Optional.
+	Endpoints func(config interface{}) ([]net.IP, error)
+}
+
+var (
+	registryLock sync.Mutex
+	registry     = make(map[string]Registration)
+)
+
+// Register adds a transport to the registry. It panics if the name is already taken.
+func Register(transport Registration) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	if _, ok := registry[transport.Name]; ok {
+		panic(fmt.Sprintf("transport %q registered twice", transport.Name))
+	}
+	if transport.NewConfig == nil {
+		panic(fmt.Sprintf("transport %q has no NewConfig", transport.Name))
+	}
+	registry[transport.Name] = transport
+}
+
+// Lookup returns the registration of the transport with the given name.
+func Lookup(name string) (Registration, bool) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	transport, ok := registry[name]
+	return transport, ok
+}
+
+// Registered returns every registered transport, in order of preference.
+func Registered() []Registration {
+	registryLock.Lock()
+	var ret []Registration
+	for _, transport := range registry {
+		ret = append(ret, transport)
+	}
+	registryLock.Unlock()
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Preference != ret[j].Preference {
+			return ret[i].Preference < ret[j].Preference
+		}
+		return ret[i].Name < ret[j].Name
+	})
+	return ret
+}
@@ -0,0 +1,97 @@
+package transports
+
+import (
+	"flag"
+	"testing"
+)
+
+type loopbackConfig struct {
+	Greeting string
+}
+
+type loopbackTransport struct {
+	Greeting string
+}
+
+func (T *loopbackTransport) Listen(ch chan<- []byte) error {
+	return nil
+}
+
+func (T *loopbackTransport) Close() error {
+	return nil
+}
+
+func (T *loopbackTransport) Write(payload []byte) (int, error) {
+	return len(payload), nil
+}
+
+func TestRegistry(t *testing.T) {
+	Register(Registration{
+		Name: "loopback-test",
+		NewConfig: func() interface{} {
+			return &loopbackConfig{Greeting: "hello"}
+		},
+		BindFlags: func(config interface{}, flags *flag.FlagSet) {
+			c := config.(*loopbackConfig)
+			flags.StringVar(&c.Greeting, "loopback-greeting", c.Greeting, "")
+		},
+		NewClient: func(config interface{}) (ClientTransport, error) {
+			return &loopbackTransport{Greeting: config.(*loopbackConfig).Greeting}, nil
+		},
+	})
+
+	config := TransportConfig{}
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	PartialConfigFromFlags(&config, flags)
+	err := flags.Parse([]string{"-transport=loopback-test", "-loopback-greeting=hi", "-udp-address=127.0.0.1:1917"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	selected, err := NewClientTransports(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(selected) != 1 || selected[0].Name != "loopback-test" {
+		t.Fatalf("expected only the loopback transport to be selected, got %+v", selected)
+	}
+	if greeting := selected[0].ClientTransport.(*loopbackTransport).Greeting; greeting != "hi" {
+		t.Fatalf("flag was not applied: greeting is %q", greeting)
+	}
+
+	_, err = NewServerTransports(config)
+	if err == nil {
+		t.Fatal("expected an error for a transport without a server side")
+	}
+	_, err = NewClientTransport("nonexistent", config)
+	if err == nil {
+		t.Fatal("expected an error for an unknown transport")
+	}
+}
+
+// TestServerConfiguredByPort checks that servers use DNS when only its port is set, as they do not connect to an
+// address like clients do.
+func TestServerConfiguredByPort(t *testing.T) {
+	config := TransportConfig{}
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	PartialConfigFromFlags(&config, flags)
+	err := flags.Parse([]string{"-dns-port=5353"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	selected, err := NewServerTransports(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(selected) != 1 || selected[0].Name != "dns" {
+		t.Fatalf("expected the DNS transport to be selected, got %+v", selected)
+	}
+	if port := selected[0].ServerTransport.(*DNSServerTransport).Server.Addr; port != ":5353" {
+		t.Errorf("expected to listen on :5353, got %q", port)
+	}
+	_, err = NewClientTransports(config)
+	if err == nil {
+		t.Error("expected clients to need the address of the DNS server")
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"net"
+	"strings"
 )
 
 type Packet struct {
@@ -12,68 +14,267 @@ type Packet struct {
 	Address interface{}
 }
 
+// ServerTransport receives the messages of clients, and sends them replies.
 type ServerTransport interface {
-	Listen(ch chan<- Packet)
+	// Listen sends the messages it receives to ch until the transport is closed, in which case it returns nil, or
+	// until receiving fails.
+	Listen(ch chan<- Packet) error
 	WriteTo(payload []byte, address interface{}) (int, error)
 	WriterTo(address interface{}) io.Writer // todo: deduplicate this
+	io.Closer
 }
 
+// ClientTransport sends messages to a server, and receives its replies.
 type ClientTransport interface {
-	Listen(ch chan<- []byte)
+	// Listen sends the messages it receives to ch until the transport is closed, in which case it returns nil, or
+	// until receiving fails.
+	Listen(ch chan<- []byte) error
 	Write(payload []byte) (int, error)
+	io.Closer
+}
+
+// PayloadLimiter is implemented by transports that carry messages of limited size. MaxPayload returns the size of
+// the largest message, after accounting for the framing of the transport and for the headers of the medium, so that
+// messages of that size are neither fragmented nor truncated.
+type PayloadLimiter interface {
+	MaxPayload() int
+}
+
+// Queuer is implemented by transports that hold messages until they can be sent, such as DNS servers, which can only
+// send them in the answers to queries. Len returns the number of messages that are waiting.
+type Queuer interface {
+	Len() int
+}
+
+// MaxPayload returns the size of the largest message that every given transport carries, or 0 if none of them has a
+// limit of its own.
+func MaxPayload(transports ...interface{}) int {
+	limit := 0
+	for _, transport := range transports {
+		if limiter, ok := transport.(PayloadLimiter); ok {
+			if max := limiter.MaxPayload(); max != 0 && (limit == 0 || max < limit) {
+				limit = max
+			}
+		}
+	}
+	return limit
+}
+
+// logger returns the logger of the transports: the default one, tagged with their subsystem. The key and value are
+// bizarre.SubsystemKey and SubsystemTransport, which this package cannot import.
+func logger() *slog.Logger {
+	return slog.Default().With("subsystem", "transport")
+}
+
+// packetLogger returns the logger for per-packet messages, which are sampled. It is meant to be kept by transports,
+// rather than called for every packet.
+func packetLogger() *slog.Logger {
+	return slog.Default().With("subsystem", "packet")
+}
+
+// hostIPs resolves the host part of an address of the form host:port.
+func hostIPs(address string) ([]net.IP, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	return net.LookupIP(host)
+}
+
+// NameList is a comma-separated list of transport names, usable as a flag.
+type NameList []string
+
+func (L *NameList) String() string {
+	return strings.Join(*L, ",")
+}
+
+func (L *NameList) Set(value string) error {
+	*L = nil
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			*L = append(*L, name)
+		}
+	}
+	return nil
 }
 
 type TransportConfig struct {
-	UDPConfig UDPConfig
-	DNSConfig DNSConfig
+	Names NameList // The selected transports, in order of preference
+
+	// Configs holds the config of every registered transport, indexed by name
+	Configs map[string]interface{}
+}
+
+// NewTransportConfig returns a TransportConfig with the default config of every registered transport.
+func NewTransportConfig() TransportConfig {
+	config := TransportConfig{Configs: make(map[string]interface{})}
+	for _, transport := range Registered() {
+		config.Configs[transport.Name] = transport.NewConfig()
+	}
+	return config
 }
 
 // PartialConfigFromFlags binds a flagset to a TransportConfig struct, so that the config is filled upon parsing the flags.
 func PartialConfigFromFlags(config *TransportConfig, flags *flag.FlagSet) {
-	flags.StringVar(&config.DNSConfig.Endpoint, "dns-address", "", "DNS server address")
-	flags.IntVar(&config.DNSConfig.Port, "dns-port", 53, "DNS server port")
-	flags.StringVar(&config.DNSConfig.RootDomain, "dns-root", "biz", "DNS root domain including TLD")
-	flags.StringVar(&config.UDPConfig.Endpoint, "udp-address", "", "UDP server address")
+	if config.Configs == nil {
+		*config = NewTransportConfig()
+	}
+	flags.Var(&config.Names, "transport", "Comma-separated list of transports in order of preference (default: every configured transport)")
+	for _, transport := range Registered() {
+		if transport.BindFlags != nil {
+			transport.BindFlags(config.Configs[transport.Name], flags)
+		}
+	}
 }
 
-// NewServerTransport creates a ServerTransport from a TransportConfig.
-func NewServerTransport(config TransportConfig) (ServerTransport, error) {
-	if config.UDPConfig.Endpoint != "" {
-		udp, err := CreateUDPServer(config.UDPConfig)
-		if err != nil {
-			return nil, err
+// lookupConfig returns the registration of a transport and its config.
+func lookupConfig(name string, config TransportConfig) (Registration, interface{}, error) {
+	transport, ok := Lookup(name)
+	if !ok {
+		return Registration{}, nil, fmt.Errorf("unknown transport %q", name)
+	}
+	transportConfig, ok := config.Configs[name]
+	if !ok {
+		transportConfig = transport.NewConfig()
+	}
+	return transport, transportConfig, nil
+}
+
+// configuredNames returns the names of the transports whose config is filled for the client or server side, in order
+// of preference.
+func configuredNames(config TransportConfig, server bool) NameList {
+	var names NameList
+	for _, transport := range Registered() {
+		transportConfig, ok := config.Configs[transport.Name]
+		isConfigured := transport.IsConfigured
+		if server && transport.IsServerConfigured != nil {
+			isConfigured = transport.IsServerConfigured
 		}
-		log.Printf("Listening on UDP with IP %s\n", config.UDPConfig.Endpoint)
-		return &udp, nil
-	} else if config.DNSConfig.Port != 0 {
-		dns, err := CreateDNSServer(config.DNSConfig)
+		if ok && isConfigured != nil && isConfigured(transportConfig) {
+			names = append(names, transport.Name)
+		}
+	}
+	return names
+}
+
+// NamedServerTransport is a ServerTransport along with the name it was selected with (eg. "udp").
+type NamedServerTransport struct {
+	Name string
+	ServerTransport
+}
+
+// NewServerTransport creates the ServerTransport with the given name from a TransportConfig.
+func NewServerTransport(name string, config TransportConfig) (ServerTransport, error) {
+	transport, transportConfig, err := lookupConfig(name, config)
+	if err != nil {
+		return nil, err
+	}
+	if transport.NewServer == nil {
+		return nil, fmt.Errorf("transport %q has no server side", name)
+	}
+	return transport.NewServer(transportConfig)
+}
+
+// NewServerTransports creates the ServerTransports selected in a TransportConfig.
+// If no transport is explicitly selected, only the most preferred configured one is used.
+func NewServerTransports(config TransportConfig) ([]NamedServerTransport, error) {
+	names := config.Names
+	if len(names) == 0 {
+		names = configuredNames(config, true)
+		if len(names) > 1 {
+			names = names[:1]
+		}
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no transport selected")
+	}
+	var ret []NamedServerTransport
+	for _, name := range names {
+		transport, err := NewServerTransport(name, config)
 		if err != nil {
-			return nil, err
+			for _, created := range ret {
+				created.Close()
+			}
+			return nil, fmt.Errorf("%s: %w", name, err)
 		}
-		log.Printf("Listening on DNS with port %d\n", config.DNSConfig.Port)
-		return &dns, nil
-	} else {
+		ret = append(ret, NamedServerTransport{Name: name, ServerTransport: transport})
+	}
+	return ret, nil
+}
+
+// NamedClientTransport is a ClientTransport along with the name it was selected with (eg. "udp").
+type NamedClientTransport struct {
+	Name string
+	ClientTransport
+}
+
+// NewClientTransport creates the ClientTransport with the given name from a TransportConfig.
+func NewClientTransport(name string, config TransportConfig) (ClientTransport, error) {
+	transport, transportConfig, err := lookupConfig(name, config)
+	if err != nil {
+		return nil, err
+	}
+	if transport.NewClient == nil {
+		return nil, fmt.Errorf("transport %q has no client side", name)
+	}
+	return transport.NewClient(transportConfig)
+}
+
+// clientNames returns the names of the client transports selected in a TransportConfig, in order of preference.
+// If no transport is explicitly selected, every configured transport is used.
+func clientNames(config TransportConfig) (NameList, error) {
+	names := config.Names
+	if len(names) == 0 {
+		names = configuredNames(config, false)
+	}
+	if len(names) == 0 {
 		return nil, fmt.Errorf("no transport selected")
 	}
+	return names, nil
 }
 
-// NewClientTransport creates a ClientTransport from a TransportConfig.
-func NewClientTransport(config TransportConfig) (ClientTransport, error) {
-	if config.UDPConfig.Endpoint != "" {
-		udp, err := CreateUDPClient(config.UDPConfig)
+// ClientEndpoints resolves the addresses that the ClientTransports selected in a TransportConfig will send their
+// messages to.
+func ClientEndpoints(config TransportConfig) ([]net.IP, error) {
+	names, err := clientNames(config)
+	if err != nil {
+		return nil, err
+	}
+	var ret []net.IP
+	for _, name := range names {
+		transport, transportConfig, err := lookupConfig(name, config)
 		if err != nil {
 			return nil, err
 		}
-		log.Printf("Using UDP transport with IP %s\n", config.UDPConfig.Endpoint)
-		return &udp, nil
-	} else if config.DNSConfig.Endpoint != "" {
-		udp, err := CreateDNSClient(config.DNSConfig)
+		if transport.Endpoints == nil {
+			continue
+		}
+		ips, err := transport.Endpoints(transportConfig)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("%s: %w", name, err)
 		}
-		log.Printf("Using DNS transport with IP %s\n", config.DNSConfig.Endpoint)
-		return &udp, nil
-	} else {
-		return nil, fmt.Errorf("no transport selected")
+		ret = append(ret, ips...)
+	}
+	return ret, nil
+}
+
+// NewClientTransports creates the ClientTransports selected in a TransportConfig, in order of preference.
+// If no transport is explicitly selected, every configured transport is used.
+func NewClientTransports(config TransportConfig) ([]NamedClientTransport, error) {
+	names, err := clientNames(config)
+	if err != nil {
+		return nil, err
+	}
+	var ret []NamedClientTransport
+	for _, name := range names {
+		transport, err := NewClientTransport(name, config)
+		if err != nil {
+			for _, created := range ret {
+				created.Close()
+			}
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		ret = append(ret, NamedClientTransport{Name: name, ClientTransport: transport})
 	}
+	return ret, nil
 }
@@ -1,34 +1,105 @@
 package transports
 
 import (
+	"errors"
+	"flag"
 	"io"
 	"net"
+	"syscall"
 )
 
 var (
 	_ ServerTransport = (*UDPServerTransport)(nil)
 	_ ClientTransport = (*UDPClientTransport)(nil)
+	_ PayloadLimiter  = (*UDPServerTransport)(nil)
+	_ PayloadLimiter  = (*UDPClientTransport)(nil)
 )
 
+const (
+	// The largest datagrams that are not fragmented on an Ethernet path, after the IP and UDP headers
+	udpMaxPayload4 = 1500 - 20 - 8
+	udpMaxPayload6 = 1500 - 40 - 8
+	// Reads must not truncate datagrams, even if they were fragmented along the way
+	udpReadBufferSize = 65535
+)
+
+// udpMaxPayload returns the largest datagram that is not fragmented on the way to or from an address.
+func udpMaxPayload(addr net.Addr) int {
+	if udpAddr, ok := addr.(*net.UDPAddr); ok && udpAddr.IP.To4() != nil {
+		return udpMaxPayload4
+	}
+	// Including unspecified addresses, which may receive IPv6 datagrams as well
+	return udpMaxPayload6
+}
+
 type UDPConfig struct {
 	Endpoint string // The UDP address to connect to
 }
 
+func init() {
+	Register(Registration{
+		Name:       "udp",
+		Preference: 10,
+		NewConfig: func() interface{} {
+			return &UDPConfig{}
+		},
+		BindFlags: func(config interface{}, flags *flag.FlagSet) {
+			c := config.(*UDPConfig)
+			flags.StringVar(&c.Endpoint, "udp-address", c.Endpoint, "UDP server address")
+		},
+		IsConfigured: func(config interface{}) bool {
+			return config.(*UDPConfig).Endpoint != ""
+		},
+		NewServer: func(config interface{}) (ServerTransport, error) {
+			c := config.(*UDPConfig)
+			udp, err := CreateUDPServer(*c)
+			if err != nil {
+				return nil, err
+			}
+			logger().Info("Listening on UDP", "address", c.Endpoint)
+			return &udp, nil
+		},
+		NewClient: func(config interface{}) (ClientTransport, error) {
+			c := config.(*UDPConfig)
+			udp, err := CreateUDPClient(*c)
+			if err != nil {
+				return nil, err
+			}
+			logger().Info("Using UDP transport", "address", c.Endpoint)
+			return &udp, nil
+		},
+		Endpoints: func(config interface{}) ([]net.IP, error) {
+			return hostIPs(config.(*UDPConfig).Endpoint)
+		},
+	})
+}
+
 type UDPServerTransport struct {
 	Conn net.UDPConn
 }
 
-func (T *UDPServerTransport) Listen(ch chan<- Packet) {
-	buffer := make([]byte, 1500)
+func (T *UDPServerTransport) Listen(ch chan<- Packet) error {
+	buffer := make([]byte, udpReadBufferSize)
 	for {
 		n, addr, err := T.Conn.ReadFromUDP(buffer)
-		if err != nil {
-			panic(err)
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err != nil {
+			return err
 		}
-		ch <- Packet{Payload: buffer[:n], Address: addr}
+		// Packets are processed concurrently with the next read, so each one needs a copy
+		ch <- Packet{Payload: append([]byte(nil), buffer[:n]...), Address: addr}
 	}
 }
 
+func (T *UDPServerTransport) Close() error {
+	return T.Conn.Close()
+}
+
+func (T *UDPServerTransport) MaxPayload() int {
+	return udpMaxPayload(T.Conn.LocalAddr())
+}
+
 func (T *UDPServerTransport) WriteTo(payload []byte, address interface{}) (int, error) {
 	return T.Conn.WriteToUDP(payload, address.(*net.UDPAddr))
 }
@@ -51,17 +122,30 @@ type UDPClientTransport struct {
 	Conn net.UDPConn
 }
 
-func (T *UDPClientTransport) Listen(ch chan<- []byte) {
-	buffer := make([]byte, 1500)
+func (T *UDPClientTransport) Listen(ch chan<- []byte) error {
+	buffer := make([]byte, udpReadBufferSize)
 	for {
 		n, err := T.Conn.Read(buffer)
-		if err != nil {
-			panic(err)
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if errors.Is(err, syscall.ECONNREFUSED) {
+			// An ICMP error for an earlier datagram: the server is not running yet, or is restarting
+			continue
+		} else if err != nil {
+			return err
 		}
-		ch <- buffer[:n]
+		ch <- append([]byte(nil), buffer[:n]...)
 	}
 }
 
+func (T *UDPClientTransport) Close() error {
+	return T.Conn.Close()
+}
+
+func (T *UDPClientTransport) MaxPayload() int {
+	return udpMaxPayload(T.Conn.RemoteAddr())
+}
+
 func (T *UDPClientTransport) Write(payload []byte) (int, error) {
 	return T.Conn.Write(payload)
 }
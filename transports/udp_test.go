@@ -0,0 +1,60 @@
+package transports
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUDPMaxPayload(t *testing.T) {
+	tests := map[string]int{
+		"127.0.0.1:1917": udpMaxPayload4,
+		"[::1]:1917":     udpMaxPayload6,
+	}
+	for endpoint, expected := range tests {
+		udp, err := CreateUDPClient(UDPConfig{Endpoint: endpoint})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if max := udp.MaxPayload(); max != expected {
+			t.Errorf("%s: got %d, expected %d", endpoint, max, expected)
+		}
+		udp.Conn.Close()
+	}
+
+	v4, _ := CreateUDPClient(UDPConfig{Endpoint: "127.0.0.1:1917"})
+	defer v4.Conn.Close()
+	if max := MaxPayload(&v4, &IRCClientTransport{}); max != udpMaxPayload4 {
+		t.Errorf("got %d for UDP and IRC, expected the limit of UDP", max)
+	}
+}
+
+func TestUDPClose(t *testing.T) {
+	server, err := CreateUDPServer(UDPConfig{Endpoint: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := CreateUDPClient(UDPConfig{Endpoint: server.Conn.LocalAddr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverErr, clientErr := make(chan error, 1), make(chan error, 1)
+	serverChan := make(chan Packet, 1)
+	go func() { serverErr <- server.Listen(serverChan) }()
+	go func() { clientErr <- client.Listen(make(chan []byte)) }()
+
+	// Close must unblock a listener that is waiting for a datagram
+	client.Write([]byte("ping"))
+	<-serverChan
+	server.Close()
+	client.Close()
+	for name, listenErr := range map[string]chan error{"server": serverErr, "client": clientErr} {
+		select {
+		case err := <-listenErr:
+			if err != nil {
+				t.Errorf("%s: Listen returned %s after Close", name, err)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%s: Listen did not return after Close", name)
+		}
+	}
+}